@@ -27,13 +27,25 @@ func run() error {
 
 	repository := storage.NewRepository()
 	sender := agent.NewMetricSender(cnf.Address)
+	// metadata is declared once, the server may be not up yet so it is retried on every report
+	declared := false
 	var i = 1
 	for {
 		if i%int(cnf.PollInterval/time.Second) == 0 {
 			agent.CollectMemMetrics(repository)
 		}
 		if i%int(cnf.ReportInterval/time.Second) == 0 {
-			agent.SendMetrics(repository, sender)
+			if !declared {
+				if err = sender.DeclareMetrics(agent.Descriptors()); err != nil {
+					log.Printf("problems with declaring metrics %v", err)
+				}
+				declared = err == nil
+			}
+			if cnf.BatchReport {
+				agent.SendMetricsBatch(repository, sender)
+			} else {
+				agent.SendMetrics(repository, sender)
+			}
 			i = 0
 		}
 		time.Sleep(time.Second * 1) // very naive proven to errors
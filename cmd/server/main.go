@@ -4,13 +4,18 @@ import (
 	"context"
 	"errors"
 	"github.com/rkinwork/musthave-metrics/internal/config"
+	"github.com/rkinwork/musthave-metrics/internal/graphite"
+	"github.com/rkinwork/musthave-metrics/internal/influx"
 	"github.com/rkinwork/musthave-metrics/internal/logger"
 	"github.com/rkinwork/musthave-metrics/internal/server"
+	"github.com/rkinwork/musthave-metrics/internal/statsd"
 	"github.com/rkinwork/musthave-metrics/internal/storage"
 	"go.uber.org/zap"
+	"io"
 	"log"
 	"net/http"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
@@ -32,12 +37,110 @@ func run() error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	metricSaver := storage.NewMetricsSaver(
-		cnf,
-		&storage.JSONFileSaver{FilePath: cnf.FileStoragePath, IMetricRepository: storage.NewRepository()},
-	)
-	metricSaver.Start(ctx)
-	serverRouter := server.NewMetricsRouter(metricSaver)
+	repo, err := storage.NewBackend(cnf)
+	if err != nil {
+		log.Fatalf("problems with storage %v", err)
+	}
+	if closer, ok := repo.(io.Closer); ok {
+		defer func() {
+			if err := closer.Close(); err != nil {
+				log.Printf("problems with closing storage %v", err)
+			}
+		}()
+	}
+	metricSaver := storage.NewMetricsSaver(cnf, repo)
+	routerOptions := []server.RouterOption{server.WithSnapshots(metricSaver)}
+	if cnf.DedupWindow > 0 {
+		// keys outliving metrics kept in memory would make retries after a restart look applied
+		var keysPath string
+		if cnf.StorageType != config.MemoryStorageType {
+			keysPath = companionPath(cnf, ".idempotency")
+		}
+		idempotency := storage.NewIdempotencyStore(keysPath, cnf.DedupWindow)
+		if err = idempotency.Load(); err != nil {
+			log.Printf("problems with idempotency keys, starting without them %v", err)
+		}
+		idempotency.Start(ctx)
+		metricSaver.Idempotency = idempotency
+		routerOptions = append(routerOptions, server.WithIdempotency(idempotency))
+	}
+	if err = metricSaver.Start(); err != nil {
+		log.Fatalf("problems with storage %v", err)
+	}
+	var repository storage.IMetricRepository = metricSaver
+	if cnf.HistoryDepth > 0 {
+		tiers, err := storage.ParseRollupTiers(cnf.HistoryRollups)
+		if err != nil {
+			log.Fatalf("problems with history config %v", err)
+		}
+		history := storage.NewMetricHistory(cnf.HistoryDepth, cnf.HistoryRetention, tiers...)
+		history.MaxSeries = cnf.HistorySeries
+		history.Start(ctx)
+		repository = storage.NewHistoryRecorder(repository, history)
+		routerOptions = append(routerOptions, server.WithHistory(history))
+	}
+	registry := storage.NewTypeRegistry()
+	registry.Path = companionPath(cnf, ".metadata")
+	if err = registry.Load(); err != nil {
+		log.Printf("problems with saved metric declarations, starting without them %v", err)
+	}
+	if cnf.Declarations != "" {
+		descriptors, err := storage.LoadDescriptors(cnf.Declarations)
+		if err != nil {
+			log.Fatalf("problems with metric declarations %v", err)
+		}
+		for _, d := range descriptors {
+			if err = registry.Declare(d); err != nil {
+				log.Fatalf("problems with metric declarations %v", err)
+			}
+		}
+	}
+	repository = storage.NewTypeGuard(repository, registry)
+	routerOptions = append(routerOptions, server.WithRegistry(registry))
+	pushGroups := storage.NewPushGroups()
+	pushGroups.Path = companionPath(cnf, ".pushgroups")
+	if err = pushGroups.Load(); err != nil {
+		log.Printf("problems with saved push groups, starting without them %v", err)
+	}
+	routerOptions = append(routerOptions, server.WithPushGroups(pushGroups))
+	ttlRules, err := storage.ParseTTLRules(cnf.MetricTTLRules)
+	if err != nil {
+		log.Fatalf("problems with ttl config %v", err)
+	}
+	if ttlPolicy := (storage.TTLPolicy{Default: cnf.MetricTTL, Rules: ttlRules}); ttlPolicy.Enabled() {
+		storage.NewTTLSweeper(repository, ttlPolicy).Start(ctx)
+	}
+	influxTypes, err := influx.ParseTypeRules(cnf.InfluxTypeRules)
+	if err != nil {
+		log.Fatalf("problems with influx config %v", err)
+	}
+	influxMapping := influx.Mapping{Types: influxTypes}
+	if cnf.InfluxNameTags != "" {
+		influxMapping.NameTags = strings.Split(cnf.InfluxNameTags, ",")
+	}
+	routerOptions = append(routerOptions, server.WithInfluxMapping(influxMapping))
+	var statsdServer *statsd.Server
+	if cnf.StatsdAddress != "" && cnf.StatsdFlush > 0 {
+		statsdServer = statsd.NewServer(cnf.StatsdAddress, cnf.StatsdFlush, repository)
+		statsdServer.MaxSeries = cnf.StatsdSeries
+		if err = statsdServer.Start(ctx); err != nil {
+			log.Fatalf("problems with statsd listener %v", err)
+		}
+	}
+	var graphiteServer *graphite.Server
+	if cnf.GraphiteAddress != "" {
+		rules, err := graphite.ParseRules(cnf.GraphiteRules)
+		if err != nil {
+			log.Fatalf("problems with graphite rules %v", err)
+		}
+		graphiteServer = graphite.NewServer(cnf.GraphiteAddress, rules, repository)
+		graphiteServer.MaxConns = cnf.GraphiteConns
+		graphiteServer.IdleTimeout = cnf.GraphiteIdle
+		if err = graphiteServer.Start(ctx); err != nil {
+			log.Fatalf("problems with graphite listener %v", err)
+		}
+	}
+	serverRouter := server.NewMetricsRouter(repository, routerOptions...)
 	srv := &http.Server{Addr: cnf.Address, Handler: serverRouter}
 
 	go func() {
@@ -50,6 +153,21 @@ func run() error {
 	if err = srv.Shutdown(context.TODO()); err != nil { // Use here context with a required timeout
 		log.Printf("server shutdown returned an err: %v\n", err)
 	}
-	metricSaver.Done()
+	if statsdServer != nil {
+		statsdServer.Done()
+	}
+	if graphiteServer != nil {
+		graphiteServer.Done()
+	}
+	// listeners have flushed their last samples, now they can be saved
+	metricSaver.Stop()
 	return err
 }
+
+// companionPath returns a file next to the file storage, it is empty when there is no file storage
+func companionPath(cnf *config.Config, suffix string) string {
+	if cnf.FileStoragePath == "" {
+		return ""
+	}
+	return cnf.FileStoragePath + suffix
+}
@@ -3,14 +3,22 @@ package agent
 import (
 	"bytes"
 	"compress/gzip"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	"github.com/rkinwork/musthave-metrics/internal/storage"
 	"log"
 	"math/rand"
+	"net/http"
+	"os"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const PollCount = `PollCount`
@@ -19,209 +27,260 @@ const retries = 3
 type MemExtractor struct {
 	ID          string
 	MType       string
+	Unit        string
+	Description string
 	ExtractorFn func(*runtime.MemStats) string
 }
 
 var presets = map[string]MemExtractor{
 	PollCount: {
-		ID:    PollCount,
-		MType: storage.CounterMetric,
+		ID:          PollCount,
+		MType:       storage.CounterMetric,
+		Description: "Number of times runtime metrics were collected",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return "1"
 		},
 	},
 	`RandomValue`: {
-		ID:    `RandomValue`,
-		MType: storage.GaugeMetric,
+		ID:          `RandomValue`,
+		MType:       storage.GaugeMetric,
+		Description: "Random value to check delivery",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf(`%f`, rand.Float64())
 		},
 	},
 	`Alloc`: {
-		ID:    `Alloc`,
-		MType: storage.GaugeMetric,
+		ID:          `Alloc`,
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of allocated heap objects",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf(`%d`, stats.Alloc)
 		},
 	},
 	"BuckHashSys": {
-		ID:    "BuckHashSys",
-		MType: storage.GaugeMetric,
+		ID:          "BuckHashSys",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of memory in profiling bucket hash tables",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.BuckHashSys)
 		},
 	},
 	"Frees": {
-		ID:    "Frees",
-		MType: storage.GaugeMetric,
+		ID:          "Frees",
+		MType:       storage.GaugeMetric,
+		Description: "Cumulative count of heap objects freed",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.Frees)
 		},
 	},
 	"GCCPUFraction": {
-		ID:    "GCCPUFraction",
-		MType: storage.GaugeMetric,
+		ID:          "GCCPUFraction",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitRatio,
+		Description: "Fraction of CPU time used by the GC since the program started",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%f", stats.GCCPUFraction)
 		},
 	},
 	"GCSys": {
-		ID:    "GCSys",
-		MType: storage.GaugeMetric,
+		ID:          "GCSys",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of memory in garbage collection metadata",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.GCSys)
 		},
 	},
 	"HeapAlloc": {
-		ID:    "HeapAlloc",
-		MType: storage.GaugeMetric,
+		ID:          "HeapAlloc",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of allocated heap objects",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.HeapAlloc)
 		},
 	},
 	"HeapIdle": {
-		ID:    "HeapIdle",
-		MType: storage.GaugeMetric,
+		ID:          "HeapIdle",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes in idle heap spans",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.HeapIdle)
 		},
 	},
 	"HeapInuse": {
-		ID:    "HeapInuse",
-		MType: storage.GaugeMetric,
+		ID:          "HeapInuse",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes in in-use heap spans",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.HeapInuse)
 		},
 	},
 	"HeapObjects": {
-		ID:    "HeapObjects",
-		MType: storage.GaugeMetric,
+		ID:          "HeapObjects",
+		MType:       storage.GaugeMetric,
+		Description: "Number of allocated heap objects",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.HeapObjects)
 		},
 	},
 	"HeapReleased": {
-		ID:    "HeapReleased",
-		MType: storage.GaugeMetric,
+		ID:          "HeapReleased",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of physical memory returned to the OS",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.HeapReleased)
 		},
 	},
 	"HeapSys": {
-		ID:    "HeapSys",
-		MType: storage.GaugeMetric,
+		ID:          "HeapSys",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of heap memory obtained from the OS",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.HeapSys)
 		},
 	},
 	"LastGC": {
-		ID:    "LastGC",
-		MType: storage.GaugeMetric,
+		ID:          "LastGC",
+		MType:       storage.GaugeMetric,
+		Description: "Time the last garbage collection finished, as nanoseconds since the Unix epoch",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.LastGC)
 		},
 	},
 	"Lookups": {
-		ID:    "Lookups",
-		MType: storage.GaugeMetric,
+		ID:          "Lookups",
+		MType:       storage.GaugeMetric,
+		Description: "Number of pointer lookups performed by the runtime",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.Lookups)
 		},
 	},
 	"MCacheInuse": {
-		ID:    "MCacheInuse",
-		MType: storage.GaugeMetric,
+		ID:          "MCacheInuse",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of allocated mcache structures",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.MCacheInuse)
 		},
 	},
 	"MCacheSys": {
-		ID:    "MCacheSys",
-		MType: storage.GaugeMetric,
+		ID:          "MCacheSys",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of memory obtained from the OS for mcache structures",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.MCacheSys)
 		},
 	},
 	"MSpanInuse": {
-		ID:    "MSpanInuse",
-		MType: storage.GaugeMetric,
+		ID:          "MSpanInuse",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of allocated mspan structures",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.MSpanInuse)
 		},
 	},
 	"MSpanSys": {
-		ID:    "MSpanSys",
-		MType: storage.GaugeMetric,
+		ID:          "MSpanSys",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of memory obtained from the OS for mspan structures",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.MSpanSys)
 		},
 	},
 	"Mallocs": {
-		ID:    "Mallocs",
-		MType: storage.GaugeMetric,
+		ID:          "Mallocs",
+		MType:       storage.GaugeMetric,
+		Description: "Cumulative count of heap objects allocated",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.Mallocs)
 		},
 	},
 	"NextGC": {
-		ID:    "NextGC",
-		MType: storage.GaugeMetric,
+		ID:          "NextGC",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Target heap size of the next GC cycle",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.NextGC)
 		},
 	},
 	"NumForcedGC": {
-		ID:    "NumForcedGC",
-		MType: storage.GaugeMetric,
+		ID:          "NumForcedGC",
+		MType:       storage.GaugeMetric,
+		Description: "Number of GC cycles forced by the application",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.NumForcedGC)
 		},
 	},
 	"NumGC": {
-		ID:    "NumGC",
-		MType: storage.GaugeMetric,
+		ID:          "NumGC",
+		MType:       storage.GaugeMetric,
+		Description: "Number of completed GC cycles",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.NumGC)
 		},
 	},
 	"OtherSys": {
-		ID:    "OtherSys",
-		MType: storage.GaugeMetric,
+		ID:          "OtherSys",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of memory in miscellaneous off-heap runtime allocations",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.OtherSys)
 		},
 	},
 	"PauseTotalNs": {
-		ID:    "PauseTotalNs",
-		MType: storage.GaugeMetric,
+		ID:          "PauseTotalNs",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitNanoseconds,
+		Description: "Cumulative time spent in GC stop-the-world pauses",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.PauseTotalNs)
 		},
 	},
 	"StackInuse": {
-		ID:    "StackInuse",
-		MType: storage.GaugeMetric,
+		ID:          "StackInuse",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes in stack spans",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.StackInuse)
 		},
 	},
 	"StackSys": {
-		ID:    "StackSys",
-		MType: storage.GaugeMetric,
+		ID:          "StackSys",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Bytes of stack memory obtained from the OS",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.StackSys)
 		},
 	},
 	"Sys": {
-		ID:    "Sys",
-		MType: storage.GaugeMetric,
+		ID:          "Sys",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Total bytes of memory obtained from the OS",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.Sys)
 		},
 	},
 	"TotalAlloc": {
-		ID:    "TotalAlloc",
-		MType: storage.GaugeMetric,
+		ID:          "TotalAlloc",
+		MType:       storage.GaugeMetric,
+		Unit:        storage.UnitBytes,
+		Description: "Cumulative bytes allocated for heap objects",
 		ExtractorFn: func(stats *runtime.MemStats) string {
 			return fmt.Sprintf("%d", stats.TotalAlloc)
 		},
@@ -244,6 +303,20 @@ func getMemMetrics() []storage.Metrics {
 	return res
 }
 
+// Descriptors declare units and descriptions of metrics the agent collects
+func Descriptors() []storage.MetricDescriptor {
+	res := make([]storage.MetricDescriptor, 0, len(presets))
+	for _, preset := range presets {
+		res = append(res, storage.MetricDescriptor{
+			Name:        preset.ID,
+			MType:       preset.MType,
+			Unit:        preset.Unit,
+			Description: preset.Description,
+		})
+	}
+	return res
+}
+
 // CollectMemMetrics Every invocation adds metrics to the storage of metrics
 func CollectMemMetrics(repository storage.IMetricRepository) {
 	for _, metric := range getMemMetrics() {
@@ -255,32 +328,137 @@ func CollectMemMetrics(repository storage.IMetricRepository) {
 
 type MetricSender struct {
 	ServerAddress string
+	// AgentID with a sequence number makes the idempotency key of every update,
+	// so that the server applies an update once however many times it is retried
+	AgentID  string
+	sequence atomic.Uint64
+	mu       sync.Mutex
+	// pending is the last update without an answer, it is resent with its key before anything else
+	pending *update
 	*resty.Client
 }
 
+// errNoAnswer means the server may have applied the update or not, or is still applying it
+var errNoAnswer = errors.New("no answer from server")
+
+// update is a request bound to its idempotency key, metrics are what it carries
+type update struct {
+	endpoint string
+	body     []byte
+	key      storage.IdempotencyKey
+	metrics  []storage.Metrics
+}
+
 func (s *MetricSender) SendMetric(metric storage.Metrics) error {
 	updateEndpoint := fmt.Sprintf(`%s/update/`, s.ServerAddress)
+	return s.sendUpdate(updateEndpoint, storage.MetricsRequest{Metrics: &metric}, []storage.Metrics{metric})
+}
 
-	bd := storage.MetricsRequest{Metrics: &metric}
-	jsonBody, err := json.Marshal(bd)
+// SendMetricsBatch sends all metrics in one request to the batch endpoint
+func (s *MetricSender) SendMetricsBatch(metrics []storage.Metrics) error {
+	updatesEndpoint := fmt.Sprintf(`%s/updates/`, s.ServerAddress)
+	return s.sendUpdate(updatesEndpoint, metrics, metrics)
+}
+
+// DeclareMetrics registers metadata of metrics on the server
+func (s *MetricSender) DeclareMetrics(descriptors []storage.MetricDescriptor) error {
+	declareEndpoint := fmt.Sprintf(`%s/admin/metrics`, s.ServerAddress)
+	u, err := s.newUpdate(declareEndpoint, descriptors)
 	if err != nil {
 		return err
 	}
+	return s.post(u)
+}
+
+// sendUpdate posts metrics, an update left without an answer becomes pending
+func (s *MetricSender) sendUpdate(endpoint string, body any, metrics []storage.Metrics) error {
+	u, err := s.newUpdate(endpoint, body)
+	if err != nil {
+		return err
+	}
+	u.metrics = metrics
+	err = s.post(u)
+	if errors.Is(err, errNoAnswer) {
+		s.mu.Lock()
+		s.pending = u
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// resendPending resends the pending update with its key and acknowledges its counters once it is answered.
+// Nothing else may be sent before, or deltas of the pending update would go out again under a new key
+func (s *MetricSender) resendPending(repository storage.IMetricRepository) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		return nil
+	}
+	err := s.post(s.pending)
+	if errors.Is(err, errNoAnswer) {
+		return err
+	}
+	u := s.pending
+	s.pending = nil
+	if err != nil {
+		// the update was rejected, its deltas stay collected and go with the next update
+		log.Printf("Problems with resending pending update %s: %v", u.key, err)
+		return nil
+	}
+	for _, metric := range u.metrics {
+		acknowledge(repository, metric)
+	}
+	return nil
+}
+
+func (s *MetricSender) newUpdate(endpoint string, body any) (*update, error) {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
 	var gzipBuffer bytes.Buffer
 	gzipWriter := gzip.NewWriter(&gzipBuffer)
 	if _, err = gzipWriter.Write(jsonBody); err != nil {
-		return err
+		return nil, err
 	}
 	if err = gzipWriter.Close(); err != nil {
-		return err
+		return nil, err
 	}
-	_, err = s.R().
+	return &update{
+		endpoint: endpoint,
+		body:     gzipBuffer.Bytes(),
+		key:      storage.IdempotencyKey{Agent: s.AgentID, Sequence: s.sequence.Add(1)},
+	}, nil
+}
+
+// post sends u, errNoAnswer is returned when the request failed, the server failed to handle it
+// or a request with the same key is still in progress there
+func (s *MetricSender) post(u *update) error {
+	resp, err := s.R().
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Content-Encoding", "gzip").
-		SetBody(gzipBuffer.Bytes()).
-		Post(updateEndpoint)
+		SetHeader(storage.IdempotencyKeyHeader, u.key.String()).
+		SetBody(u.body).
+		Post(u.endpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNoAnswer, err)
+	}
+	if resp.StatusCode() >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: server responded with status %d", errNoAnswer, resp.StatusCode())
+	}
+	if resp.StatusCode() == http.StatusConflict && isInProgress(resp.Body()) {
+		return fmt.Errorf("%w: %v", errNoAnswer, storage.ErrRequestInProgress)
+	}
+	if resp.IsError() {
+		return fmt.Errorf("server responded with status %d", resp.StatusCode())
+	}
+	return nil
+}
 
-	return err
+// isInProgress tells a conflict with a request in progress from other conflicts like metric type ones
+func isInProgress(body []byte) bool {
+	var errResp storage.ErrorResponse
+	return json.Unmarshal(body, &errResp) == nil && errResp.ErrorValue == storage.ErrRequestInProgress.Error()
 }
 
 func formatServerAddress(rawAddress string) string {
@@ -297,20 +475,101 @@ func formatServerAddress(rawAddress string) string {
 	return formattedAddress
 }
 
+// newAgentID is unique for every run of the agent, so sequences of restarted agents do not clash
+func newAgentID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "agent"
+	}
+	suffix := make([]byte, 4)
+	if _, err = crand.Read(suffix); err != nil {
+		return fmt.Sprintf("%s-%d", host, time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%s-%s", host, hex.EncodeToString(suffix))
+}
+
 func NewMetricSender(serverAddress string) *MetricSender {
 	formattedServerAddress := formatServerAddress(serverAddress)
 	c := resty.New()
 	c.SetRetryCount(retries)
 	return &MetricSender{
 		ServerAddress: formattedServerAddress,
+		AgentID:       newAgentID(),
 		Client:        c,
 	}
 }
 
+// SendMetrics sends metrics one by one, counters are sent as deltas not acknowledged by the server yet.
+// An update left without an answer is resent with its key on the next call before anything else
 func SendMetrics(repository storage.IMetricRepository, sender *MetricSender) {
+	if err := sender.resendPending(repository); err != nil {
+		log.Printf("Problems with resending pending update: %v", err)
+		return
+	}
 	for _, metric := range repository.GetAllMetrics() {
-		if err := sender.SendMetric(metric); err != nil {
+		if isSettled(metric) {
+			continue
+		}
+		err := sender.SendMetric(metric)
+		if errors.Is(err, errNoAnswer) {
+			// the rest waits until the pending update is answered
 			logError(metric, err)
+			return
+		}
+		if err != nil {
+			logError(metric, err)
+			continue
+		}
+		acknowledge(repository, metric)
+	}
+}
+
+// SendMetricsBatch sends the whole repository in a single request,
+// counters are acknowledged only if the whole batch is accepted
+func SendMetricsBatch(repository storage.IMetricRepository, sender *MetricSender) {
+	if err := sender.resendPending(repository); err != nil {
+		log.Printf("Problems with resending pending update: %v", err)
+		return
+	}
+	var metrics []storage.Metrics
+	for _, metric := range repository.GetAllMetrics() {
+		if !isSettled(metric) {
+			metrics = append(metrics, metric)
+		}
+	}
+	if len(metrics) == 0 {
+		return
+	}
+	if err := sender.SendMetricsBatch(metrics); err != nil {
+		log.Printf("Problems with sending batch of %d metrics: %v", len(metrics), err)
+		return
+	}
+	for _, metric := range metrics {
+		acknowledge(repository, metric)
+	}
+}
+
+// isSettled reports if the server already has everything the counter collected
+func isSettled(metric storage.Metrics) bool {
+	return metric.MType == storage.CounterMetric && (metric.Delta == nil || *metric.Delta == 0)
+}
+
+// acknowledge subtracts the sent delta of a counter from the local one,
+// so that only what was collected after the send is left pending
+func acknowledge(repository storage.IMetricRepository, sent storage.Metrics) {
+	if sent.MType != storage.CounterMetric || sent.Delta == nil {
+		return
+	}
+	delta := -*sent.Delta
+	pending, err := repository.Collect(&storage.Metrics{ID: sent.ID, MType: sent.MType, Labels: sent.Labels, Delta: &delta})
+	if err != nil {
+		log.Printf("Problems with acknowledging %v: %v", sent, err)
+		return
+	}
+	if *pending.Delta == 0 {
+		// a counter collected again after the acknowledgement stays
+		if err = repository.Delete(pending); err != nil && !errors.Is(err, storage.ErrMetricUpdated) {
+			log.Printf("Problems with acknowledging %v: %v", sent, err)
 		}
 	}
 }
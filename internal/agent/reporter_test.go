@@ -1,9 +1,14 @@
 package agent
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"github.com/go-resty/resty/v2"
 	"github.com/rkinwork/musthave-metrics/internal/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -59,3 +64,235 @@ func TestNewMetricSender(t *testing.T) {
 		})
 	}
 }
+
+func TestSendMetricsBatch(t *testing.T) {
+	var requests int
+	var received []storage.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/updates/", r.URL.Path)
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		zr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.NewDecoder(zr).Decode(&received))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	repository := storage.NewRepository()
+	CollectMemMetrics(repository)
+	SendMetricsBatch(repository, NewMetricSender(ts.URL))
+
+	assert.Equal(t, 1, requests)
+	assert.Len(t, received, len(presets))
+}
+
+func TestSendMetricIdempotencyKey(t *testing.T) {
+	var keys []storage.IdempotencyKey
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := storage.ParseIdempotencyKey(r.Header.Get(storage.IdempotencyKeyHeader))
+		require.NoError(t, err)
+		keys = append(keys, key)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	metric, err := storage.ParseMetric(storage.CounterMetric, PollCount, "1")
+	require.NoError(t, err)
+	sender := NewMetricSender(ts.URL)
+	require.NoError(t, sender.SendMetric(*metric))
+	require.NoError(t, sender.SendMetricsBatch([]storage.Metrics{*metric}))
+
+	require.Len(t, keys, 2)
+	assert.Equal(t, sender.AgentID, keys[0].Agent)
+	assert.Equal(t, keys[0].Agent, keys[1].Agent)
+	assert.Equal(t, keys[0].Sequence+1, keys[1].Sequence)
+	assert.NotEqual(t, sender.AgentID, NewMetricSender(ts.URL).AgentID)
+}
+
+func TestSendOnlyPendingCounterDeltas(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(storage.IMetricRepository, *MetricSender)
+	}{
+		{name: "one by one", send: SendMetrics},
+		{name: "batch", send: SendMetricsBatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fail := true
+			var serverTotal int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if fail {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				zr, err := gzip.NewReader(r.Body)
+				require.NoError(t, err)
+				var metrics []storage.Metrics
+				if r.URL.Path == "/updates/" {
+					require.NoError(t, json.NewDecoder(zr).Decode(&metrics))
+				} else {
+					var metric storage.Metrics
+					require.NoError(t, json.NewDecoder(zr).Decode(&metric))
+					metrics = append(metrics, metric)
+				}
+				for _, m := range metrics {
+					if m.ID == PollCount {
+						serverTotal += *m.Delta
+					}
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			repository := storage.NewRepository()
+			sender := NewMetricSender(ts.URL)
+			CollectMemMetrics(repository)
+			CollectMemMetrics(repository)
+			tt.send(repository, sender)
+			// failed sends keep the deltas pending
+			pending, ok := repository.Get(&storage.Metrics{ID: PollCount, MType: storage.CounterMetric})
+			require.True(t, ok)
+			assert.Equal(t, int64(2), *pending.Delta)
+
+			fail = false
+			CollectMemMetrics(repository)
+			tt.send(repository, sender)
+			assert.Equal(t, int64(3), serverTotal)
+			_, ok = repository.Get(&storage.Metrics{ID: PollCount, MType: storage.CounterMetric})
+			assert.False(t, ok)
+
+			tt.send(repository, sender)
+			CollectMemMetrics(repository)
+			tt.send(repository, sender)
+			assert.Equal(t, int64(4), serverTotal)
+		})
+	}
+}
+
+func TestPendingUpdateKeepsItsKey(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(storage.IMetricRepository, *MetricSender)
+	}{
+		{name: "one by one", send: SendMetrics},
+		{name: "batch", send: SendMetricsBatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the server applies every key once, the first answer is lost like on a timeout
+			applied := make(map[string]bool)
+			lose := true
+			var serverTotal int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				key := r.Header.Get(storage.IdempotencyKeyHeader)
+				if !applied[key] {
+					applied[key] = true
+					zr, err := gzip.NewReader(r.Body)
+					require.NoError(t, err)
+					var metrics []storage.Metrics
+					if r.URL.Path == "/updates/" {
+						require.NoError(t, json.NewDecoder(zr).Decode(&metrics))
+					} else {
+						var metric storage.Metrics
+						require.NoError(t, json.NewDecoder(zr).Decode(&metric))
+						metrics = append(metrics, metric)
+					}
+					for _, m := range metrics {
+						if m.ID == PollCount {
+							serverTotal += *m.Delta
+						}
+					}
+				}
+				if lose {
+					lose = false
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			repository := storage.NewRepository()
+			sender := NewMetricSender(ts.URL)
+			_, err := repository.Collect(&storage.Metrics{ID: PollCount, MType: storage.CounterMetric, Delta: new(int64)})
+			require.NoError(t, err)
+			delta := int64(2)
+			_, err = repository.Collect(&storage.Metrics{ID: PollCount, MType: storage.CounterMetric, Delta: &delta})
+			require.NoError(t, err)
+			tt.send(repository, sender)
+			assert.Equal(t, int64(2), serverTotal)
+
+			delta = 1
+			_, err = repository.Collect(&storage.Metrics{ID: PollCount, MType: storage.CounterMetric, Delta: &delta})
+			require.NoError(t, err)
+			tt.send(repository, sender)
+			assert.Equal(t, int64(3), serverTotal)
+			_, ok := repository.Get(&storage.Metrics{ID: PollCount, MType: storage.CounterMetric})
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestPendingUpdateInProgress(t *testing.T) {
+	// the first request with a key is still running on the server when it is answered
+	applied := make(map[string]bool)
+	inProgress := true
+	var serverTotal int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(storage.IdempotencyKeyHeader)
+		if !applied[key] {
+			applied[key] = true
+			zr, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			var metrics []storage.Metrics
+			require.NoError(t, json.NewDecoder(zr).Decode(&metrics))
+			for _, m := range metrics {
+				serverTotal += *m.Delta
+			}
+		}
+		if inProgress {
+			inProgress = false
+			w.WriteHeader(http.StatusConflict)
+			require.NoError(t, json.NewEncoder(w).Encode(storage.ErrorResponse{ErrorValue: storage.ErrRequestInProgress.Error()}))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	repository := storage.NewRepository()
+	sender := NewMetricSender(ts.URL)
+	delta := int64(2)
+	_, err := repository.Collect(&storage.Metrics{ID: PollCount, MType: storage.CounterMetric, Delta: &delta})
+	require.NoError(t, err)
+	SendMetricsBatch(repository, sender)
+	SendMetricsBatch(repository, sender)
+	assert.Len(t, applied, 1, "the update is retried with its key")
+	assert.Equal(t, int64(2), serverTotal)
+	_, ok := repository.Get(&storage.Metrics{ID: PollCount, MType: storage.CounterMetric})
+	assert.False(t, ok)
+}
+
+func TestDeclareMetrics(t *testing.T) {
+	var received []storage.MetricDescriptor
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/admin/metrics", r.URL.Path)
+		zr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.NewDecoder(zr).Decode(&received))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	require.NoError(t, NewMetricSender(ts.URL).DeclareMetrics(Descriptors()))
+	require.Len(t, received, len(presets))
+	for _, d := range received {
+		assert.NoError(t, d.Validate())
+		assert.NotEmpty(t, d.Description, d.Name)
+		if d.Name == "HeapAlloc" {
+			assert.Equal(t, storage.UnitBytes, d.Unit)
+		}
+	}
+}
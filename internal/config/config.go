@@ -11,13 +11,34 @@ import (
 )
 
 type Config struct {
-	Address         string
-	ReportInterval  time.Duration
-	PollInterval    time.Duration
-	StorageType     string
-	StoreInterval   time.Duration
-	FileStoragePath string
-	Restore         bool
+	Address          string
+	ReportInterval   time.Duration
+	PollInterval     time.Duration
+	StorageType      string
+	StoreInterval    time.Duration
+	FileStoragePath  string
+	Restore          bool
+	BatchReport      bool
+	DatabaseDSN      string
+	SnapshotHistory  int
+	RestoreFrom      string
+	HistoryDepth     int
+	HistoryRetention time.Duration
+	HistoryRollups   string
+	HistorySeries    int
+	MetricTTL        time.Duration
+	MetricTTLRules   string
+	DedupWindow      time.Duration
+	Declarations     string
+	StatsdAddress    string
+	StatsdFlush      time.Duration
+	StatsdSeries     int
+	GraphiteAddress  string
+	GraphiteRules    string
+	GraphiteConns    int
+	GraphiteIdle     time.Duration
+	InfluxTypeRules  string
+	InfluxNameTags   string
 }
 
 const (
@@ -25,19 +46,41 @@ const (
 	defaultReportInterval  = 10 // in seconds
 	defaultPollInterval    = 2  // in seconds
 	DefaultStorageType     = "filestorage"
+	MemoryStorageType      = "memory"
+	PostgresStorageType    = "postgres"
+	WALStorageType         = "wal"
 	defaultStoreInterval   = 300
 	defaultFileStoragePath = "/tmp/metrics-db.json"
 	defaultRestore         = true
+	defaultBatchReport     = false
+	defaultHistoryDepth    = 1000
+	defaultHistoryRetain   = 3600 // in seconds
+	defaultHistoryRollups  = "1m:24h,1h:720h"
+	defaultHistorySeries   = 10000
+	defaultDedupWindow     = 300 // in seconds
+	defaultStatsdFlush     = 10  // in seconds
+	defaultStatsdSeries    = 10000
+	defaultGraphiteConns   = 100
+	defaultGraphiteIdle    = 60 // in seconds
 	developingEnv          = "devStorage"
 )
 
 func New(production bool) (*Config, error) {
 	cfg := &Config{
-		Address:         defaultAddr,
-		StorageType:     developingEnv,
-		StoreInterval:   defaultStoreInterval,
-		FileStoragePath: defaultFileStoragePath,
-		Restore:         defaultRestore,
+		Address:          defaultAddr,
+		StorageType:      developingEnv,
+		StoreInterval:    defaultStoreInterval,
+		FileStoragePath:  defaultFileStoragePath,
+		Restore:          defaultRestore,
+		HistoryDepth:     defaultHistoryDepth,
+		HistoryRetention: defaultHistoryRetain * time.Second,
+		HistoryRollups:   defaultHistoryRollups,
+		HistorySeries:    defaultHistorySeries,
+		DedupWindow:      defaultDedupWindow * time.Second,
+		StatsdFlush:      defaultStatsdFlush * time.Second,
+		StatsdSeries:     defaultStatsdSeries,
+		GraphiteConns:    defaultGraphiteConns,
+		GraphiteIdle:     defaultGraphiteIdle * time.Second,
 	}
 	if production {
 		if err := loadFromFlagsServer(cfg); err != nil {
@@ -46,6 +89,14 @@ func New(production bool) (*Config, error) {
 		if err := loadFromEnv(cfg); err != nil {
 			return nil, err
 		}
+		// asking for a particular snapshot implies restoring
+		if cfg.RestoreFrom != "" {
+			cfg.Restore = true
+		}
+		// configured database takes precedence over the default file storage
+		if cfg.DatabaseDSN != "" && cfg.StorageType == DefaultStorageType {
+			cfg.StorageType = PostgresStorageType
+		}
 	}
 	return cfg, nil
 }
@@ -59,6 +110,7 @@ func NewAgent(production bool) (*Config, error) {
 		StoreInterval:   defaultStoreInterval,
 		FileStoragePath: defaultFileStoragePath,
 		Restore:         false,
+		BatchReport:     defaultBatchReport,
 	}
 	if production {
 		if err := loadFromFlagsAgent(cfg); err != nil {
@@ -73,13 +125,34 @@ func NewAgent(production bool) (*Config, error) {
 
 func loadFromEnv(cfg *Config) error {
 	parsedConfig := struct {
-		Addr            string `env:"ADDRESS"`
-		ReportInterval  int64  `env:"REPORT_INTERVAL"`
-		PollInterval    int64  `env:"POLL_INTERVAL"`
-		StorageType     string `env:"STORAGE_TYPE"`
-		StoreInterval   int64  `env:"STORE_INTERVAL"`
-		FileStoragePath string `env:"FILE_STORAGE_PATH"`
-		Restore         bool   `env:"RESTORE"`
+		Addr             string `env:"ADDRESS"`
+		ReportInterval   int64  `env:"REPORT_INTERVAL"`
+		PollInterval     int64  `env:"POLL_INTERVAL"`
+		StorageType      string `env:"STORAGE_TYPE"`
+		StoreInterval    int64  `env:"STORE_INTERVAL"`
+		FileStoragePath  string `env:"FILE_STORAGE_PATH"`
+		Restore          bool   `env:"RESTORE"`
+		BatchReport      bool   `env:"BATCH_REPORT"`
+		DatabaseDSN      string `env:"DATABASE_DSN"`
+		SnapshotHistory  int    `env:"SNAPSHOT_HISTORY"`
+		RestoreFrom      string `env:"RESTORE_FROM"`
+		HistoryDepth     int    `env:"HISTORY_DEPTH"`
+		HistoryRetention int64  `env:"HISTORY_RETENTION"`
+		HistoryRollups   string `env:"HISTORY_ROLLUPS"`
+		HistorySeries    int    `env:"HISTORY_MAX_SERIES"`
+		MetricTTL        int64  `env:"METRIC_TTL"`
+		MetricTTLRules   string `env:"METRIC_TTL_RULES"`
+		DedupWindow      int64  `env:"DEDUP_WINDOW"`
+		Declarations     string `env:"METRIC_DECLARATIONS"`
+		StatsdAddress    string `env:"STATSD_ADDRESS"`
+		StatsdFlush      int64  `env:"STATSD_FLUSH_INTERVAL"`
+		StatsdSeries     int    `env:"STATSD_MAX_SERIES"`
+		GraphiteAddress  string `env:"GRAPHITE_ADDRESS"`
+		GraphiteRules    string `env:"GRAPHITE_RULES"`
+		GraphiteConns    int    `env:"GRAPHITE_MAX_CONNS"`
+		GraphiteIdle     int64  `env:"GRAPHITE_IDLE_TIMEOUT"`
+		InfluxTypeRules  string `env:"INFLUX_TYPE_RULES"`
+		InfluxNameTags   string `env:"INFLUX_NAME_TAGS"`
 	}{}
 
 	if err := env.Parse(&parsedConfig); err != nil {
@@ -92,6 +165,69 @@ func loadFromEnv(cfg *Config) error {
 	if parsedConfig.StorageType != "" {
 		cfg.StorageType = parsedConfig.StorageType
 	}
+	if parsedConfig.DatabaseDSN != "" {
+		cfg.DatabaseDSN = parsedConfig.DatabaseDSN
+	}
+	if parsedConfig.SnapshotHistory > 0 {
+		cfg.SnapshotHistory = parsedConfig.SnapshotHistory
+	}
+	if parsedConfig.RestoreFrom != "" {
+		cfg.RestoreFrom = parsedConfig.RestoreFrom
+	}
+	if parsedConfig.HistoryDepth > 0 {
+		cfg.HistoryDepth = parsedConfig.HistoryDepth
+	}
+	if parsedConfig.HistoryRetention > 0 {
+		cfg.HistoryRetention = time.Duration(parsedConfig.HistoryRetention) * time.Second
+	}
+	if parsedConfig.HistoryRollups != "" {
+		cfg.HistoryRollups = parsedConfig.HistoryRollups
+	}
+	if parsedConfig.HistorySeries > 0 {
+		cfg.HistorySeries = parsedConfig.HistorySeries
+	}
+	if parsedConfig.MetricTTL > 0 {
+		cfg.MetricTTL = time.Duration(parsedConfig.MetricTTL) * time.Second
+	}
+	if parsedConfig.MetricTTLRules != "" {
+		cfg.MetricTTLRules = parsedConfig.MetricTTLRules
+	}
+	if parsedConfig.DedupWindow > 0 {
+		cfg.DedupWindow = time.Duration(parsedConfig.DedupWindow) * time.Second
+	}
+	if parsedConfig.Declarations != "" {
+		cfg.Declarations = parsedConfig.Declarations
+	}
+	if parsedConfig.StatsdAddress != "" {
+		cfg.StatsdAddress = parsedConfig.StatsdAddress
+	}
+	if parsedConfig.StatsdFlush > 0 {
+		cfg.StatsdFlush = time.Duration(parsedConfig.StatsdFlush) * time.Second
+	}
+	if parsedConfig.StatsdSeries > 0 {
+		cfg.StatsdSeries = parsedConfig.StatsdSeries
+	}
+	if parsedConfig.GraphiteAddress != "" {
+		cfg.GraphiteAddress = parsedConfig.GraphiteAddress
+	}
+	if parsedConfig.GraphiteRules != "" {
+		cfg.GraphiteRules = parsedConfig.GraphiteRules
+	}
+	if parsedConfig.GraphiteConns > 0 {
+		cfg.GraphiteConns = parsedConfig.GraphiteConns
+	}
+	if parsedConfig.GraphiteIdle > 0 {
+		cfg.GraphiteIdle = time.Duration(parsedConfig.GraphiteIdle) * time.Second
+	}
+	if parsedConfig.InfluxTypeRules != "" {
+		cfg.InfluxTypeRules = parsedConfig.InfluxTypeRules
+	}
+	if parsedConfig.InfluxNameTags != "" {
+		cfg.InfluxNameTags = parsedConfig.InfluxNameTags
+	}
+	if parsedConfig.BatchReport {
+		cfg.BatchReport = true
+	}
 	if parsedConfig.ReportInterval < 0 || parsedConfig.PollInterval < 0 || parsedConfig.StoreInterval < 0 {
 		log.Println("negative intervals are not allowed. Use defaults")
 	}
@@ -112,6 +248,7 @@ func loadFromFlagsAgent(cfg *Config) error {
 	reportInterval := flagSet.Int64("r", defaultReportInterval, "How ofter agent should send data to server")
 	pollInterval := flagSet.Int64("p", defaultPollInterval, "How often agent should extract metrics")
 	storageType := flagSet.String("s", developingEnv, "Storage type configuration")
+	batchReport := flagSet.Bool("b", defaultBatchReport, "Send all metrics in one request")
 
 	if err := flagSet.Parse(os.Args[1:]); err != nil {
 		return fmt.Errorf("failed to parse flags: %w", err)
@@ -121,6 +258,7 @@ func loadFromFlagsAgent(cfg *Config) error {
 	cfg.ReportInterval = time.Duration(*reportInterval) * time.Second
 	cfg.PollInterval = time.Duration(*pollInterval) * time.Second
 	cfg.StorageType = *storageType
+	cfg.BatchReport = *batchReport
 
 	return nil
 }
@@ -134,6 +272,26 @@ func loadFromFlagsServer(cfg *Config) error {
 	fileStoragePath := flagSet.String("f", defaultFileStoragePath, "File storage path")
 	restore := flagSet.Bool("r", defaultRestore, "Is restore metrics from file storage")
 	storeInterval := flagSet.Int64("i", defaultStoreInterval, "How often agent should dump metrics")
+	databaseDSN := flagSet.String("d", "", "PostgreSQL connection string, enables database storage")
+	snapshotHistory := flagSet.Int("n", 0, "How many timestamped snapshots to keep next to file storage")
+	historyDepth := flagSet.Int("history-depth", defaultHistoryDepth, "How many samples of every metric to keep, 0 disables history")
+	historyRetention := flagSet.Int64("history-retention", defaultHistoryRetain, "How long to keep samples of metrics in seconds, 0 keeps them until depth is reached")
+	historyRollups := flagSet.String("history-rollups", defaultHistoryRollups, "Rollup tiers of history as resolution:retention pairs, empty disables rollups")
+	historySeries := flagSet.Int("history-series", defaultHistorySeries, "How many metrics to keep history for, 0 means no limit")
+	metricTTL := flagSet.Int64("ttl", 0, "Evict metrics not updated for this many seconds, 0 keeps them forever")
+	metricTTLRules := flagSet.String("ttl-rules", "", "TTL of metrics by name pattern as pattern:ttl pairs, the first match wins")
+	dedupWindow := flagSet.Int64("dedup-window", defaultDedupWindow, "How long to remember idempotency keys of updates in seconds, 0 disables deduplication")
+	declarations := flagSet.String("declarations", "", "JSON file with declared metrics: name, type, unit, description and help")
+	statsdAddress := flagSet.String("statsd", "", "UDP and TCP address of the StatsD listener, empty disables it")
+	statsdFlush := flagSet.Int64("statsd-flush", defaultStatsdFlush, "How often to collect aggregated StatsD samples in seconds")
+	statsdSeries := flagSet.Int("statsd-series", defaultStatsdSeries, "How many StatsD series to aggregate between flushes, 0 means no limit")
+	graphiteAddress := flagSet.String("graphite", "", "TCP address of the Graphite plaintext listener, empty disables it")
+	graphiteRules := flagSet.String("graphite-rules", "", "Rewrite rules of Graphite paths as pattern:template pairs like servers.*.load:load{host=$1}")
+	graphiteConns := flagSet.Int("graphite-max-conns", defaultGraphiteConns, "How many Graphite connections to serve at once, 0 means no limit")
+	graphiteIdle := flagSet.Int64("graphite-idle-timeout", defaultGraphiteIdle, "Close Graphite connections idle for this many seconds, 0 keeps them open")
+	influxTypeRules := flagSet.String("influx-types", "", "Types of InfluxDB fields as pattern:type pairs, a pattern of metric names or a field kind int, uint, float or bool. Integers are counters carrying totals and other fields are gauges otherwise")
+	influxNameTags := flagSet.String("influx-name-tags", "", "Comma separated InfluxDB tags whose values become a part of metric names instead of labels")
+	restoreFrom := flagSet.String("restore-from", "", `Snapshot to restore from: "latest" valid one or a snapshot name`)
 
 	if err := flagSet.Parse(os.Args[1:]); err != nil {
 		return fmt.Errorf("failed to parse flags: %w", err)
@@ -145,6 +303,26 @@ func loadFromFlagsServer(cfg *Config) error {
 	cfg.FileStoragePath = *fileStoragePath
 	cfg.Restore = *restore
 	cfg.StoreInterval = time.Duration(*storeInterval) * time.Second
+	cfg.DatabaseDSN = *databaseDSN
+	cfg.SnapshotHistory = *snapshotHistory
+	cfg.RestoreFrom = *restoreFrom
+	cfg.HistoryDepth = *historyDepth
+	cfg.HistoryRetention = time.Duration(*historyRetention) * time.Second
+	cfg.HistoryRollups = *historyRollups
+	cfg.HistorySeries = *historySeries
+	cfg.MetricTTL = time.Duration(*metricTTL) * time.Second
+	cfg.MetricTTLRules = *metricTTLRules
+	cfg.DedupWindow = time.Duration(*dedupWindow) * time.Second
+	cfg.Declarations = *declarations
+	cfg.StatsdAddress = *statsdAddress
+	cfg.StatsdFlush = time.Duration(*statsdFlush) * time.Second
+	cfg.StatsdSeries = *statsdSeries
+	cfg.GraphiteAddress = *graphiteAddress
+	cfg.GraphiteRules = *graphiteRules
+	cfg.GraphiteConns = *graphiteConns
+	cfg.GraphiteIdle = time.Duration(*graphiteIdle) * time.Second
+	cfg.InfluxTypeRules = *influxTypeRules
+	cfg.InfluxNameTags = *influxNameTags
 
 	return nil
 }
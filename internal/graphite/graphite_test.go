@@ -0,0 +1,94 @@
+package graphite
+
+import (
+	"context"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRewrite(t *testing.T) {
+	rules, err := ParseRules("collectd.*.cpu.*.percent:cpu_percent{host=$1,cpu=$2}, servers.*.load:load_$1")
+	require.NoError(t, err)
+	tests := []struct {
+		path       string
+		wantID     string
+		wantLabels map[string]string
+	}{
+		{path: "collectd.web01.cpu.0.percent", wantID: "cpu_percent", wantLabels: map[string]string{"host": "web01", "cpu": "0"}},
+		{path: "servers.db-01.load", wantID: "load_db_01"},
+		{path: "collectd.web01.memory.used", wantID: "collectd_web01_memory_used"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			id, labels := Rewrite(rules, tt.path)
+			assert.Equal(t, tt.wantID, id)
+			assert.Equal(t, tt.wantLabels, labels)
+		})
+	}
+
+	for _, value := range []string{"servers.*", "servers.*.load:load{host}", "servers.*.load:load{host=$1", "servers.*.load:load_$2"} {
+		_, err = ParseRules(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	srv := NewServer("", nil, storage.NewRepository())
+	metric, err := srv.ParseLine("servers.web01.load;dc=eu 0.75 1700000000")
+	require.NoError(t, err)
+	assert.Equal(t, "servers_web01_load", metric.ID)
+	assert.Equal(t, storage.GaugeMetric, metric.MType)
+	assert.Equal(t, 0.75, *metric.Value)
+	assert.Equal(t, map[string]string{"dc": "eu"}, metric.Labels)
+
+	for _, line := range []string{"servers.load", "servers.load high 1700000000", "servers.load NaN 1700000000",
+		"servers.load 1 now", "servers.load;dc 1 1700000000", "1servers.load 1 1700000000"} {
+		_, err = srv.ParseLine(line)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestServer(t *testing.T) {
+	repo := storage.NewRepository()
+	srv := NewServer("127.0.0.1:0", nil, repo)
+	srv.MaxConns = 1
+	srv.IdleTimeout = 200 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, srv.Start(ctx))
+
+	conn, err := net.Dial("tcp", srv.TCPAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("servers.web01.load 0.5 1700000000\nbroken\n"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, ok := repo.Get(&storage.Metrics{ID: "servers_web01_load", MType: storage.GaugeMetric})
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	// the second connection is over the limit
+	rejected, err := net.Dial("tcp", srv.TCPAddr().String())
+	require.NoError(t, err)
+	defer rejected.Close()
+	require.NoError(t, rejected.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = rejected.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// the idle connection is closed by the server
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	idle, err := net.Dial("tcp", srv.TCPAddr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	cancel()
+	srv.Done()
+	_, err = net.Dial("tcp", srv.TCPAddr().String())
+	assert.Error(t, err)
+}
@@ -0,0 +1,167 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"strconv"
+	"strings"
+)
+
+// Rule rewrites a dotted path matching Pattern into a metric ID and labels.
+// Every * of the pattern matches one segment of the path, the template refers to matched segments as $1, $2 and so on
+type Rule struct {
+	Pattern []string
+	ID      string
+	Labels  map[string]string
+}
+
+// ParseRules parses comma separated pattern:template pairs like
+// "collectd.*.cpu.*.percent:cpu_percent{host=$1,cpu=$2},servers.*.load:load{host=$1}"
+func ParseRules(value string) ([]Rule, error) {
+	var res []Rule
+	for _, part := range splitRules(value) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, template, found := strings.Cut(part, ":")
+		if !found || pattern == "" || template == "" {
+			return nil, fmt.Errorf("graphite rule %q should look like pattern:template", part)
+		}
+		rule, err := parseTemplate(template)
+		if err != nil {
+			return nil, fmt.Errorf("graphite rule %q: %w", part, err)
+		}
+		rule.Pattern = strings.Split(pattern, ".")
+		if highest := maxReference(rule); highest > wildcards(rule.Pattern) {
+			return nil, fmt.Errorf("graphite rule %q refers to $%d, the pattern has fewer wildcards", part, highest)
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+// splitRules splits on commas which are not inside braces of labels
+func splitRules(value string) []string {
+	var res []string
+	depth, start := 0, 0
+	for i, r := range value {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				res = append(res, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, value[start:])
+}
+
+func parseTemplate(template string) (Rule, error) {
+	id, labels, hasLabels := strings.Cut(template, "{")
+	rule := Rule{ID: id}
+	if !hasLabels {
+		return rule, nil
+	}
+	if !strings.HasSuffix(labels, "}") {
+		return Rule{}, errors.New("labels of the template are not closed")
+	}
+	rule.Labels = make(map[string]string)
+	for _, pair := range strings.Split(strings.TrimSuffix(labels, "}"), ",") {
+		name, value, found := strings.Cut(pair, "=")
+		if !found || name == "" || value == "" {
+			return Rule{}, fmt.Errorf("template label %q should look like name=value", pair)
+		}
+		rule.Labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return rule, nil
+}
+
+func wildcards(pattern []string) int {
+	n := 0
+	for _, segment := range pattern {
+		if segment == "*" {
+			n++
+		}
+	}
+	return n
+}
+
+// maxReference returns the highest $N used by the template
+func maxReference(rule Rule) int {
+	highest := 0
+	for _, s := range append([]string{rule.ID}, labelValues(rule.Labels)...) {
+		for i := 0; i < len(s); i++ {
+			if s[i] != '$' {
+				continue
+			}
+			j := i + 1
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			if n, err := strconv.Atoi(s[i+1 : j]); err == nil && n > highest {
+				highest = n
+			}
+		}
+	}
+	return highest
+}
+
+func labelValues(labels map[string]string) []string {
+	res := make([]string, 0, len(labels))
+	for _, value := range labels {
+		res = append(res, value)
+	}
+	return res
+}
+
+// match returns segments matched by wildcards, ok is false if the path does not match
+func (r Rule) match(segments []string) ([]string, bool) {
+	if len(segments) != len(r.Pattern) {
+		return nil, false
+	}
+	var captured []string
+	for i, segment := range r.Pattern {
+		switch {
+		case segment == "*":
+			captured = append(captured, segments[i])
+		case segment != segments[i]:
+			return nil, false
+		}
+	}
+	return captured, true
+}
+
+// expand substitutes $N by matched segments, higher numbers go first so that $1 does not eat $10
+func expand(template string, captured []string) string {
+	for i := len(captured); i > 0; i-- {
+		template = strings.ReplaceAll(template, "$"+strconv.Itoa(i), captured[i-1])
+	}
+	return template
+}
+
+// Rewrite maps a dotted path to a metric ID and labels by the first matching rule.
+// Paths without a matching rule keep their segments joined by underscores
+func Rewrite(rules []Rule, path string) (string, map[string]string) {
+	segments := strings.Split(path, ".")
+	for _, rule := range rules {
+		captured, ok := rule.match(segments)
+		if !ok {
+			continue
+		}
+		var labels map[string]string
+		if len(rule.Labels) > 0 {
+			labels = make(map[string]string, len(rule.Labels))
+			for name, value := range rule.Labels {
+				labels[name] = expand(value, captured)
+			}
+		}
+		return storage.SanitizeName(expand(rule.ID, captured)), labels
+	}
+	return storage.SanitizeName(path), nil
+}
@@ -0,0 +1,114 @@
+package graphite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/listener"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"go.uber.org/zap"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxLineBytes = 4096
+
+// Server receives Graphite plaintext lines "path value timestamp" over TCP and collects them as gauges.
+// At most MaxConns connections are served at once, a connection idle for IdleTimeout is closed.
+// Zero values disable the limits
+type Server struct {
+	Addr        string
+	MaxConns    int
+	IdleTimeout time.Duration
+	rules       []Rule
+	repository  storage.IMetricRepository
+	tcp         *listener.TCP
+	quit        chan struct{}
+}
+
+// Start opens the listener and serves until ctx is done
+func (s *Server) Start(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.tcp = &listener.TCP{Name: "graphite", MaxConns: s.MaxConns, IdleTimeout: s.IdleTimeout, MaxLineBytes: maxLineBytes}
+	s.tcp.Serve(l, s.handleLine)
+	go func() {
+		<-ctx.Done()
+		s.tcp.Stop()
+		close(s.quit)
+	}()
+	return nil
+}
+
+// Done waits for the server to stop after its context is done
+func (s *Server) Done() {
+	<-s.quit
+}
+
+// TCPAddr returns the address the server listens on
+func (s *Server) TCPAddr() net.Addr {
+	return s.tcp.Addr()
+}
+
+func (s *Server) handleLine(line string) {
+	metric, err := s.ParseLine(line)
+	if err != nil {
+		logger.Log.Debug("problems with graphite line", zap.String("line", line), zap.Error(err))
+		return
+	}
+	if _, err = s.repository.Collect(metric); err != nil {
+		logger.Log.Warn("problems with collecting graphite metric", zap.String("id", metric.ID), zap.Error(err))
+	}
+}
+
+// ParseLine turns a line into a gauge, the timestamp is checked but the time of receiving is stored.
+// Tags of tagged series like cpu.load;host=web01 become labels
+func (s *Server) ParseLine(line string) (*storage.Metrics, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, errors.New("line should look like path value timestamp")
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, fmt.Errorf("not valid value %q", fields[1])
+	}
+	if len(fields) == 3 {
+		if _, err = strconv.ParseFloat(fields[2], 64); err != nil {
+			return nil, fmt.Errorf("not valid timestamp %q", fields[2])
+		}
+	}
+	path, tags, _ := strings.Cut(fields[0], ";")
+	id, labels := Rewrite(s.rules, path)
+	if tags != "" {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		for _, tag := range strings.Split(tags, ";") {
+			name, tagValue, found := strings.Cut(tag, "=")
+			if !found {
+				return nil, fmt.Errorf("tag %q should look like name=value", tag)
+			}
+			labels[name] = tagValue
+		}
+	}
+	metric := &storage.Metrics{ID: id, MType: storage.GaugeMetric, Value: &value, Labels: labels}
+	if err = storage.ValidateMetric(metric); err != nil {
+		return nil, err
+	}
+	return metric, nil
+}
+
+func NewServer(addr string, rules []Rule, repository storage.IMetricRepository) *Server {
+	return &Server{
+		Addr:       addr,
+		rules:      rules,
+		repository: repository,
+		quit:       make(chan struct{}),
+	}
+}
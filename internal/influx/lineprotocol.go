@@ -0,0 +1,215 @@
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Kinds of field values, a TypeRule whose Pattern is a kind matches all fields of the kind
+const (
+	intField   = "int"
+	uintField  = "uint"
+	floatField = "float"
+	boolField  = "bool"
+)
+
+// TypeRule sets the metric type of fields whose metric ID matches Pattern, see path.Match for the syntax.
+// Pattern may be a field kind instead
+type TypeRule struct {
+	Pattern string
+	MType   string
+}
+
+func isFieldKind(pattern string) bool {
+	return pattern == intField || pattern == uintField || pattern == floatField || pattern == boolField
+}
+
+// ParseTypeRules parses comma separated pattern:type pairs like "net_bytes_*:counter,int:gauge"
+func ParseTypeRules(value string) ([]TypeRule, error) {
+	var res []TypeRule
+	if strings.TrimSpace(value) == "" {
+		return res, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		pattern, mtype, found := strings.Cut(strings.TrimSpace(part), ":")
+		if !found {
+			return nil, fmt.Errorf("influx type rule %q should look like pattern:type", part)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("influx type rule %q: %w", part, err)
+		}
+		if mtype != storage.CounterMetric && mtype != storage.GaugeMetric {
+			return nil, fmt.Errorf("influx type rule %q: type should be %s or %s", part, storage.CounterMetric, storage.GaugeMetric)
+		}
+		res = append(res, TypeRule{Pattern: pattern, MType: mtype})
+	}
+	return res, nil
+}
+
+// Mapping tells how points of the line protocol become metrics.
+// A field becomes the metric measurement_field, the field named value becomes the metric named after the measurement.
+// Values of NameTags are added to the name before the field instead of being labels, other tags become labels.
+// Integer fields are counters and float or boolean fields are gauges. Types override it, the first rule matching
+// the ID wins and rules by field kind apply to fields no ID rule matches, so "int:gauge,*_total:counter"
+// keeps only totals counters. A counter field carries the total, it replaces the stored value and may not be negative.
+// String fields are skipped
+type Mapping struct {
+	Types    []TypeRule
+	NameTags []string
+}
+
+func (m Mapping) typeOf(id, kind string) string {
+	for _, rule := range m.Types {
+		if ok, _ := path.Match(rule.Pattern, id); ok && !isFieldKind(rule.Pattern) {
+			return rule.MType
+		}
+	}
+	for _, rule := range m.Types {
+		if rule.Pattern == kind {
+			return rule.MType
+		}
+	}
+	if kind == intField || kind == uintField {
+		return storage.CounterMetric
+	}
+	return storage.GaugeMetric
+}
+
+var keyReplacer = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`)
+
+// ParseLine turns a point like "cpu,host=web01 usage_idle=99.5,procs=12i 1700000000000000000" into metrics.
+// Timestamps are checked but the time of receiving is stored
+func (m Mapping) ParseLine(line string) ([]storage.Metrics, error) {
+	sections := splitEscaped(line, ' ', true)
+	if len(sections) != 2 && len(sections) != 3 {
+		return nil, errors.New("point should look like measurement,tags fields timestamp")
+	}
+	if len(sections) == 3 {
+		if _, err := strconv.ParseInt(sections[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("bad timestamp %q", sections[2])
+		}
+	}
+
+	series := splitEscaped(sections[0], ',', false)
+	measurement := keyReplacer.Replace(series[0])
+	if measurement == "" {
+		return nil, errors.New("missing measurement")
+	}
+	tags := make(map[string]string, len(series)-1)
+	for _, tag := range series[1:] {
+		kv := splitEscaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad tag %q", tag)
+		}
+		tags[keyReplacer.Replace(kv[0])] = keyReplacer.Replace(kv[1])
+	}
+	prefix := []string{measurement}
+	for _, name := range m.NameTags {
+		if value, ok := tags[name]; ok {
+			prefix = append(prefix, value)
+			delete(tags, name)
+		}
+	}
+	var labels map[string]string
+	if len(tags) > 0 {
+		labels = make(map[string]string, len(tags))
+		for name, value := range tags {
+			labels[storage.SanitizeName(name)] = value
+		}
+	}
+
+	var res []storage.Metrics
+	for _, field := range splitEscaped(sections[1], ',', true) {
+		kv := splitEscaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad field %q", field)
+		}
+		name := append(prefix[:len(prefix):len(prefix)], keyReplacer.Replace(kv[0]))
+		if name[len(name)-1] == "value" {
+			name = name[:len(name)-1]
+		}
+		metric, ok, err := m.fieldMetric(storage.SanitizeName(strings.Join(name, "_")), kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", kv[0], err)
+		}
+		if ok {
+			metric.Labels = labels
+			res = append(res, metric)
+		}
+	}
+	return res, nil
+}
+
+// fieldMetric converts a field value, ok is false for string fields which have no metric
+func (m Mapping) fieldMetric(id, raw string) (storage.Metrics, bool, error) {
+	var value float64
+	var kind string
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+			return storage.Metrics{}, false, errors.New("unterminated string")
+		}
+		return storage.Metrics{}, false, nil
+	case strings.HasSuffix(raw, "i"):
+		v, err := strconv.ParseInt(strings.TrimSuffix(raw, "i"), 10, 64)
+		if err != nil {
+			return storage.Metrics{}, false, fmt.Errorf("bad integer %q", raw)
+		}
+		value, kind = float64(v), intField
+	case strings.HasSuffix(raw, "u"):
+		v, err := strconv.ParseUint(strings.TrimSuffix(raw, "u"), 10, 63)
+		if err != nil {
+			return storage.Metrics{}, false, fmt.Errorf("bad unsigned integer %q", raw)
+		}
+		value, kind = float64(v), uintField
+	default:
+		if b, err := strconv.ParseBool(raw); err == nil {
+			if b {
+				value = 1
+			}
+			kind = boolField
+			break
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return storage.Metrics{}, false, fmt.Errorf("bad float %q", raw)
+		}
+		value, kind = v, floatField
+	}
+
+	metric := storage.Metrics{ID: id, MType: m.typeOf(id, kind)}
+	if metric.MType == storage.CounterMetric {
+		if value != math.Trunc(value) || math.Abs(value) >= math.MaxInt64 {
+			return storage.Metrics{}, false, fmt.Errorf("counter value %q should be an integer", raw)
+		}
+		delta := int64(value)
+		metric.Delta = &delta
+	} else {
+		metric.Value = &value
+	}
+	return metric, true, nil
+}
+
+// splitEscaped splits s on sep which is not escaped by a backslash, with quotes separators inside double quotes are kept
+func splitEscaped(s string, sep byte, quotes bool) []string {
+	var res []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
@@ -0,0 +1,71 @@
+package influx
+
+import (
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func gauge(id string, value float64, labels map[string]string) storage.Metrics {
+	return storage.Metrics{ID: id, MType: storage.GaugeMetric, Value: &value, Labels: labels}
+}
+
+func counter(id string, delta int64, labels map[string]string) storage.Metrics {
+	return storage.Metrics{ID: id, MType: storage.CounterMetric, Delta: &delta, Labels: labels}
+}
+
+func TestParseLine(t *testing.T) {
+	types, err := ParseTypeRules("net_bytes_*:counter,procs_*:gauge,uint:gauge")
+	require.NoError(t, err)
+	mapping := Mapping{Types: types, NameTags: []string{"cpu"}}
+	host := map[string]string{"host": "web01"}
+	tests := []struct {
+		line    string
+		want    []storage.Metrics
+		wantErr bool
+	}{
+		{
+			line: "cpu,host=web01,cpu=cpu0 usage_idle=99.5,ok=true,state=\"idle, waiting\" 1700000000000000000",
+			want: []storage.Metrics{gauge("cpu_cpu0_usage_idle", 99.5, host), gauge("cpu_cpu0_ok", 1, host)},
+		},
+		{
+			line: "net,host=web01 bytes_recv=1024i,drops=3u",
+			want: []storage.Metrics{counter("net_bytes_recv", 1024, host), gauge("net_drops", 3, host)},
+		},
+		{line: "procs running=3i,delta=-2i", want: []storage.Metrics{gauge("procs_running", 3, nil), gauge("procs_delta", -2, nil)}},
+		{line: "m i=5i,f=1.5", want: []storage.Metrics{counter("m_i", 5, nil), gauge("m_f", 1.5, nil)}},
+		{line: `disk\ io,path=/var\,log value=0.5`, want: []storage.Metrics{gauge("disk_io", 0.5, map[string]string{"path": "/var,log"})}},
+		{line: "cpu", wantErr: true},
+		{line: "cpu usage", wantErr: true},
+		{line: "cpu usage=high", wantErr: true},
+		{line: "cpu usage=1 yesterday", wantErr: true},
+		{line: "cpu,host usage=1", wantErr: true},
+		{line: "cpu state=\"idle", wantErr: true},
+		{line: "cpu usage=1.5i", wantErr: true},
+		{line: "net bytes_sent=1.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := mapping.ParseLine(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// rules by ID win over rules by kind whatever their order
+	types, err = ParseTypeRules("int:gauge,float:counter,m_i:counter")
+	require.NoError(t, err)
+	got, err := Mapping{Types: types}.ParseLine("m i=5i,j=6i,f=2")
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Metrics{counter("m_i", 5, nil), gauge("m_j", 6, nil), counter("m_f", 2, nil)}, got)
+
+	for _, value := range []string{"procs_*", "procs_*:histogram", "[:gauge"} {
+		_, err = ParseTypeRules(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,131 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+var errTooManyConns = errors.New("too many connections")
+
+// TCP serves connections of a line based protocol, Name tells listeners apart in logs.
+// At most MaxConns connections are served at once, a connection idle for IdleTimeout is closed.
+// Zero values disable the limits. Lines are at most MaxLineBytes long, bufio.MaxScanTokenSize if it is zero
+type TCP struct {
+	Name         string
+	MaxConns     int
+	IdleTimeout  time.Duration
+	MaxLineBytes int
+	listener     net.Listener
+	mu           sync.Mutex
+	conns        map[net.Conn]struct{}
+	closed       bool
+	wg           sync.WaitGroup
+}
+
+// Serve accepts connections of listener in the background until Stop,
+// handle is called with every non-empty line without surrounding spaces
+func (t *TCP) Serve(listener net.Listener, handle func(line string)) {
+	t.listener = listener
+	t.conns = make(map[net.Conn]struct{})
+	t.wg.Add(1)
+	go t.serve(handle)
+}
+
+// Addr returns the address the listener accepts connections on
+func (t *TCP) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Stop closes the listener and all connections and waits for their lines to be handled
+func (t *TCP) Stop() {
+	_ = t.listener.Close()
+	t.mu.Lock()
+	t.closed = true
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+func (t *TCP) serve(handle func(line string)) {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Log.Warn("problems with accepting connection", zap.String("listener", t.Name), zap.Error(err))
+			continue
+		}
+		if err = t.track(conn); err != nil {
+			logger.Log.Warn("rejecting connection", zap.String("listener", t.Name),
+				zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+			_ = conn.Close()
+			continue
+		}
+		go t.handle(conn, handle)
+	}
+}
+
+// track registers a connection to be closed on stop, it fails when the limit is reached or the listener is stopping
+func (t *TCP) track(conn net.Conn) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return net.ErrClosed
+	}
+	if t.MaxConns > 0 && len(t.conns) >= t.MaxConns {
+		return errTooManyConns
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return nil
+}
+
+func (t *TCP) untrack(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	_ = conn.Close()
+}
+
+func (t *TCP) handle(conn net.Conn, handle func(line string)) {
+	defer t.wg.Done()
+	defer t.untrack(conn)
+	scanner := bufio.NewScanner(conn)
+	maxLineBytes := t.MaxLineBytes
+	if maxLineBytes == 0 {
+		maxLineBytes = bufio.MaxScanTokenSize
+	}
+	// the scanner grows its buffer only up to the limit, a larger initial buffer would lift it
+	initial := 4096
+	if initial > maxLineBytes {
+		initial = maxLineBytes
+	}
+	scanner.Buffer(make([]byte, 0, initial), maxLineBytes)
+	for {
+		if t.IdleTimeout > 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(t.IdleTimeout)); err != nil {
+				return
+			}
+		}
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Log.Debug("closing connection", zap.String("listener", t.Name),
+					zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+			}
+			return
+		}
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			handle(string(line))
+		}
+	}
+}
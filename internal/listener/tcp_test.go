@@ -0,0 +1,57 @@
+package listener
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var mu sync.Mutex
+	var lines []string
+	tcp := &TCP{Name: "test", MaxLineBytes: 16}
+	tcp.Serve(l, func(line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, line)
+	})
+
+	conn, err := net.Dial("tcp", tcp.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(" first \n\nsecond\n"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(lines) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"first", "second"}, lines)
+
+	// a line over the limit closes the connection
+	tooLong, err := net.Dial("tcp", tcp.Addr().String())
+	require.NoError(t, err)
+	defer tooLong.Close()
+	_, err = tooLong.Write([]byte("a line which is too long\n"))
+	require.NoError(t, err)
+	require.NoError(t, tooLong.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = tooLong.Read(make([]byte, 1))
+	// unread data makes the close a reset instead of EOF
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// stop closes connections which are still open
+	tcp.Stop()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = net.Dial("tcp", tcp.Addr().String())
+	assert.Error(t, err)
+}
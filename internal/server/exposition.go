@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"go.uber.org/zap"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	openMetricsMediaType   = "application/openmetrics-text"
+)
+
+// getExpositionHandler renders all metrics in the Prometheus text format,
+// the OpenMetrics format is used when the scraper accepts it
+func getExpositionHandler(repository storage.IMetricRepository, registry *storage.TypeRegistry) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		openMetrics := acceptsOpenMetrics(request.Header.Values("Accept"))
+		var buf bytes.Buffer
+		writeExposition(&buf, repository.GetAllMetrics(), registry, openMetrics)
+		if openMetrics {
+			writer.Header().Set("Content-Type", openMetricsContentType)
+		} else {
+			writer.Header().Set("Content-Type", prometheusContentType)
+		}
+		writer.WriteHeader(http.StatusOK)
+		logError(writer.Write(buf.Bytes()))
+	}
+}
+
+// acceptsOpenMetrics reports if the Accept header lists OpenMetrics with a non-zero weight
+func acceptsOpenMetrics(accept []string) bool {
+	for _, header := range accept {
+		for _, item := range strings.Split(header, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+			if err != nil || mediaType != openMetricsMediaType {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// metricFamily is a group of series with the same name and type
+type metricFamily struct {
+	name   string
+	mtype  string
+	series []storage.Metrics
+}
+
+// writeExposition writes families sorted by name, series of a family are sorted by labels.
+// A family whose names were taken by an earlier one, like counters foo and foo_total or gauge x_count
+// next to histogram x, is skipped, since scrapers reject the whole exposition with a duplicate name
+func writeExposition(buf *bytes.Buffer, metrics []storage.Metrics, registry *storage.TypeRegistry, openMetrics bool) {
+	families := make(map[string]*metricFamily)
+	for _, m := range metrics {
+		key := m.ID + " " + m.MType
+		family, ok := families[key]
+		if !ok {
+			family = &metricFamily{name: m.ID, mtype: m.MType}
+			families[key] = family
+		}
+		family.series = append(family.series, m)
+	}
+	keys := make([]string, 0, len(families))
+	for key := range families {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	taken := make(map[string]string)
+families:
+	for _, key := range keys {
+		family := families[key]
+		names := exposedNames(family)
+		for _, name := range names {
+			if owner, ok := taken[name]; ok {
+				logger.Log.Warn("skipping metric family with a name taken by another one",
+					zap.String("id", family.name), zap.String("type", family.mtype), zap.String("name", name), zap.String("taken_by", owner))
+				continue families
+			}
+		}
+		for _, name := range names {
+			taken[name] = family.name
+		}
+		sort.Slice(family.series, func(i, j int) bool {
+			return storage.LabelsKey(family.series[i].Labels) < storage.LabelsKey(family.series[j].Labels)
+		})
+		d, _ := registry.Describe(family.name)
+		writeFamily(buf, family, d, openMetrics)
+	}
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+	}
+}
+
+func writeFamily(buf *bytes.Buffer, family *metricFamily, d storage.MetricDescriptor, openMetrics bool) {
+	name, promType := family.name, exposedType(family.mtype)
+	if promType == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	// Prometheus text format names a counter family by its sample name, OpenMetrics without the suffix
+	familyName := name
+	if promType == "counter" && !openMetrics {
+		familyName = name + "_total"
+	}
+	help := d.Help
+	if help == "" {
+		help = d.Description
+	}
+	if help != "" {
+		fmt.Fprintf(buf, "# HELP %s %s\n", familyName, escapeHelp(help, openMetrics))
+	}
+	fmt.Fprintf(buf, "# TYPE %s %s\n", familyName, promType)
+	if openMetrics && d.Unit != "" && strings.HasSuffix(name, "_"+d.Unit) {
+		fmt.Fprintf(buf, "# UNIT %s %s\n", familyName, d.Unit)
+	}
+	for _, m := range family.series {
+		writeSeries(buf, name, m)
+	}
+}
+
+// exposedNames returns the family name and all sample names a family is written with
+func exposedNames(family *metricFamily) []string {
+	name := family.name
+	switch exposedType(family.mtype) {
+	case "counter":
+		name = strings.TrimSuffix(name, "_total")
+		return []string{name, name + "_total"}
+	case "histogram":
+		return []string{name, name + "_bucket", name + "_sum", name + "_count"}
+	case "summary":
+		return []string{name, name + "_sum", name + "_count"}
+	}
+	return []string{name}
+}
+
+// exposedType maps a metric type to the closest Prometheus one
+func exposedType(mtype string) string {
+	switch mtype {
+	case storage.CounterMetric:
+		return "counter"
+	case storage.HistogramMetric:
+		return "histogram"
+	case storage.SummaryMetric:
+		return "summary"
+	}
+	// up-down counters and sets are exposed by their current value
+	return "gauge"
+}
+
+func writeSeries(buf *bytes.Buffer, name string, m storage.Metrics) {
+	switch {
+	case m.MType == storage.CounterMetric && m.Delta != nil:
+		writeSample(buf, name+"_total", m.Labels, "", "", float64(*m.Delta))
+	case m.Delta != nil:
+		writeSample(buf, name, m.Labels, "", "", float64(*m.Delta))
+	case m.Value != nil:
+		writeSample(buf, name, m.Labels, "", "", *m.Value)
+	case m.Histogram != nil:
+		var cumulative uint64
+		for i, bound := range m.Histogram.Buckets {
+			cumulative += m.Histogram.Counts[i]
+			writeSample(buf, name+"_bucket", m.Labels, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(buf, name+"_bucket", m.Labels, "le", "+Inf", float64(m.Histogram.Count))
+		writeSample(buf, name+"_sum", m.Labels, "", "", m.Histogram.Sum)
+		writeSample(buf, name+"_count", m.Labels, "", "", float64(m.Histogram.Count))
+	case m.Summary != nil:
+		for _, q := range storage.DefaultQuantiles {
+			writeSample(buf, name, m.Labels, "quantile", formatFloat(q), m.Summary.Quantile(q))
+		}
+		writeSample(buf, name+"_sum", m.Labels, "", "", m.Summary.Sum)
+		writeSample(buf, name+"_count", m.Labels, "", "", float64(m.Summary.Count))
+	case m.Set != nil:
+		writeSample(buf, name, m.Labels, "", "", float64(m.Set.Cardinality()))
+	}
+}
+
+// writeSample writes a line of a series, extraName and extraValue is a label added by the format like le or quantile.
+// Labels reserved by the format are rejected on update, those stored before are skipped
+func writeSample(buf *bytes.Buffer, name string, labels map[string]string, extraName, extraValue string, value float64) {
+	buf.WriteString(name)
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		if label == extraName || strings.HasPrefix(label, "__") {
+			continue
+		}
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	if len(names) > 0 || extraName != "" {
+		buf.WriteString("{")
+		for i, label := range names {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, `%s="%s"`, label, escapeLabelValue(labels[label]))
+		}
+		if extraName != "" {
+			if len(names) > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, `%s="%s"`, extraName, extraValue)
+		}
+		buf.WriteString("}")
+	}
+	buf.WriteString(" ")
+	buf.WriteString(formatFloat(value))
+	buf.WriteString("\n")
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	labelValueReplacer      = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpReplacer            = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	openMetricsHelpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+// escapeHelp escapes HELP text, OpenMetrics also escapes double quotes
+func escapeHelp(help string, openMetrics bool) string {
+	if openMetrics {
+		return openMetricsHelpReplacer.Replace(help)
+	}
+	return helpReplacer.Replace(help)
+}
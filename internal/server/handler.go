@@ -2,16 +2,22 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rkinwork/musthave-metrics/internal/gzipper"
+	"github.com/rkinwork/musthave-metrics/internal/influx"
 	"github.com/rkinwork/musthave-metrics/internal/logger"
 	"github.com/rkinwork/musthave-metrics/internal/storage"
 	"go.uber.org/zap"
 	"html/template"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 )
 
 const (
@@ -22,30 +28,126 @@ const (
 
 var indexTemplate = template.Must(template.New("index").Parse(GenerateHTML()))
 
-func NewMetricsRouter(repository storage.IMetricRepository) chi.Router {
+// RouterOption provides dependencies of optional endpoints
+type RouterOption func(*routerOptions)
+
+type routerOptions struct {
+	snapshots   storage.ISnapshotLister
+	history     storage.IHistoryReader
+	idempotency *storage.IdempotencyStore
+	registry    *storage.TypeRegistry
+	pushGroups  *storage.PushGroups
+	influx      influx.Mapping
+}
+
+// WithSnapshots enables listing of snapshots on /admin/snapshots
+func WithSnapshots(lister storage.ISnapshotLister) RouterOption {
+	return func(o *routerOptions) {
+		o.snapshots = lister
+	}
+}
+
+// WithHistory enables range queries on /history/
+func WithHistory(history storage.IHistoryReader) RouterOption {
+	return func(o *routerOptions) {
+		o.history = history
+	}
+}
+
+// WithIdempotency makes updates with an idempotency key applied once
+func WithIdempotency(store *storage.IdempotencyStore) RouterOption {
+	return func(o *routerOptions) {
+		o.idempotency = store
+	}
+}
+
+// WithRegistry enables listing of declared metrics on /admin/metrics
+func WithRegistry(registry *storage.TypeRegistry) RouterOption {
+	return func(o *routerOptions) {
+		o.registry = registry
+	}
+}
+
+// WithPushGroups enables pushes in the Prometheus text format on /metrics/job/
+func WithPushGroups(groups *storage.PushGroups) RouterOption {
+	return func(o *routerOptions) {
+		o.pushGroups = groups
+	}
+}
+
+// WithInfluxMapping sets how points written to /write become metrics
+func WithInfluxMapping(mapping influx.Mapping) RouterOption {
+	return func(o *routerOptions) {
+		o.influx = mapping
+	}
+}
+
+func NewMetricsRouter(repository storage.IMetricRepository, options ...RouterOption) chi.Router {
+	opts := &routerOptions{}
+	for _, option := range options {
+		option(opts)
+	}
 	router := chi.NewRouter()
 	router.Use(logger.WithLogging)
 	router.Use(middleware.Compress(5))
 	router.Use(gzipper.CompressedBodyReaderMiddleware)
-	router.Get("/", getMainHandler(repository))
-	router.Route("/update", func(router chi.Router) {
-		router.Post("/", getJSONUpdateHandler(repository))
-		router.Post("/{metricType}/{name}/{value}", getUpdateHandler(repository))
+	router.Get("/", getMainHandler(repository, opts.registry))
+	router.Get("/metrics", getExpositionHandler(repository, opts.registry))
+	for _, pattern := range []string{"/metrics/job/{job}", "/metrics/job/{job}/*"} {
+		router.Put(pattern, getPushHandler(repository, opts.pushGroups, true))
+		router.Post(pattern, getPushHandler(repository, opts.pushGroups, false))
+		router.Delete(pattern, getPushDeleteHandler(repository, opts.pushGroups))
+	}
+	router.Group(func(router chi.Router) {
+		router.Use(withIdempotency(opts.idempotency))
+		router.Route("/update", func(router chi.Router) {
+			router.Post("/", getJSONUpdateHandler(repository))
+			router.Post("/{metricType}/{name}/{value}", getUpdateHandler(repository))
+		})
+		router.Post("/updates/", getJSONBatchUpdateHandler(repository))
 	})
+	router.Post("/write", getInfluxWriteHandler(repository, opts.influx))
+	router.Post("/reset/{metricType}/{name}", getResetHandler(repository))
+	router.Route("/admin", func(router chi.Router) {
+		router.Get("/snapshots", getSnapshotsHandler(opts.snapshots))
+		router.Get("/metrics", getDeclaredMetricsHandler(opts.registry))
+		router.Post("/metrics", getDeclareMetricsHandler(opts.registry))
+	})
+	router.Get("/history/{metricType}/{name}", getHistoryHandler(opts.history))
 	router.Route("/value", func(router chi.Router) {
-		router.Post("/", getJSONValueHandler(repository))
-		router.Get("/{metricType}/{name}", getValueHandler(repository))
+		router.Post("/", getJSONValueHandler(repository, opts.registry))
+		router.Get("/{metricType}/{name}", getValueHandler(repository, opts.registry))
 	})
 	return router
 }
 
-func getMainHandler(repository storage.IMetricRepository) http.HandlerFunc {
+// indexEntry is a line of the index page
+type indexEntry struct {
+	Display     string
+	Description string
+}
+
+func getMainHandler(repository storage.IMetricRepository, registry *storage.TypeRegistry) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		metrics := repository.GetAllMetrics()
+		if filter := storage.ParseLabels(request.URL.Query()); len(filter) > 0 {
+			filtered := metrics[:0:0]
+			for _, m := range metrics {
+				if m.HasLabels(filter) {
+					filtered = append(filtered, m)
+				}
+			}
+			metrics = filtered
+		}
 		writer.Header().Set("Content-Type", "text/html")
 		writer.WriteHeader(http.StatusOK)
 		if len(metrics) > 0 {
-			err := indexTemplate.Execute(writer, metrics)
+			entries := make([]indexEntry, len(metrics))
+			for i, m := range metrics {
+				d, _ := registry.Describe(m.ID)
+				entries[i] = indexEntry{Display: m.Display(d.Unit), Description: d.Description}
+			}
+			err := indexTemplate.Execute(writer, entries)
 			logError(0, err)
 			return
 		}
@@ -53,7 +155,7 @@ func getMainHandler(repository storage.IMetricRepository) http.HandlerFunc {
 	}
 }
 
-func getValueHandler(repository storage.IMetricRepository) http.HandlerFunc {
+func getValueHandler(repository storage.IMetricRepository, registry *storage.TypeRegistry) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		metricType, name, value := chi.URLParam(request, "metricType"), chi.URLParam(request, "name"), chi.URLParam(request, "value")
 		m, err := storage.ParseMetric(metricType, name, value)
@@ -61,6 +163,16 @@ func getValueHandler(repository storage.IMetricRepository) http.HandlerFunc {
 			writer.WriteHeader(http.StatusNotFound)
 			return
 		}
+		query := request.URL.Query()
+		quantiles, err := parseQuantilesParam(query["q"])
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		human := query.Get("format") == "human"
+		query.Del("q")
+		query.Del("format")
+		m.Labels = storage.ParseLabels(query)
 		metric, ok := repository.Get(m)
 		if !ok {
 			writer.WriteHeader(http.StatusNotFound)
@@ -68,18 +180,81 @@ func getValueHandler(repository storage.IMetricRepository) http.HandlerFunc {
 		}
 		writer.Header().Set("Content-Type", "text/plain")
 		writer.WriteHeader(http.StatusOK)
+		if human {
+			logError(writer.Write([]byte(metric.DisplayValue(registry.Unit(metric.ID)))))
+			return
+		}
 		switch m.MType {
-		case storage.CounterMetric:
+		case storage.CounterMetric, storage.UpDownCounterMetric:
 			logError(fmt.Fprintf(writer, "%d", *metric.Delta))
 			return
 		case storage.GaugeMetric:
 			logError(fmt.Fprintf(writer, "%g", *metric.Value))
+		case storage.HistogramMetric, storage.SummaryMetric:
+			distribution := metric.Distribution()
+			if len(quantiles) == 1 {
+				logError(fmt.Fprintf(writer, "%g", distribution.Quantile(quantiles[0])))
+				return
+			}
+			count, sum := distribution.Stats()
+			logError(fmt.Fprintf(writer, "count=%d sum=%g", count, sum))
+			for _, q := range quantilesOrDefault(quantiles) {
+				logError(fmt.Fprintf(writer, " p%s=%g", formatQuantile(q*100), distribution.Quantile(q)))
+			}
+		case storage.SetMetric:
+			logError(fmt.Fprintf(writer, "%d", metric.Set.Cardinality()))
+		}
+
+	}
+}
+
+// parseQuantilesParam parses requested quantiles, every one should be within [0, 1]
+func parseQuantilesParam(values []string) ([]float64, error) {
+	res := make([]float64, 0, len(values))
+	for _, value := range values {
+		q, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		if q < 0 || q > 1 {
+			return nil, fmt.Errorf("quantile %g is out of [0, 1]", q)
 		}
+		res = append(res, q)
+	}
+	return res, nil
+}
 
+func quantilesOrDefault(quantiles []float64) []float64 {
+	if len(quantiles) == 0 {
+		return storage.DefaultQuantiles
 	}
+	return quantiles
+}
+
+func formatQuantile(q float64) string {
+	return strconv.FormatFloat(q, 'g', -1, 64)
 }
 
-func getJSONValueHandler(repository storage.IMetricRepository) http.HandlerFunc {
+// estimateQuantiles returns estimates of distribution metrics keyed by quantile, nil for other metrics
+func estimateQuantiles(metric *storage.Metrics, quantiles []float64) map[string]float64 {
+	distribution := metric.Distribution()
+	if distribution == nil {
+		return nil
+	}
+	if count, _ := distribution.Stats(); count == 0 {
+		return nil
+	}
+	res := make(map[string]float64, len(quantiles))
+	for _, q := range quantilesOrDefault(quantiles) {
+		// quantiles out of [0, 1] have no estimate
+		if estimate := distribution.Quantile(q); !math.IsNaN(estimate) {
+			res[formatQuantile(q)] = estimate
+		}
+	}
+	return res
+}
+
+func getJSONValueHandler(repository storage.IMetricRepository, registry *storage.TypeRegistry) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		contentType := request.Header.Get("Content-type")
 		writer.Header().Set("Content-Type", "application/json")
@@ -120,6 +295,16 @@ func getJSONValueHandler(repository storage.IMetricRepository) http.HandlerFunc
 			return
 		}
 		resp.Metrics = &metrics
+		if d, ok := registry.Describe(metrics.ID); ok {
+			resp.Unit = d.Unit
+			resp.Description = d.Description
+			resp.Display = metrics.DisplayValue(d.Unit)
+		}
+		resp.Quantiles = estimateQuantiles(&metrics, mRequest.Quantiles)
+		if metrics.Set != nil {
+			cardinality := metrics.Set.Cardinality()
+			resp.Cardinality = &cardinality
+		}
 		resp.ErrorResponse = nil
 
 	}
@@ -137,15 +322,20 @@ func getUpdateHandler(repository storage.IMetricRepository) http.HandlerFunc {
 			writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		metric.Labels = storage.ParseLabels(request.URL.Query())
 		if err = storage.ValidateMetric(metric); err != nil {
 			writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if _, err = repository.Collect(metric); err == nil {
+		_, err = repository.Collect(metric)
+		switch {
+		case err == nil:
 			writer.WriteHeader(http.StatusOK)
-			return
+		case errors.Is(err, storage.ErrTypeConflict):
+			writer.WriteHeader(http.StatusConflict)
+		default:
+			writer.WriteHeader(http.StatusBadRequest)
 		}
-		writer.WriteHeader(http.StatusBadRequest)
 	}
 }
 
@@ -188,6 +378,16 @@ func getJSONUpdateHandler(repository storage.IMetricRepository) http.HandlerFunc
 		}
 
 		metric, err := repository.Collect(mRequest.Metrics)
+		if errors.Is(err, storage.ErrTypeConflict) {
+			statusCode = http.StatusConflict
+			errorResp = storage.ErrorResponse{ErrorValue: err.Error()}
+			return
+		}
+		if errors.Is(err, storage.ErrIncompatibleMerge) {
+			statusCode = http.StatusBadRequest
+			errorResp = storage.ErrorResponse{ErrorValue: err.Error()}
+			return
+		}
 		if err != nil {
 			statusCode = http.StatusInternalServerError
 			errorResp = storage.ErrorResponse{ErrorValue: problemsWithServerError}
@@ -199,6 +399,280 @@ func getJSONUpdateHandler(repository storage.IMetricRepository) http.HandlerFunc
 	}
 }
 
+func getJSONBatchUpdateHandler(repository storage.IMetricRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		contentType := request.Header.Get("Content-type")
+		writer.Header().Set("Content-Type", "application/json")
+		var resp any
+		enc := json.NewEncoder(writer)
+		var statusCode = http.StatusOK
+
+		defer func() {
+			err := request.Body.Close()
+			logError(0, err)
+		}()
+		defer func() {
+			writer.WriteHeader(statusCode)
+			if err := enc.Encode(resp); err != nil {
+				logger.Log.Debug("error encoding response", zap.Error(err))
+				return
+			}
+
+		}()
+		if contentType != "application/json" {
+			statusCode = http.StatusUnsupportedMediaType
+			resp = storage.ErrorResponse{ErrorValue: "unsupported media type"}
+			return
+		}
+		metrics, err := storage.ParseJSONBatchRequest(request.Body)
+		if err != nil {
+			statusCode = http.StatusBadRequest
+			resp = storage.ErrorResponse{ErrorValue: badRequestError}
+			return
+		}
+
+		results := make([]storage.MetricsResponse, len(metrics))
+		for i := range metrics {
+			results[i].Metrics = &metrics[i]
+			if err = storage.ValidateMetric(&metrics[i]); err != nil {
+				statusCode = http.StatusBadRequest
+				results[i].ErrorResponse = &storage.ErrorResponse{ErrorValue: err.Error()}
+			}
+		}
+		resp = results
+		if statusCode != http.StatusOK {
+			return
+		}
+
+		collected, err := repository.CollectBatch(metrics)
+		var itemErr *storage.BatchItemError
+		switch {
+		case errors.As(err, &itemErr):
+			statusCode = http.StatusBadRequest
+			if errors.Is(itemErr.Err, storage.ErrTypeConflict) {
+				statusCode = http.StatusConflict
+			}
+			results[itemErr.Index].ErrorResponse = &storage.ErrorResponse{ErrorValue: itemErr.Err.Error()}
+			return
+		case err != nil:
+			statusCode = http.StatusInternalServerError
+			resp = storage.ErrorResponse{ErrorValue: problemsWithServerError}
+			return
+		}
+		for i := range collected {
+			results[i].Metrics = &collected[i]
+		}
+
+	}
+}
+
+// getResetHandler sets a counter to zero, labels of the counter are taken from the query
+func getResetHandler(repository storage.IMetricRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(writer)
+		metric, err := storage.ParseMetric(chi.URLParam(request, "metricType"), chi.URLParam(request, "name"), "")
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+			return
+		}
+		metric.Labels = storage.ParseLabels(request.URL.Query())
+		res, err := repository.Reset(metric)
+		switch {
+		case errors.Is(err, storage.ErrNotResettable):
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+			return
+		case errors.Is(err, storage.ErrMetricNotFound):
+			writer.WriteHeader(http.StatusNotFound)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: metricNotFountError}))
+			return
+		case err != nil:
+			logger.Log.Error("problems with resetting metric", zap.Error(err))
+			writer.WriteHeader(http.StatusInternalServerError)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: problemsWithServerError}))
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+		logError(0, enc.Encode(res))
+	}
+}
+
+func getSnapshotsHandler(lister storage.ISnapshotLister) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(writer)
+		if lister == nil {
+			writer.WriteHeader(http.StatusNotImplemented)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: storage.ErrSnapshotsNotSupported.Error()}))
+			return
+		}
+		snapshots, err := lister.Snapshots()
+		switch {
+		case errors.Is(err, storage.ErrSnapshotsNotSupported):
+			writer.WriteHeader(http.StatusNotImplemented)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+			return
+		case err != nil:
+			logger.Log.Error("problems with listing snapshots", zap.Error(err))
+			writer.WriteHeader(http.StatusInternalServerError)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: problemsWithServerError}))
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+		logError(0, enc.Encode(snapshots))
+	}
+}
+
+func getDeclaredMetricsHandler(registry *storage.TypeRegistry) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(writer)
+		if registry == nil {
+			writer.WriteHeader(http.StatusNotImplemented)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: "metric registry is disabled"}))
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+		logError(0, enc.Encode(registry.Declared()))
+	}
+}
+
+// getDeclareMetricsHandler declares metrics sent as a JSON array of descriptors
+func getDeclareMetricsHandler(registry *storage.TypeRegistry) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(writer)
+		if registry == nil {
+			writer.WriteHeader(http.StatusNotImplemented)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: "metric registry is disabled"}))
+			return
+		}
+		if request.Header.Get("Content-type") != "application/json" {
+			writer.WriteHeader(http.StatusUnsupportedMediaType)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: "unsupported media type"}))
+			return
+		}
+		var descriptors []storage.MetricDescriptor
+		if err := json.NewDecoder(request.Body).Decode(&descriptors); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: badRequestError}))
+			return
+		}
+		for _, d := range descriptors {
+			err := registry.Declare(d)
+			switch {
+			case errors.Is(err, storage.ErrTypeConflict):
+				writer.WriteHeader(http.StatusConflict)
+				logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+				return
+			case err != nil:
+				writer.WriteHeader(http.StatusBadRequest)
+				logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+				return
+			}
+		}
+		if err := registry.Save(); err != nil {
+			logger.Log.Error("problems with saving metric declarations", zap.Error(err))
+			writer.WriteHeader(http.StatusInternalServerError)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: problemsWithServerError}))
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+		logError(0, enc.Encode(descriptors))
+	}
+}
+
+// HistoryResponse is the answer of the history endpoint
+type HistoryResponse struct {
+	ID         string            `json:"id"`
+	MType      string            `json:"type"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Resolution string            `json:"resolution"`
+	Samples    []storage.Sample  `json:"samples"`
+}
+
+func getHistoryHandler(history storage.IHistoryReader) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(writer)
+		if history == nil {
+			writer.WriteHeader(http.StatusNotImplemented)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: "history is disabled"}))
+			return
+		}
+		metric, err := storage.ParseMetric(chi.URLParam(request, "metricType"), chi.URLParam(request, "name"), "")
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+			return
+		}
+		query := request.URL.Query()
+		labels := url.Values{}
+		for name, values := range query {
+			switch name {
+			case "from", "to", "resolution":
+			default:
+				labels[name] = values
+			}
+		}
+		metric.Labels = storage.ParseLabels(labels)
+		from, err := parseTimeParam(query.Get("from"), time.Time{})
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: "not valid from: " + err.Error()}))
+			return
+		}
+		to, err := parseTimeParam(query.Get("to"), time.Now())
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: "not valid to: " + err.Error()}))
+			return
+		}
+		resolution, err := parseResolutionParam(query.Get("resolution"))
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: "not valid resolution: " + err.Error()}))
+			return
+		}
+		res, ok := history.Range(metric, storage.HistoryQuery{From: from, To: to, Resolution: resolution})
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: metricNotFountError}))
+			return
+		}
+		resp := HistoryResponse{ID: metric.ID, MType: metric.MType, Labels: metric.Labels, Resolution: "raw", Samples: res.Samples}
+		if res.Resolution != storage.RawResolution {
+			resp.Resolution = res.Resolution.String()
+		}
+		writer.WriteHeader(http.StatusOK)
+		logError(0, enc.Encode(resp))
+	}
+}
+
+// parseTimeParam accepts unix seconds or RFC 3339, empty value gives def
+func parseTimeParam(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseResolutionParam accepts "raw", "auto" or a duration of a rollup tier, empty value means auto
+func parseResolutionParam(value string) (time.Duration, error) {
+	switch value {
+	case "", "auto":
+		return storage.AutoResolution, nil
+	case "raw":
+		return storage.RawResolution, nil
+	}
+	return time.ParseDuration(value)
+}
+
 func logError(_ int, err error) {
 	if err != nil {
 		log.Printf("An error occurred: %v\n", err)
@@ -209,6 +683,6 @@ func GenerateHTML() string {
 	return `
 <b>All Storage Metrics</b>
 {{range  .}}
-   <li>{{ . }}</li>
+   <li{{ if .Description }} title="{{ .Description }}"{{ end }}>{{ .Display }}</li>
 {{end}}`
 }
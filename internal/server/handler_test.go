@@ -3,14 +3,19 @@ package server
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"github.com/rkinwork/musthave-metrics/internal/influx"
 	"github.com/rkinwork/musthave-metrics/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func testRequest(t *testing.T, ts *httptest.Server, method,
@@ -478,8 +483,621 @@ func TestJSONGzipHandling(t *testing.T) {
 			require.NoError(t, err)
 			assert.Equal(t, tc.want.code, statusCode)
 			assert.JSONEq(t, tc.want.resp, body)
-			err = repo.Delete(baseValue)
+			// baseValue got the update time of Collect, a delete with it would keep the updated metric
+			err = repo.Delete(&storage.Metrics{ID: baseValue.ID, MType: baseValue.MType})
 			require.NoError(t, err)
 		})
 	}
 }
+
+func TestJSONBatchUpdateHandler(t *testing.T) {
+	type want struct {
+		code int
+		resp string
+	}
+	tests := []struct {
+		name string
+		// setup batches are sent before payload, their responses are not checked
+		setup   []string
+		payload string
+		want    want
+	}{
+		{
+			name:    "positive flow batch",
+			payload: `[{"id": "test", "type":"counter", "delta": 1}, {"id": "test", "type":"gauge", "value": 1.5}]`,
+			want: want{
+				code: http.StatusOK,
+				resp: `[{"id": "test", "type":"counter", "delta": 1}, {"id": "test", "type":"gauge", "value": 1.5}]`,
+			},
+		},
+		{
+			name:    "counter summed inside batch",
+			payload: `[{"id": "batch", "type":"counter", "delta": 2}, {"id": "batch", "type":"counter", "delta": 3}]`,
+			want: want{
+				code: http.StatusOK,
+				resp: `[{"id": "batch", "type":"counter", "delta": 2}, {"id": "batch", "type":"counter", "delta": 5}]`,
+			},
+		},
+		{
+			name:    "per item error rejects whole batch",
+			setup:   []string{`[{"id": "batch", "type":"counter", "delta": 5}]`},
+			payload: `[{"id": "batch", "type":"counter", "delta": 1}, {"id": "1bad", "type":"gauge", "value": 1}]`,
+			want: want{
+				code: http.StatusBadRequest,
+				resp: `[{"id": "batch", "type":"counter", "delta": 1}, {"id": "1bad", "type":"gauge", "value": 1, "error": "not valid metric Name"}]`,
+			},
+		},
+		{
+			name: "rejected batch was not applied",
+			setup: []string{
+				`[{"id": "batch", "type":"counter", "delta": 5}]`,
+				`[{"id": "batch", "type":"counter", "delta": 1}, {"id": "1bad", "type":"gauge", "value": 1}]`,
+			},
+			payload: `[{"id": "batch", "type":"counter", "delta": 1}]`,
+			want: want{
+				code: http.StatusOK,
+				resp: `[{"id": "batch", "type":"counter", "delta": 6}]`,
+			},
+		},
+		{
+			name:    "empty batch",
+			payload: `[]`,
+			want: want{
+				code: http.StatusBadRequest,
+				resp: `{"error":"mailformed request"}`,
+			},
+		},
+		{
+			name:    "not an array",
+			payload: `{"id": "test", "type":"counter", "delta": 1}`,
+			want: want{
+				code: http.StatusBadRequest,
+				resp: `{"error":"mailformed request"}`,
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(NewMetricsRouter(storage.NewRepository()))
+			defer ts.Close()
+			header := http.Header{"Content-Type": {"application/json"}}
+			for _, batch := range tc.setup {
+				testRequest(t, ts, "POST", "/updates/", header, strings.NewReader(batch))
+			}
+			statusCode, bd, _ := testRequest(t, ts, "POST", "/updates/", header, strings.NewReader(tc.payload))
+			assert.Equal(t, tc.want.code, statusCode)
+			assert.JSONEq(t, tc.want.resp, bd)
+		})
+	}
+}
+
+func TestSnapshotsHandler(t *testing.T) {
+	ts := httptest.NewServer(NewMetricsRouter(storage.NewRepository()))
+	statusCode, body, _ := testRequest(t, ts, "GET", "/admin/snapshots", http.Header{}, nil)
+	ts.Close()
+	assert.Equal(t, http.StatusNotImplemented, statusCode)
+	assert.JSONEq(t, `{"error":"storage does not keep snapshots"}`, body)
+
+	saver := &storage.JSONFileSaver{
+		FilePath:          filepath.Join(t.TempDir(), "metrics.json"),
+		SnapshotHistory:   1,
+		IMetricRepository: storage.NewRepository(),
+	}
+	require.NoError(t, saver.SaveHistory())
+	ts = httptest.NewServer(NewMetricsRouter(saver, WithSnapshots(saver)))
+	defer ts.Close()
+	statusCode, body, _ = testRequest(t, ts, "GET", "/admin/snapshots", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	var snapshots []storage.SnapshotInfo
+	require.NoError(t, json.Unmarshal([]byte(body), &snapshots))
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, "metrics.json", snapshots[0].Name)
+	assert.True(t, snapshots[1].Valid)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	history := storage.NewMetricHistory(10, 0)
+	repo := storage.NewHistoryRecorder(storage.NewRepository(), history)
+	delta := int64(2)
+	for i := 0; i < 2; i++ {
+		_, err := repo.Collect(&storage.Metrics{ID: "clicks", MType: storage.CounterMetric, Delta: &delta})
+		require.NoError(t, err)
+	}
+	ts := httptest.NewServer(NewMetricsRouter(repo, WithHistory(history)))
+	defer ts.Close()
+
+	statusCode, body, _ := testRequest(t, ts, "GET", "/history/counter/clicks", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	var resp HistoryResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	assert.Equal(t, "clicks", resp.ID)
+	require.Len(t, resp.Samples, 2)
+	assert.Equal(t, int64(4), *resp.Samples[1].Delta)
+
+	statusCode, body, _ = testRequest(t, ts, "GET", "/history/counter/clicks?to=1", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"id":"clicks","type":"counter","resolution":"raw","samples":[]}`, body)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/history/counter/clicks?resolution=1m", http.Header{}, nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/history/counter/clicks?resolution=often", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, _, _ = testRequest(t, ts, "GET", "/history/counter/clicks?from=yesterday", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/history/gauge/clicks", http.Header{}, nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/history/unknown/clicks", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestLabelsHandlers(t *testing.T) {
+	repo := storage.NewRepository()
+	ts := httptest.NewServer(NewMetricsRouter(repo))
+	defer ts.Close()
+
+	statusCode, _, _ := testRequest(t, ts, "POST", "/update/gauge/HeapAlloc/1?host=web01", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/gauge/HeapAlloc/2?host=db01", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/gauge/HeapAlloc/2?1host=db01", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, body, _ := testRequest(t, ts, "GET", "/value/gauge/HeapAlloc?host=web01", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "1", body)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/value/gauge/HeapAlloc", http.Header{}, nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	statusCode, body, _ = testRequest(t, ts, "POST", "/value/", http.Header{"Content-Type": {"application/json"}},
+		strings.NewReader(`{"id":"HeapAlloc","type":"gauge","labels":{"host":"db01"}}`))
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"id":"HeapAlloc","type":"gauge","value":2,"labels":{"host":"db01"}}`, body)
+
+	statusCode, body, _ = testRequest(t, ts, "GET", "/?host=db01", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, `HeapAlloc{host=&#34;db01&#34;} gauge 2`)
+	assert.NotContains(t, body, "web01")
+}
+
+func TestHistogramHandlers(t *testing.T) {
+	repo := storage.NewRepository()
+	ts := httptest.NewServer(NewMetricsRouter(repo))
+	defer ts.Close()
+
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	statusCode, body, _ := testRequest(t, ts, "POST", "/update/", jsonHeader,
+		strings.NewReader(`{"id":"latency","type":"histogram","histogram":{"buckets":[1,2,4],"counts":[1,2,1,0],"sum":6,"count":4}}`))
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"id":"latency","type":"histogram","histogram":{"buckets":[1,2,4],"counts":[1,2,1,0],"sum":6,"count":4}}`, body)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/histogram/latency/3", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/", jsonHeader,
+		strings.NewReader(`{"id":"latency","type":"histogram","histogram":{"buckets":[1,2],"counts":[1,0,0],"sum":1,"count":1}}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/", jsonHeader,
+		strings.NewReader(`{"id":"latency","type":"histogram","histogram":{"buckets":[1,2],"counts":[1,0],"sum":1,"count":1}}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/histogram/latency?q=0.5", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "1.75", body)
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/histogram/latency", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "count=5 sum=9 p50=1.75 p90=3.5 p99=3.95", body)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/value/histogram/latency?q=2", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, body, _ = testRequest(t, ts, "POST", "/value/", jsonHeader,
+		strings.NewReader(`{"id":"latency","type":"histogram","quantiles":[0.5]}`))
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"id":"latency","type":"histogram","histogram":{"buckets":[1,2,4],"counts":[1,2,2,0],"sum":9,"count":5},"quantiles":{"0.5":1.75}}`, body)
+}
+
+func TestSummaryHandlers(t *testing.T) {
+	repo := storage.NewRepository()
+	ts := httptest.NewServer(NewMetricsRouter(repo))
+	defer ts.Close()
+
+	for _, v := range []string{"100", "200", "300"} {
+		statusCode, _, _ := testRequest(t, ts, "POST", "/update/summary/latency/"+v, http.Header{}, nil)
+		assert.Equal(t, http.StatusOK, statusCode)
+	}
+	statusCode, _, _ := testRequest(t, ts, "POST", "/update/summary/latency/NaN", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/", http.Header{"Content-Type": {"application/json"}},
+		strings.NewReader(`{"id":"latency","type":"summary","summary":{"accuracy":0.05,"positive":{"10":1},"count":1}}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, body, _ := testRequest(t, ts, "GET", "/value/summary/latency?q=0.99", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	estimate, err := strconv.ParseFloat(body, 64)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 300, estimate, storage.DefaultSketchAccuracy)
+
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/summary/latency", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, "count=3 sum=600 p50=")
+}
+
+func TestSetHandlers(t *testing.T) {
+	repo := storage.NewRepository()
+	ts := httptest.NewServer(NewMetricsRouter(repo))
+	defer ts.Close()
+
+	for _, member := range []string{"alice", "bob", "alice"} {
+		statusCode, _, _ := testRequest(t, ts, "POST", "/update/set/visitors/"+member, http.Header{}, nil)
+		assert.Equal(t, http.StatusOK, statusCode)
+	}
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	statusCode, _, _ := testRequest(t, ts, "POST", "/update/", jsonHeader,
+		strings.NewReader(`{"id":"visitors","type":"set","members":["carol"]}`))
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/", jsonHeader,
+		strings.NewReader(`{"id":"visitors","type":"set"}`))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, body, _ := testRequest(t, ts, "GET", "/value/set/visitors", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "3", body)
+
+	statusCode, body, _ = testRequest(t, ts, "POST", "/value/", jsonHeader,
+		strings.NewReader(`{"id":"visitors","type":"set"}`))
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, `"cardinality":3`)
+}
+
+func TestResetHandler(t *testing.T) {
+	repo := storage.NewRepository()
+	ts := httptest.NewServer(NewMetricsRouter(repo))
+	defer ts.Close()
+
+	statusCode, _, _ := testRequest(t, ts, "POST", "/update/updowncounter/queue/5?shard=1", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/updowncounter/queue/-7?shard=1", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/counter/queue/-7", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	statusCode, body, _ := testRequest(t, ts, "GET", "/value/updowncounter/queue?shard=1", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "-2", body)
+
+	statusCode, body, _ = testRequest(t, ts, "POST", "/reset/updowncounter/queue?shard=1", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	var metric storage.Metrics
+	require.NoError(t, json.Unmarshal([]byte(body), &metric))
+	assert.Equal(t, int64(0), *metric.Delta)
+	assert.NotNil(t, metric.ResetAt)
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/updowncounter/queue?shard=1", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "0", body)
+
+	statusCode, _, _ = testRequest(t, ts, "POST", "/reset/updowncounter/queue", http.Header{}, nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/reset/gauge/queue", http.Header{}, nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestIdempotentUpdates(t *testing.T) {
+	repo := storage.NewRepository()
+	store := storage.NewIdempotencyStore("", time.Minute)
+	ts := httptest.NewServer(NewMetricsRouter(repo, WithIdempotency(store)))
+	defer ts.Close()
+
+	keyed := func(key string) http.Header {
+		return http.Header{"Content-Type": {"application/json"}, storage.IdempotencyKeyHeader: {key}}
+	}
+	update := `{"id":"PollCount","type":"counter","delta":5}`
+	statusCode, first, _ := testRequest(t, ts, "POST", "/update/", keyed("web01:1"), strings.NewReader(update))
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, replayed, header := testRequest(t, ts, "POST", "/update/", keyed("web01:1"), strings.NewReader(update))
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, first, replayed)
+	assert.Equal(t, "true", header.Get(IdempotentReplayedHeader))
+	statusCode, _, _ = testRequest(t, ts, "POST", "/updates/", keyed("web01:2"), strings.NewReader("["+update+"]"))
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/updates/", keyed("web01:2"), strings.NewReader("["+update+"]"))
+	assert.Equal(t, http.StatusOK, statusCode)
+	// the same sequence of another agent is another update
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/counter/PollCount/5", keyed("web02:1"), nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/counter/PollCount/5", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/counter/PollCount/5", keyed("web02"), nil)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, body, _ := testRequest(t, ts, "GET", "/value/counter/PollCount", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "20", body)
+}
+
+func TestTypeConflicts(t *testing.T) {
+	registry := storage.NewTypeRegistry()
+	require.NoError(t, registry.Declare(storage.MetricDescriptor{Name: "HeapAlloc", MType: storage.GaugeMetric, Unit: "bytes"}))
+	repo := storage.NewTypeGuard(storage.NewRepository(), registry)
+	ts := httptest.NewServer(NewMetricsRouter(repo, WithRegistry(registry)))
+	defer ts.Close()
+
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	statusCode, _, _ := testRequest(t, ts, "POST", "/update/counter/HeapAlloc/1", http.Header{}, nil)
+	assert.Equal(t, http.StatusConflict, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/gauge/HeapAlloc/1", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, body, _ := testRequest(t, ts, "POST", "/update/", jsonHeader, strings.NewReader(`{"id":"HeapAlloc","type":"counter","delta":1}`))
+	assert.Equal(t, http.StatusConflict, statusCode)
+	assert.Contains(t, body, "HeapAlloc is a gauge")
+	statusCode, _, _ = testRequest(t, ts, "POST", "/updates/", jsonHeader,
+		strings.NewReader(`[{"id":"Alloc","type":"gauge","value":1},{"id":"HeapAlloc","type":"counter","delta":1}]`))
+	assert.Equal(t, http.StatusConflict, statusCode)
+
+	statusCode, body, _ = testRequest(t, ts, "GET", "/admin/metrics", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `[{"name":"HeapAlloc","type":"gauge","unit":"bytes"}]`, body)
+
+	ts2 := httptest.NewServer(NewMetricsRouter(storage.NewRepository()))
+	defer ts2.Close()
+	statusCode, _, _ = testRequest(t, ts2, "GET", "/admin/metrics", http.Header{}, nil)
+	assert.Equal(t, http.StatusNotImplemented, statusCode)
+}
+
+func TestMetricMetadata(t *testing.T) {
+	registry := storage.NewTypeRegistry()
+	repo := storage.NewTypeGuard(storage.NewRepository(), registry)
+	ts := httptest.NewServer(NewMetricsRouter(repo, WithRegistry(registry)))
+	defer ts.Close()
+
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	statusCode, _, _ := testRequest(t, ts, "POST", "/admin/metrics", jsonHeader,
+		strings.NewReader(`[{"name":"HeapAlloc","type":"gauge","unit":"bytes","description":"Bytes of allocated heap objects"}]`))
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/admin/metrics", jsonHeader,
+		strings.NewReader(`[{"name":"HeapAlloc","type":"counter"}]`))
+	assert.Equal(t, http.StatusConflict, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "POST", "/admin/metrics", jsonHeader, strings.NewReader(`[{"name":"HeapAlloc"}]`))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, _, _ = testRequest(t, ts, "POST", "/update/gauge/HeapAlloc/1572864", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, body, _ := testRequest(t, ts, "GET", "/", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, `<li title="Bytes of allocated heap objects">HeapAlloc gauge 1.5 MiB</li>`)
+
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/gauge/HeapAlloc", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "1.572864e+06", body)
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/gauge/HeapAlloc?format=human", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "1.5 MiB", body)
+
+	statusCode, body, _ = testRequest(t, ts, "POST", "/value/", jsonHeader, strings.NewReader(`{"id":"HeapAlloc","type":"gauge"}`))
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"id":"HeapAlloc","type":"gauge","value":1572864,"unit":"bytes","description":"Bytes of allocated heap objects","display":"1.5 MiB"}`, body)
+}
+
+func TestExpositionHandler(t *testing.T) {
+	registry := storage.NewTypeRegistry()
+	repo := storage.NewTypeGuard(storage.NewRepository(), registry)
+	ts := httptest.NewServer(NewMetricsRouter(repo, WithRegistry(registry)))
+	defer ts.Close()
+
+	require.NoError(t, registry.Declare(storage.MetricDescriptor{Name: "heap_bytes", MType: storage.GaugeMetric, Unit: storage.UnitBytes, Description: "Heap \"in use\""}))
+	require.NoError(t, registry.Declare(storage.MetricDescriptor{Name: "PollCount", MType: storage.CounterMetric, Help: "Number of polls"}))
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	for _, update := range []string{
+		`{"id":"PollCount","type":"counter","delta":3,"labels":{"host":"web02"}}`,
+		`{"id":"PollCount","type":"counter","delta":5,"labels":{"host":"web01"}}`,
+		`{"id":"heap_bytes","type":"gauge","value":1024}`,
+		`{"id":"queue","type":"updowncounter","delta":-2}`,
+		`{"id":"latency","type":"histogram","histogram":{"buckets":[1,2],"counts":[1,2,1],"sum":6,"count":4},"labels":{"path":"/a\"b"}}`,
+		`{"id":"visitors","type":"set","members":["a","b"]}`,
+	} {
+		statusCode, _, _ := testRequest(t, ts, "POST", "/update/", jsonHeader, strings.NewReader(update))
+		require.Equal(t, http.StatusOK, statusCode, update)
+	}
+	// le would clash with the label of buckets
+	statusCode, _, _ := testRequest(t, ts, "POST", "/update/", jsonHeader,
+		strings.NewReader(`{"id":"latency","type":"histogram","value":1,"labels":{"le":"1"}}`))
+	require.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, body, header := testRequest(t, ts, "GET", "/metrics", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, prometheusContentType, header.Get("Content-Type"))
+	assert.Equal(t, `# HELP PollCount_total Number of polls
+# TYPE PollCount_total counter
+PollCount_total{host="web01"} 5
+PollCount_total{host="web02"} 3
+# HELP heap_bytes Heap "in use"
+# TYPE heap_bytes gauge
+heap_bytes 1024
+# TYPE latency histogram
+latency_bucket{path="/a\"b",le="1"} 1
+latency_bucket{path="/a\"b",le="2"} 3
+latency_bucket{path="/a\"b",le="+Inf"} 4
+latency_sum{path="/a\"b"} 6
+latency_count{path="/a\"b"} 4
+# TYPE queue gauge
+queue -2
+# TYPE visitors gauge
+visitors 2
+`, body)
+
+	statusCode, body, header = testRequest(t, ts, "GET", "/metrics",
+		http.Header{"Accept": {"application/openmetrics-text;version=1.0.0,text/plain;q=0.5"}}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, openMetricsContentType, header.Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(body, `# HELP PollCount Number of polls
+# TYPE PollCount counter
+PollCount_total{host="web01"} 5
+`), body)
+	assert.Contains(t, body, `# HELP heap_bytes Heap \"in use\"
+# TYPE heap_bytes gauge
+# UNIT heap_bytes bytes
+`)
+	assert.True(t, strings.HasSuffix(body, "# EOF\n"))
+
+	_, _, header = testRequest(t, ts, "GET", "/metrics", http.Header{"Accept": {"application/openmetrics-text;q=0"}}, nil)
+	assert.Equal(t, prometheusContentType, header.Get("Content-Type"))
+}
+
+func TestExpositionSkipsCollidingNames(t *testing.T) {
+	one, two := int64(1), int64(2)
+	value := 3.0
+	histogram := storage.NewHistogram([]float64{1})
+	histogram.Observe(0.5)
+	metrics := []storage.Metrics{
+		{ID: "x_count", MType: storage.GaugeMetric, Value: &value},
+		{ID: "foo_total", MType: storage.CounterMetric, Delta: &two},
+		{ID: "x", MType: storage.HistogramMetric, Histogram: histogram},
+		{ID: "foo", MType: storage.CounterMetric, Delta: &one},
+	}
+	var buf bytes.Buffer
+	writeExposition(&buf, metrics, storage.NewTypeRegistry(), false)
+	assert.Equal(t, `# TYPE foo_total counter
+foo_total 1
+# TYPE x histogram
+x_bucket{le="1"} 1
+x_bucket{le="+Inf"} 1
+x_sum 0.5
+x_count 1
+`, buf.String())
+}
+
+func TestPushHandlers(t *testing.T) {
+	registry := storage.NewTypeRegistry()
+	repo := storage.NewTypeGuard(storage.NewRepository(), registry)
+	groups := storage.NewPushGroups()
+	groups.Path = filepath.Join(t.TempDir(), "pushgroups")
+	ts := httptest.NewServer(NewMetricsRouter(repo, WithRegistry(registry), WithPushGroups(groups)))
+	defer ts.Close()
+
+	textHeader := http.Header{"Content-Type": {"text/plain"}}
+	statusCode, _, _ := testRequest(t, ts, "PUT", "/metrics/job/backup/instance/db01", textHeader, strings.NewReader(`# TYPE backup_files_total counter
+backup_files_total 120
+backup_files_total{disk="sdb"} 0
+backup_duration_seconds 12.5
+`))
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "PUT", "/metrics/job/backup/instance/db02", textHeader, strings.NewReader("backup_duration_seconds 3\n"))
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, body, _ := testRequest(t, ts, "GET", "/value/counter/backup_files?job=backup&instance=db01", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "120", body)
+
+	// POST replaces only series with pushed names, the pushed counter total is not added to the stored one
+	statusCode, _, _ = testRequest(t, ts, "POST", "/metrics/job/backup/instance/db01", textHeader, strings.NewReader("# TYPE backup_files counter\nbackup_files 130\n"))
+	assert.Equal(t, http.StatusOK, statusCode)
+	_, body, _ = testRequest(t, ts, "GET", "/value/counter/backup_files?job=backup&instance=db01", http.Header{}, nil)
+	assert.Equal(t, "130", body)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/value/counter/backup_files?job=backup&instance=db01&disk=sdb", http.Header{}, nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/value/gauge/backup_duration_seconds?job=backup&instance=db01", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	// PUT replaces the whole group
+	statusCode, _, _ = testRequest(t, ts, "PUT", "/metrics/job/backup/instance/db01", textHeader, strings.NewReader("backup_running 0\n"))
+	assert.Equal(t, http.StatusOK, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/value/gauge/backup_duration_seconds?job=backup&instance=db01", http.Header{}, nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	statusCode, _, _ = testRequest(t, ts, "DELETE", "/metrics/job/backup/instance/db01", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Len(t, repo.GetAllMetrics(), 1)
+
+	restored := storage.NewPushGroups()
+	restored.Path = groups.Path
+	require.NoError(t, restored.Load())
+	require.NoError(t, restored.Delete(repo, map[string]string{"job": "backup", "instance": "db02"}))
+	assert.Empty(t, repo.GetAllMetrics())
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "odd grouping labels", path: "/metrics/job/backup/instance", body: "up 1\n", status: http.StatusBadRequest},
+		{name: "not valid grouping label", path: "/metrics/job/backup/1instance/db01", body: "up 1\n", status: http.StatusBadRequest},
+		{name: "syntax error", path: "/metrics/job/backup", body: "up{\n", status: http.StatusBadRequest},
+		{name: "conflicting label", path: "/metrics/job/backup", body: "up{job=\"other\"} 1\n", status: http.StatusBadRequest},
+		{name: "not valid name", path: "/metrics/job/backup", body: "backup:files 1\n", status: http.StatusBadRequest},
+		{name: "type conflict", path: "/metrics/job/backup", body: "backup_size 5\n# TYPE backup_running counter\nbackup_running 1\n", status: http.StatusConflict},
+	}
+	require.NoError(t, registry.Declare(storage.MetricDescriptor{Name: "backup_running", MType: storage.GaugeMetric}))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statusCode, _, _ := testRequest(t, ts, "PUT", tt.path, textHeader, strings.NewReader(tt.body))
+			assert.Equal(t, tt.status, statusCode)
+		})
+	}
+	// a rejected push is not applied partially
+	assert.Empty(t, repo.GetAllMetrics())
+
+	ts = httptest.NewServer(NewMetricsRouter(repo))
+	defer ts.Close()
+	statusCode, _, _ = testRequest(t, ts, "PUT", "/metrics/job/backup", textHeader, strings.NewReader("up 1\n"))
+	assert.Equal(t, http.StatusNotImplemented, statusCode)
+}
+
+func TestInfluxWriteHandler(t *testing.T) {
+	registry := storage.NewTypeRegistry()
+	repo := storage.NewTypeGuard(storage.NewRepository(), registry)
+	types, err := influx.ParseTypeRules("processes_*:gauge")
+	require.NoError(t, err)
+	ts := httptest.NewServer(NewMetricsRouter(repo, WithRegistry(registry), WithInfluxMapping(influx.Mapping{Types: types})))
+	defer ts.Close()
+
+	statusCode, _, _ := testRequest(t, ts, "POST", "/write?db=telegraf", http.Header{},
+		strings.NewReader("cpu,host=web01 usage_idle=99.5\nnet,host=web01 bytes_recv=1024i 1700000000000000000\n"))
+	assert.Equal(t, http.StatusNoContent, statusCode)
+	// counters carry totals, a later write replaces the stored value
+	statusCode, _, _ = testRequest(t, ts, "POST", "/write", http.Header{}, strings.NewReader("net,host=web01 bytes_recv=2048i\n"))
+	assert.Equal(t, http.StatusNoContent, statusCode)
+	statusCode, body, _ := testRequest(t, ts, "GET", "/value/counter/net_bytes_recv?host=web01", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "2048", body)
+	// integers are counters and floats are gauges
+	statusCode, _, _ = testRequest(t, ts, "POST", "/write", http.Header{}, strings.NewReader("m i=5i,f=1.5\n"))
+	assert.Equal(t, http.StatusNoContent, statusCode)
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/counter/m_i", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "5", body)
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/gauge/m_f", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "1.5", body)
+	// rules make integers gauges
+	statusCode, _, _ = testRequest(t, ts, "POST", "/write", http.Header{}, strings.NewReader("processes,host=web01 running=3i\n"))
+	assert.Equal(t, http.StatusNoContent, statusCode)
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/gauge/processes_running?host=web01", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "3", body)
+
+	statusCode, body, header := testRequest(t, ts, "POST", "/write", http.Header{},
+		strings.NewReader("cpu,host=web02 usage_idle=50\ncpu usage_idle=high\ncpu,host=web02 usage_idle=1\n"))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.JSONEq(t, `{"error":"partial write: unable to parse 'cpu usage_idle=high': field \"usage_idle\": bad float \"high\" dropped=1"}`, body)
+	assert.Equal(t, `partial write: unable to parse 'cpu usage_idle=high': field "usage_idle": bad float "high" dropped=1`, header.Get(influxErrorHeader))
+	statusCode, body, _ = testRequest(t, ts, "GET", "/value/gauge/cpu_usage_idle?host=web02", http.Header{}, nil)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "1", body)
+
+	statusCode, body, _ = testRequest(t, ts, "POST", "/write", http.Header{}, strings.NewReader("net bytes_recv=-1i\n"))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.JSONEq(t, `{"error":"unable to parse 'net bytes_recv=-1i': counter value should not be negative dropped=1"}`, body)
+
+	// a point is dropped with all its fields when one of them conflicts
+	require.NoError(t, registry.Declare(storage.MetricDescriptor{Name: "net_bytes_sent", MType: storage.GaugeMetric}))
+	statusCode, _, _ = testRequest(t, ts, "POST", "/write", http.Header{}, strings.NewReader("net,host=web03 drops=1i,bytes_sent=5i\n"))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	statusCode, _, _ = testRequest(t, ts, "GET", "/value/gauge/net_drops?host=web03", http.Header{}, nil)
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	// a point without numeric fields is dropped instead of being written empty
+	statusCode, body, _ = testRequest(t, ts, "POST", "/write", http.Header{}, strings.NewReader("syslog message=\"up\"\n"))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.JSONEq(t, `{"error":"unable to parse 'syslog message=\"up\"': point has no numeric fields dropped=1"}`, body)
+
+	statusCode, _, _ = testRequest(t, ts, "POST", "/write", http.Header{}, strings.NewReader("\n"))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
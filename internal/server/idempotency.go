@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"net/http"
+	"time"
+)
+
+// IdempotentReplayedHeader marks responses replayed to retries of an update
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// recordingResponseWriter holds the response back until its key is completed and keeps it for replaying to retries
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recordingResponseWriter) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *recordingResponseWriter) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+}
+
+// flush sends the response held back
+func (r *recordingResponseWriter) flush() {
+	r.ResponseWriter.WriteHeader(r.status)
+	logError(r.ResponseWriter.Write(r.body.Bytes()))
+}
+
+// withIdempotency applies an update with an idempotency key once, retries get the first response back.
+// Requests without a key are passed as is
+func withIdempotency(store *storage.IdempotencyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if store == nil {
+			return next
+		}
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			value := request.Header.Get(storage.IdempotencyKeyHeader)
+			if value == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			key, err := storage.ParseIdempotencyKey(value)
+			if err != nil {
+				writer.Header().Set("Content-Type", "application/json")
+				writer.WriteHeader(http.StatusBadRequest)
+				logError(0, json.NewEncoder(writer).Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+				return
+			}
+			seen, err := store.Begin(key, time.Now())
+			if errors.Is(err, storage.ErrRequestInProgress) {
+				writer.Header().Set("Content-Type", "application/json")
+				writer.WriteHeader(http.StatusConflict)
+				logError(0, json.NewEncoder(writer).Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+				return
+			}
+			if seen != nil {
+				if seen.ContentType != "" {
+					writer.Header().Set("Content-Type", seen.ContentType)
+				}
+				writer.Header().Set(IdempotentReplayedHeader, "true")
+				writer.WriteHeader(seen.Status)
+				logError(writer.Write(seen.Body))
+				return
+			}
+
+			recorder := &recordingResponseWriter{ResponseWriter: writer}
+			next.ServeHTTP(recorder, request)
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			defer recorder.flush()
+			// failed updates are not applied, so their retries should be
+			if recorder.status >= http.StatusInternalServerError {
+				store.Abort(key)
+				return
+			}
+			// the response is sent after the key is completed, so an acknowledged update is saved with its key
+			store.Complete(key, storage.IdempotentResponse{
+				Status:      recorder.status,
+				ContentType: writer.Header().Get("Content-Type"),
+				Body:        recorder.body.Bytes(),
+				SeenAt:      time.Now(),
+			})
+		})
+	}
+}
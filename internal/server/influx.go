@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/influx"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxInfluxLineBytes = 1 << 20
+	// influxErrorHeader repeats the error of a write for clients which do not read the body
+	influxErrorHeader = "X-Influxdb-Error"
+)
+
+var errNoNumericFields = errors.New("point has no numeric fields")
+
+// getInfluxWriteHandler stores points of the InfluxDB line protocol like Influx 1.x /write does:
+// 204 when every point is written, otherwise 400 with the first error and the number of dropped points.
+// Points which could be written are kept, the error is then reported as a partial write.
+// A point is written or dropped with all its fields, a point with string fields only is dropped
+func getInfluxWriteHandler(repository storage.IMetricRepository, mapping influx.Mapping) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		var written, dropped int
+		var firstErr string
+		drop := func(line string, err error) {
+			if dropped == 0 {
+				firstErr = fmt.Sprintf("unable to parse '%s': %v", line, err)
+			}
+			dropped++
+		}
+
+		scanner := bufio.NewScanner(request.Body)
+		scanner.Buffer(make([]byte, 4096), maxInfluxLineBytes)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			metrics, err := mapping.ParseLine(line)
+			if err != nil {
+				drop(line, err)
+				continue
+			}
+			if len(metrics) == 0 {
+				drop(line, errNoNumericFields)
+				continue
+			}
+			// fields of a point are written together, a point with a bad field is dropped as a whole
+			_, err = repository.SetBatch(metrics)
+			var itemErr *storage.BatchItemError
+			if errors.As(err, &itemErr) {
+				drop(line, itemErr.Err)
+				continue
+			}
+			if err != nil {
+				logger.Log.Error("problems with storing influx point", zap.Error(err))
+				writeInfluxError(writer, http.StatusInternalServerError, problemsWithServerError)
+				return
+			}
+			written++
+		}
+		if err := scanner.Err(); err != nil {
+			writeInfluxError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+		switch {
+		case dropped > 0 && written > 0:
+			writeInfluxError(writer, http.StatusBadRequest, fmt.Sprintf("partial write: %s dropped=%d", firstErr, dropped))
+		case dropped > 0:
+			writeInfluxError(writer, http.StatusBadRequest, fmt.Sprintf("%s dropped=%d", firstErr, dropped))
+		case written == 0:
+			writeInfluxError(writer, http.StatusBadRequest, "no points")
+		default:
+			writer.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func writeInfluxError(writer http.ResponseWriter, status int, message string) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set(influxErrorHeader, message)
+	writer.WriteHeader(status)
+	logError(0, json.NewEncoder(writer).Encode(storage.ErrorResponse{ErrorValue: message}))
+}
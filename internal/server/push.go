@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseGroupingKey takes the job and further label pairs from a path like /metrics/job/backup/instance/db01
+func parseGroupingKey(request *http.Request) (map[string]string, error) {
+	job, err := url.PathUnescape(chi.URLParam(request, "job"))
+	if err != nil || job == "" {
+		return nil, errors.New("job should not be empty")
+	}
+	grouping := map[string]string{"job": job}
+	rest := strings.Trim(chi.URLParam(request, "*"), "/")
+	if rest == "" {
+		return grouping, nil
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts)%2 != 0 {
+		return nil, errors.New("grouping labels should come in name/value pairs")
+	}
+	for i := 0; i < len(parts); i += 2 {
+		name := parts[i]
+		value, err := url.PathUnescape(parts[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("not valid value of grouping label %q", name)
+		}
+		if _, ok := grouping[name]; ok {
+			return nil, fmt.Errorf("duplicate grouping label %q", name)
+		}
+		grouping[name] = value
+	}
+	return grouping, storage.ValidateLabels(grouping)
+}
+
+// getPushHandler stores metrics pushed in the Prometheus text format under the grouping key of the path.
+// With replace all series of the group are replaced, otherwise only series with the pushed names
+func getPushHandler(repository storage.IMetricRepository, groups *storage.PushGroups, replace bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(writer)
+		if groups == nil {
+			writer.WriteHeader(http.StatusNotImplemented)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: "metric pushes are disabled"}))
+			return
+		}
+		grouping, err := parseGroupingKey(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+			return
+		}
+		metrics, err := storage.ParseExposition(request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+			return
+		}
+		err = groups.Push(repository, grouping, metrics, replace)
+		var itemErr *storage.BatchItemError
+		switch {
+		case errors.Is(err, storage.ErrTypeConflict):
+			writer.WriteHeader(http.StatusConflict)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+			return
+		case errors.As(err, &itemErr):
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+			return
+		case err != nil:
+			logger.Log.Error("problems with storing pushed metrics", zap.Error(err))
+			writer.WriteHeader(http.StatusInternalServerError)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: problemsWithServerError}))
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+		logError(0, enc.Encode(metrics))
+	}
+}
+
+// getPushDeleteHandler deletes all series of the group given by the path
+func getPushDeleteHandler(repository storage.IMetricRepository, groups *storage.PushGroups) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(writer)
+		if groups == nil {
+			writer.WriteHeader(http.StatusNotImplemented)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: "metric pushes are disabled"}))
+			return
+		}
+		grouping, err := parseGroupingKey(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: err.Error()}))
+			return
+		}
+		if err = groups.Delete(repository, grouping); err != nil {
+			logger.Log.Error("problems with deleting push group", zap.Error(err))
+			writer.WriteHeader(http.StatusInternalServerError)
+			logError(0, enc.Encode(storage.ErrorResponse{ErrorValue: problemsWithServerError}))
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+		logError(0, enc.Encode(grouping))
+	}
+}
@@ -0,0 +1,158 @@
+package statsd
+
+import (
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"go.uber.org/zap"
+	"math"
+	"sort"
+	"sync"
+)
+
+// maxSetMembers limits members of a set kept between flushes, beyond it they are counted by a HyperLogLog
+const maxSetMembers = 1000
+
+type seriesKey struct {
+	name   string
+	labels string
+}
+
+type gaugeState struct {
+	value    float64
+	relative bool
+}
+
+// setState keeps distinct members of a set until there are too many of them
+type setState struct {
+	members map[string]struct{}
+	sketch  *storage.HyperLogLog
+}
+
+func (s *setState) add(member string) {
+	if s.sketch != nil {
+		s.sketch.Add(member)
+		return
+	}
+	s.members[member] = struct{}{}
+	if len(s.members) > maxSetMembers {
+		s.sketch = storage.NewHyperLogLog(storage.DefaultSetPrecision)
+		for m := range s.members {
+			s.sketch.Add(m)
+		}
+		s.members = nil
+	}
+}
+
+// aggregator accumulates samples between flushes, at most maxSeries series unless it is 0
+type aggregator struct {
+	mu         sync.Mutex
+	maxSeries  int
+	labels     map[seriesKey]map[string]string
+	counters   map[seriesKey]float64
+	gauges     map[seriesKey]*gaugeState
+	histograms map[seriesKey]*storage.Histogram
+	sets       map[seriesKey]*setState
+}
+
+func newAggregator(maxSeries int) *aggregator {
+	a := &aggregator{maxSeries: maxSeries}
+	a.reset()
+	return a
+}
+
+func (a *aggregator) reset() {
+	a.labels = make(map[seriesKey]map[string]string)
+	a.counters = make(map[seriesKey]float64)
+	a.gauges = make(map[seriesKey]*gaugeState)
+	a.histograms = make(map[seriesKey]*storage.Histogram)
+	a.sets = make(map[seriesKey]*setState)
+}
+
+// Add accounts a sample, counters are scaled by their sample rate.
+// Timers are observed in seconds as they are sent in milliseconds.
+// A sample of a new series is dropped when there are maxSeries series already, then false is returned
+func (a *aggregator) Add(s Sample) bool {
+	key := seriesKey{name: s.Name, labels: storage.LabelsKey(s.Labels)}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.labels[key]; !ok && a.maxSeries > 0 && len(a.labels) >= a.maxSeries {
+		return false
+	}
+	a.labels[key] = s.Labels
+	switch s.Type {
+	case counterType:
+		a.counters[key] += s.Value / s.Rate
+	case gaugeType:
+		g, ok := a.gauges[key]
+		switch {
+		case !ok:
+			a.gauges[key] = &gaugeState{value: s.Value, relative: s.Relative}
+		case s.Relative:
+			g.value += s.Value
+		default:
+			g.value, g.relative = s.Value, false
+		}
+	case timerType, histogramType:
+		h, ok := a.histograms[key]
+		if !ok {
+			h = storage.NewHistogram(storage.DefaultHistogramBuckets)
+			a.histograms[key] = h
+		}
+		value := s.Value
+		if s.Type == timerType {
+			value /= 1000
+		}
+		h.Observe(value)
+	case setType:
+		set, ok := a.sets[key]
+		if !ok {
+			set = &setState{members: make(map[string]struct{})}
+			a.sets[key] = set
+		}
+		set.add(s.Raw)
+	}
+	return true
+}
+
+// Flush returns metrics accumulated since the previous flush and starts over.
+// Relative gauges are marked so that the repository adds them to the stored value
+func (a *aggregator) Flush() []storage.Metrics {
+	a.mu.Lock()
+	labels, counters, gauges, histograms, sets := a.labels, a.counters, a.gauges, a.histograms, a.sets
+	a.reset()
+	a.mu.Unlock()
+
+	var res []storage.Metrics
+	for key, sum := range counters {
+		// counters of the server only grow, so decrements and fractions below one are dropped
+		delta := int64(math.Round(sum))
+		if delta < 1 {
+			if delta < 0 {
+				logger.Log.Debug("dropping decrement of statsd counter, use a relative gauge instead",
+					zap.String("id", key.name), zap.Int64("delta", delta))
+			}
+			continue
+		}
+		res = append(res, storage.Metrics{ID: key.name, MType: storage.CounterMetric, Delta: &delta, Labels: labels[key]})
+	}
+	for key, g := range gauges {
+		value := g.value
+		m := storage.Metrics{ID: key.name, MType: storage.GaugeMetric, Value: &value, Relative: g.relative, Labels: labels[key]}
+		res = append(res, m)
+	}
+	for key, h := range histograms {
+		res = append(res, storage.Metrics{ID: key.name, MType: storage.HistogramMetric, Histogram: h, Labels: labels[key]})
+	}
+	for key, set := range sets {
+		m := storage.Metrics{ID: key.name, MType: storage.SetMetric, Set: set.sketch, Labels: labels[key]}
+		if set.sketch == nil {
+			m.Members = make([]string, 0, len(set.members))
+			for member := range set.members {
+				m.Members = append(m.Members, member)
+			}
+			sort.Strings(m.Members)
+		}
+		res = append(res, m)
+	}
+	return res
+}
@@ -0,0 +1,92 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"strconv"
+	"strings"
+)
+
+// Types of StatsD samples
+const (
+	counterType   = "c"
+	gaugeType     = "g"
+	timerType     = "ms"
+	histogramType = "h"
+	setType       = "s"
+)
+
+// Sample is a parsed StatsD line like api.requests:1|c|@0.1|#host:web01
+type Sample struct {
+	Name  string
+	Type  string
+	Value float64
+	// Raw is the value as it was sent, sets count distinct raw values
+	Raw string
+	// Relative gauges, sent with an explicit sign, change the current value instead of replacing it
+	Relative bool
+	Rate     float64
+	// Labels come from DogStatsD tags
+	Labels map[string]string
+}
+
+// ParseLine parses a single StatsD line
+func ParseLine(line string) (Sample, error) {
+	colon := strings.LastIndexByte(line, ':')
+	if pipe := strings.IndexByte(line, '|'); pipe >= 0 {
+		colon = strings.LastIndexByte(line[:pipe], ':')
+	}
+	if colon <= 0 {
+		return Sample{}, errors.New("sample should look like name:value|type")
+	}
+	s := Sample{Name: storage.SanitizeName(line[:colon]), Rate: 1}
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return Sample{}, errors.New("sample should have a type")
+	}
+	s.Raw, s.Type = parts[0], parts[1]
+	switch s.Type {
+	case counterType, gaugeType, timerType, histogramType:
+		value, err := strconv.ParseFloat(s.Raw, 64)
+		if err != nil {
+			return Sample{}, fmt.Errorf("not valid value %q", s.Raw)
+		}
+		s.Value = value
+		s.Relative = s.Type == gaugeType && (strings.HasPrefix(s.Raw, "+") || strings.HasPrefix(s.Raw, "-"))
+	case setType:
+		if s.Raw == "" {
+			return Sample{}, errors.New("set member should not be empty")
+		}
+	default:
+		return Sample{}, fmt.Errorf("not supported type %q", s.Type)
+	}
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Sample{}, fmt.Errorf("not valid sample rate %q", part)
+			}
+			s.Rate = rate
+		case strings.HasPrefix(part, "#"):
+			s.Labels = parseTags(part[1:])
+		}
+	}
+	return s, nil
+}
+
+// parseTags takes name:value tags as labels, tags without a value are skipped
+func parseTags(tags string) map[string]string {
+	labels := make(map[string]string)
+	for _, tag := range strings.Split(tags, ",") {
+		name, value, ok := strings.Cut(tag, ":")
+		if ok && name != "" && value != "" {
+			labels[storage.SanitizeName(name)] = value
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
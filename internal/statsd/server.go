@@ -0,0 +1,142 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/rkinwork/musthave-metrics/internal/listener"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxPacketSize = 65535
+
+// Server receives StatsD samples over UDP and TCP on the same address
+// and collects them into the repository every FlushInterval.
+// Between flushes at most MaxSeries series are aggregated, 0 means no limit
+type Server struct {
+	Addr          string
+	FlushInterval time.Duration
+	MaxSeries     int
+	repository    storage.IMetricRepository
+	agg           *aggregator
+	packetConn    net.PacketConn
+	tcp           *listener.TCP
+	wg            sync.WaitGroup
+	quit          chan struct{}
+}
+
+// Start opens listeners and serves until ctx is done, then the last samples are flushed
+func (s *Server) Start(ctx context.Context) error {
+	packetConn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	// the TCP listener takes the port UDP has got, so that :0 works for both
+	l, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		_ = packetConn.Close()
+		return err
+	}
+	s.packetConn = packetConn
+	s.agg = newAggregator(s.MaxSeries)
+
+	s.wg.Add(1)
+	go s.serveUDP()
+	s.tcp = &listener.TCP{Name: "statsd", MaxLineBytes: maxPacketSize}
+	s.tcp.Serve(l, s.handleLine)
+	go func() {
+		ticker := time.NewTicker(s.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.flush()
+			case <-ctx.Done():
+				s.stop()
+				s.flush()
+				close(s.quit)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Done waits for the server to stop after its context is done
+func (s *Server) Done() {
+	<-s.quit
+}
+
+// UDPAddr and TCPAddr return addresses the server listens on
+func (s *Server) UDPAddr() net.Addr {
+	return s.packetConn.LocalAddr()
+}
+
+func (s *Server) TCPAddr() net.Addr {
+	return s.tcp.Addr()
+}
+
+func (s *Server) stop() {
+	_ = s.packetConn.Close()
+	s.tcp.Stop()
+	s.wg.Wait()
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := s.packetConn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Log.Warn("problems with reading statsd packet", zap.Error(err))
+			continue
+		}
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			s.handleLine(string(bytes.TrimSpace(line)))
+		}
+	}
+}
+
+func (s *Server) handleLine(line string) {
+	if line == "" {
+		return
+	}
+	sample, err := ParseLine(line)
+	if err != nil {
+		logger.Log.Debug("problems with statsd line", zap.String("line", line), zap.Error(err))
+		return
+	}
+	if !s.agg.Add(sample) {
+		logger.Log.Debug("dropping statsd sample of a new series, too many series", zap.String("line", line))
+	}
+}
+
+func (s *Server) flush() {
+	for _, m := range s.agg.Flush() {
+		metric := m
+		if err := storage.ValidateMetric(&metric); err != nil {
+			logger.Log.Debug("dropping statsd metric", zap.String("id", metric.ID), zap.Error(err))
+			continue
+		}
+		if _, err := s.repository.Collect(&metric); err != nil {
+			logger.Log.Warn("problems with collecting statsd metric", zap.String("id", metric.ID), zap.Error(err))
+		}
+	}
+}
+
+func NewServer(addr string, flushInterval time.Duration, repository storage.IMetricRepository) *Server {
+	return &Server{
+		Addr:          addr,
+		FlushInterval: flushInterval,
+		repository:    repository,
+		quit:          make(chan struct{}),
+	}
+}
@@ -0,0 +1,142 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    Sample
+		wantErr bool
+	}{
+		{line: "api.requests:1|c", want: Sample{Name: "api_requests", Type: counterType, Value: 1, Raw: "1", Rate: 1}},
+		{line: "api.requests:2|c|@0.1|#host:web01,canary", want: Sample{Name: "api_requests", Type: counterType, Value: 2, Raw: "2", Rate: 0.1, Labels: map[string]string{"host": "web01"}}},
+		{line: "load:3.2|g", want: Sample{Name: "load", Type: gaugeType, Value: 3.2, Raw: "3.2", Rate: 1}},
+		{line: "load:-1|g", want: Sample{Name: "load", Type: gaugeType, Value: -1, Raw: "-1", Relative: true, Rate: 1}},
+		{line: "db.query:320|ms", want: Sample{Name: "db_query", Type: timerType, Value: 320, Raw: "320", Rate: 1}},
+		{line: "visitors:user:42|s", want: Sample{Name: "visitors_user", Type: setType, Raw: "42", Rate: 1}},
+		{line: "api.requests", wantErr: true},
+		{line: "api.requests:1", wantErr: true},
+		{line: "api.requests:one|c", wantErr: true},
+		{line: "api.requests:1|x", wantErr: true},
+		{line: "api.requests:1|c|@2", wantErr: true},
+		{line: ":1|c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAggregatorFlush(t *testing.T) {
+	repo := storage.NewRepository()
+	value := 10.0
+	_, err := repo.Collect(&storage.Metrics{ID: "queue", MType: storage.GaugeMetric, Value: &value})
+	require.NoError(t, err)
+
+	agg := newAggregator(0)
+	for _, line := range []string{
+		"hits:1|c|@0.5", "hits:3|c", "misses:-1|c",
+		"queue:+2|g", "queue:-1|g", "load:1|g", "load:+0.5|g",
+		"db.query:20|ms", "db.query:300|ms",
+		"visitors:a|s", "visitors:b|s", "visitors:a|s",
+	} {
+		s, err := ParseLine(line)
+		require.NoError(t, err)
+		assert.True(t, agg.Add(s))
+	}
+	metrics := make(map[string]storage.Metrics)
+	for _, m := range agg.Flush() {
+		metrics[m.ID] = m
+	}
+	require.Len(t, metrics, 5)
+	assert.Equal(t, int64(5), *metrics["hits"].Delta)
+	// relative gauges are added to the stored value by the repository
+	assert.True(t, metrics["queue"].Relative)
+	queue := metrics["queue"]
+	_, err = repo.Collect(&queue)
+	require.NoError(t, err)
+	stored, ok := repo.Get(&storage.Metrics{ID: "queue", MType: storage.GaugeMetric})
+	require.True(t, ok)
+	assert.Equal(t, 11.0, *stored.Value)
+	assert.False(t, metrics["load"].Relative)
+	assert.Equal(t, 1.5, *metrics["load"].Value)
+	assert.Equal(t, uint64(2), metrics["db_query"].Histogram.Count)
+	assert.InDelta(t, 0.32, metrics["db_query"].Histogram.Sum, 1e-9)
+	assert.Equal(t, []string{"a", "b"}, metrics["visitors"].Members)
+
+	assert.Empty(t, agg.Flush())
+}
+
+func TestAggregatorBounds(t *testing.T) {
+	agg := newAggregator(2)
+	for i := 0; i < 2*maxSetMembers; i++ {
+		assert.True(t, agg.Add(Sample{Name: "visitors", Type: setType, Raw: fmt.Sprintf("user%d", i)}))
+	}
+	assert.True(t, agg.Add(Sample{Name: "hits", Type: counterType, Value: 1, Rate: 1}))
+	assert.False(t, agg.Add(Sample{Name: "misses", Type: counterType, Value: 1, Rate: 1}))
+	assert.True(t, agg.Add(Sample{Name: "hits", Type: counterType, Value: 1, Rate: 1}))
+
+	metrics := agg.Flush()
+	require.Len(t, metrics, 2)
+	for _, m := range metrics {
+		if m.MType == storage.SetMetric {
+			// too many members are counted by registers only
+			assert.Empty(t, m.Members)
+			require.NotNil(t, m.Set)
+			assert.InEpsilon(t, 2*maxSetMembers, m.Set.Cardinality(), 0.05)
+		}
+	}
+	// the limit applies to every interval
+	assert.True(t, agg.Add(Sample{Name: "misses", Type: counterType, Value: 1, Rate: 1}))
+}
+
+func TestServer(t *testing.T) {
+	repo := storage.NewRepository()
+	srv := NewServer("127.0.0.1:0", time.Hour, repo)
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, srv.Start(ctx))
+
+	udp, err := net.Dial("udp", srv.UDPAddr().String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("hits:1|c\nload:0.5|g"))
+	require.NoError(t, err)
+
+	tcp, err := net.Dial("tcp", srv.TCPAddr().String())
+	require.NoError(t, err)
+	defer tcp.Close()
+	_, err = tcp.Write([]byte("hits:2|c\nbroken\n"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		srv.agg.mu.Lock()
+		defer srv.agg.mu.Unlock()
+		return srv.agg.counters[seriesKey{name: "hits"}] == 3 && srv.agg.gauges[seriesKey{name: "load"}] != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// samples are flushed on shutdown, open connections do not hold it
+	cancel()
+	srv.Done()
+	hits, ok := repo.Get(&storage.Metrics{ID: "hits", MType: storage.CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(3), *hits.Delta)
+	load, ok := repo.Get(&storage.Metrics{ID: "load", MType: storage.GaugeMetric})
+	require.True(t, ok)
+	assert.Equal(t, 0.5, *load.Value)
+}
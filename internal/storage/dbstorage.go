@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/rkinwork/musthave-metrics/internal/config"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"go.uber.org/zap"
+	"time"
+)
+
+const dbQueryTimeout = 5 * time.Second
+
+func init() {
+	RegisterBackend(config.PostgresStorageType, func(cnf *config.Config) (IMetricSaver, error) {
+		if cnf.DatabaseDSN == "" {
+			return nil, errors.New("database DSN is not configured")
+		}
+		st, err := OpenPostgresMetricStorage(cnf.DatabaseDSN)
+		if err != nil {
+			return nil, err
+		}
+		return &DBMetricSaver{NoopMetricSaver: NoopMetricSaver{IMetricRepository: NewRepositoryWithStorage(st)}, storage: st}, nil
+	})
+}
+
+// migrations are applied in order on start, the index of a migration is its schema version
+var migrations = [][]string{
+	{`CREATE TABLE IF NOT EXISTS metrics (
+		id    VARCHAR(128) NOT NULL,
+		mtype VARCHAR(16)  NOT NULL,
+		delta BIGINT,
+		value DOUBLE PRECISION,
+		PRIMARY KEY (id, mtype)
+	)`},
+	{`ALTER TABLE metrics ADD COLUMN updated_at BIGINT`},
+	// labels become a part of the key, so the table is rebuilt
+	{
+		`CREATE TABLE metrics_labeled (
+			id         VARCHAR(128) NOT NULL,
+			mtype      VARCHAR(16)  NOT NULL,
+			labels     TEXT         NOT NULL DEFAULT '',
+			delta      BIGINT,
+			value      DOUBLE PRECISION,
+			updated_at BIGINT,
+			PRIMARY KEY (id, mtype, labels)
+		)`,
+		`INSERT INTO metrics_labeled (id, mtype, delta, value, updated_at)
+			SELECT id, mtype, delta, value, updated_at FROM metrics`,
+		`DROP TABLE metrics`,
+		`ALTER TABLE metrics_labeled RENAME TO metrics`,
+	},
+	// payload keeps values of metric types which do not fit into delta and value as JSON
+	{`ALTER TABLE metrics ADD COLUMN payload TEXT`},
+}
+
+const (
+	selectMetricQuery = `SELECT id, mtype, labels, delta, value, updated_at, payload FROM metrics
+		WHERE id = $1 AND mtype = $2 AND labels = $3`
+	// selectMetricForUpdateQuery keeps the row locked until the transaction ends
+	selectMetricForUpdateQuery = selectMetricQuery + ` FOR UPDATE`
+	// lockMetricQuery serializes transactions on a metric even before its row exists
+	lockMetricQuery   = `SELECT pg_advisory_xact_lock(hashtext($1::text || '/' || $2::text || '/' || $3::text))`
+	selectAllQuery    = `SELECT id, mtype, labels, delta, value, updated_at, payload FROM metrics ORDER BY id, mtype, labels`
+	deleteMetricQuery = `DELETE FROM metrics WHERE id = $1 AND mtype = $2 AND labels = $3`
+	// deleteNotUpdatedQuery removes a metric unless it was updated after $4
+	deleteNotUpdatedQuery = `DELETE FROM metrics WHERE id = $1 AND mtype = $2 AND labels = $3
+		AND (updated_at IS NULL OR updated_at <= $4)`
+	upsertMetricQuery = `INSERT INTO metrics (id, mtype, labels, delta, value, updated_at, payload) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id, mtype, labels) DO UPDATE
+		SET delta = excluded.delta, value = excluded.value, updated_at = excluded.updated_at, payload = excluded.payload`
+	incrementCounterQuery = `INSERT INTO metrics (id, mtype, labels, delta, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id, mtype, labels) DO UPDATE
+		SET delta = metrics.delta + excluded.delta, updated_at = excluded.updated_at
+		RETURNING delta, payload`
+)
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// DBMetricStorage keeps metrics in an SQL database.
+// With rowLocks a transaction locks every metric it reads, so merges of concurrent updates are not lost
+type DBMetricStorage struct {
+	db       *sql.DB
+	rowLocks bool
+}
+
+func (d *DBMetricStorage) Get(m *Metrics) (Metrics, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbQueryTimeout)
+	defer cancel()
+	return dbGet(ctx, d.db, selectMetricQuery, m)
+}
+
+func (d *DBMetricStorage) Set(m Metrics) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbQueryTimeout)
+	defer cancel()
+	return dbSet(ctx, d.db, m)
+}
+
+func (d *DBMetricStorage) Delete(m *Metrics) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbQueryTimeout)
+	defer cancel()
+	if m.UpdatedAt == nil {
+		_, err := d.db.ExecContext(ctx, deleteMetricQuery, m.ID, m.MType, LabelsKey(m.Labels))
+		return err
+	}
+	res, err := d.db.ExecContext(ctx, deleteNotUpdatedQuery, m.ID, m.MType, LabelsKey(m.Labels), unixNano(m.UpdatedAt))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, ok := dbGet(ctx, d.db, selectMetricQuery, m); ok {
+		return ErrMetricUpdated
+	}
+	return nil
+}
+
+func (d *DBMetricStorage) IterMetrics() []Metrics {
+	ctx, cancel := context.WithTimeout(context.Background(), dbQueryTimeout)
+	defer cancel()
+	rows, err := d.db.QueryContext(ctx, selectAllQuery)
+	if err != nil {
+		logger.Log.Error("problems with reading metrics", zap.Error(err))
+		return nil
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logger.Log.Error("problems with closing rows", zap.Error(err))
+		}
+	}()
+	var res []Metrics
+	for rows.Next() {
+		metric, err := scanMetric(rows)
+		if err != nil {
+			logger.Log.Error("problems with scanning metric", zap.Error(err))
+			return nil
+		}
+		res = append(res, metric)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Log.Error("problems with reading metrics", zap.Error(err))
+		return nil
+	}
+	return res
+}
+
+func (d *DBMetricStorage) Tx(fn func(tx IMetricStorageTx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbQueryTimeout)
+	defer cancel()
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(&dbTx{ctx: ctx, tx: tx, rowLocks: d.rowLocks}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			logger.Log.Error("problems with rollback", zap.Error(rbErr))
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close releases the database connections
+func (d *DBMetricStorage) Close() error {
+	return d.db.Close()
+}
+
+// DBMetricSaver is durable by itself, so it only needs to release the connections
+type DBMetricSaver struct {
+	NoopMetricSaver
+	storage *DBMetricStorage
+}
+
+// LogsUpdates is true as every update is written to the database
+func (ds *DBMetricSaver) LogsUpdates() bool {
+	return true
+}
+
+func (ds *DBMetricSaver) Close() error {
+	return ds.storage.Close()
+}
+
+type dbTx struct {
+	ctx      context.Context
+	tx       *sql.Tx
+	rowLocks bool
+}
+
+// Get locks the metric with rowLocks, so that it can't change until the transaction ends
+func (t *dbTx) Get(m *Metrics) (Metrics, bool) {
+	if !t.rowLocks {
+		return dbGet(t.ctx, t.tx, selectMetricQuery, m)
+	}
+	if _, err := t.tx.ExecContext(t.ctx, lockMetricQuery, m.ID, m.MType, LabelsKey(m.Labels)); err != nil {
+		// the transaction is aborted, so its writes fail as well
+		logger.Log.Error("problems with locking metric", zap.Error(err))
+		return Metrics{}, false
+	}
+	return dbGet(t.ctx, t.tx, selectMetricForUpdateQuery, m)
+}
+
+func (t *dbTx) Set(m Metrics) error {
+	return dbSet(t.ctx, t.tx, m)
+}
+
+func (t *dbTx) Increment(m Metrics) (Metrics, error) {
+	var delta int64
+	var payload sql.NullString
+	if err := t.tx.QueryRowContext(t.ctx, incrementCounterQuery, m.ID, m.MType, LabelsKey(m.Labels), *m.Delta, unixNano(m.UpdatedAt)).Scan(&delta, &payload); err != nil {
+		return m, err
+	}
+	m.Delta = &delta
+	return m, decodePayload(payload, &m)
+}
+
+func dbGet(ctx context.Context, q queryer, query string, m *Metrics) (Metrics, bool) {
+	res, err := scanMetric(q.QueryRowContext(ctx, query, m.ID, m.MType, LabelsKey(m.Labels)))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.Log.Error("problems with reading metric", zap.Error(err))
+		}
+		return Metrics{}, false
+	}
+	return res, true
+}
+
+func dbSet(ctx context.Context, q queryer, m Metrics) error {
+	payload, err := encodePayload(m)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, upsertMetricQuery, m.ID, m.MType, LabelsKey(m.Labels), m.Delta, m.Value, unixNano(m.UpdatedAt), payload)
+	return err
+}
+
+// metricPayload is the part of a metric kept in the payload column
+type metricPayload struct {
+	Histogram *Histogram   `json:"histogram,omitempty"`
+	Summary   *Sketch      `json:"summary,omitempty"`
+	Set       *HyperLogLog `json:"set,omitempty"`
+	ResetAt   *time.Time   `json:"reset_at,omitempty"`
+}
+
+func encodePayload(m Metrics) (sql.NullString, error) {
+	p := metricPayload{Histogram: m.Histogram, Summary: m.Summary, Set: m.Set, ResetAt: m.ResetAt}
+	if p == (metricPayload{}) {
+		return sql.NullString{}, nil
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("problems with encoding %s: %w", m.ID, err)
+	}
+	return sql.NullString{String: string(payload), Valid: true}, nil
+}
+
+func decodePayload(payload sql.NullString, m *Metrics) error {
+	if !payload.Valid {
+		return nil
+	}
+	var p metricPayload
+	if err := json.Unmarshal([]byte(payload.String), &p); err != nil {
+		return fmt.Errorf("not valid payload of %s: %w", m.ID, err)
+	}
+	m.Histogram = p.Histogram
+	m.Summary = p.Summary
+	m.Set = p.Set
+	m.ResetAt = p.ResetAt
+	return nil
+}
+
+// unixNano keeps update time as a number to stay portable between SQL engines
+func unixNano(ts *time.Time) sql.NullInt64 {
+	if ts == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: ts.UnixNano(), Valid: true}
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMetric(row scanner) (Metrics, error) {
+	var res Metrics
+	var delta sql.NullInt64
+	var value sql.NullFloat64
+	var updatedAt sql.NullInt64
+	var labels string
+	var payload sql.NullString
+	if err := row.Scan(&res.ID, &res.MType, &labels, &delta, &value, &updatedAt, &payload); err != nil {
+		return Metrics{}, err
+	}
+	if labels != "" {
+		if err := json.Unmarshal([]byte(labels), &res.Labels); err != nil {
+			return Metrics{}, fmt.Errorf("not valid labels of %s: %w", res.ID, err)
+		}
+	}
+	if delta.Valid {
+		res.Delta = &delta.Int64
+	}
+	if value.Valid {
+		res.Value = &value.Float64
+	}
+	if updatedAt.Valid {
+		ts := time.Unix(0, updatedAt.Int64)
+		res.UpdatedAt = &ts
+	}
+	if err := decodePayload(payload, &res); err != nil {
+		return Metrics{}, err
+	}
+	return res, nil
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+	var current sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	next := 0
+	if current.Valid {
+		next = int(current.Int64) + 1
+	}
+	for version := next; version < len(migrations); version++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, statement := range migrations[version] {
+			if _, err = tx.ExecContext(ctx, statement); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewDBMetricStorage migrates the schema and returns storage on top of db
+func NewDBMetricStorage(db *sql.DB) (*DBMetricStorage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbQueryTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("database is not available: %w", err)
+	}
+	if err := migrate(ctx, db); err != nil {
+		return nil, err
+	}
+	return &DBMetricStorage{db: db}, nil
+}
+
+// OpenPostgresMetricStorage connects to PostgreSQL by dsn and prepares the schema
+func OpenPostgresMetricStorage(dsn string) (*DBMetricStorage, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	st, err := NewDBMetricStorage(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	st.rowLocks = true
+	return st, nil
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+	"testing"
+)
+
+// newTestDBStorage uses embedded SQLite as a stand-in for PostgreSQL
+func newTestDBStorage(t *testing.T) *DBMetricStorage {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	st, err := NewDBMetricStorage(db)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, st.Close())
+	})
+	return st
+}
+
+func TestDBStorageCollect(t *testing.T) {
+	st := newTestDBStorage(t)
+	repo := NewRepositoryWithStorage(st)
+
+	_, err := repo.Collect(NewCounterMetrics("clicks", 3))
+	require.NoError(t, err)
+	res, err := repo.Collect(NewCounterMetrics("clicks", 4))
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), *res.Delta)
+
+	_, err = repo.Collect(NewGaugeMetrics("load", 1.5))
+	require.NoError(t, err)
+	_, err = repo.Collect(NewGaugeMetrics("load", 2.5))
+	require.NoError(t, err)
+
+	metric, ok := repo.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(7), *metric.Delta)
+	assert.Nil(t, metric.Value)
+	metric, ok = repo.Get(&Metrics{ID: "load", MType: GaugeMetric})
+	require.True(t, ok)
+	assert.Equal(t, 2.5, *metric.Value)
+	_, ok = repo.Get(&Metrics{ID: "absent", MType: GaugeMetric})
+	assert.False(t, ok)
+
+	assert.Len(t, repo.GetAllMetrics(), 2)
+	require.NoError(t, repo.Delete(&Metrics{ID: "load", MType: GaugeMetric}))
+	assert.Len(t, repo.GetAllMetrics(), 1)
+}
+
+func TestDBStorageCollectBatchRollback(t *testing.T) {
+	st := newTestDBStorage(t)
+	repo := NewRepositoryWithStorage(st)
+	_, err := repo.Collect(NewCounterMetrics("clicks", 10))
+	require.NoError(t, err)
+
+	errStop := assert.AnError
+	err = st.Tx(func(tx IMetricStorageTx) error {
+		if _, err := tx.Increment(*NewCounterMetrics("clicks", 5)); err != nil {
+			return err
+		}
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+	metric, ok := repo.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(10), *metric.Delta)
+
+	res, err := repo.CollectBatch([]Metrics{
+		*NewCounterMetrics("clicks", 5),
+		*NewCounterMetrics("clicks", 5),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), *res[1].Delta)
+}
+
+func TestDBStorageMigrationsAreIdempotent(t *testing.T) {
+	st := newTestDBStorage(t)
+	_, err := NewDBMetricStorage(st.db)
+	require.NoError(t, err)
+}
+
+func TestDBStorageLabels(t *testing.T) {
+	repo := NewRepositoryWithStorage(newTestDBStorage(t))
+	web := NewCounterMetrics("requests", 1)
+	web.Labels = map[string]string{"host": "web01"}
+	for _, m := range []*Metrics{web, NewCounterMetrics("requests", 5)} {
+		_, err := repo.Collect(m)
+		require.NoError(t, err)
+	}
+	again := NewCounterMetrics("requests", 2)
+	again.Labels = map[string]string{"host": "web01"}
+	res, err := repo.Collect(again)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *res.Delta)
+
+	metric, ok := repo.Get(&Metrics{ID: "requests", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(5), *metric.Delta)
+	assert.Empty(t, metric.Labels)
+	all := repo.GetAllMetrics()
+	require.Len(t, all, 2)
+	assert.Equal(t, map[string]string{"host": "web01"}, all[1].Labels)
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseExposition reads metrics in the Prometheus text format.
+// Counters become counters holding their total, their _total suffix is dropped from the ID.
+// Gauges and untyped samples become gauges, histograms and summaries are not supported.
+// Timestamps are accepted but ignored
+func ParseExposition(reader io.Reader) ([]Metrics, error) {
+	types := make(map[string]string)
+	seen := make(map[MetricHash]bool)
+	var res []Metrics
+	scanner := bufio.NewScanner(reader)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		m, err := parseSample(line, types)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if seen[m.GetHash()] {
+			return nil, fmt.Errorf("line %d: duplicate series %s", lineNo, m.ID)
+		}
+		seen[m.GetHash()] = true
+		res = append(res, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no samples")
+	}
+	return res, nil
+}
+
+func parseSample(line string, types map[string]string) (Metrics, error) {
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd <= 0 {
+		return Metrics{}, errors.New("sample should have a name and a value")
+	}
+	name, rest := line[:nameEnd], line[nameEnd:]
+	var labels map[string]string
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		if labels, rest, err = parseLabelSet(rest[1:]); err != nil {
+			return Metrics{}, err
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Metrics{}, errors.New("sample should have a value and an optional timestamp")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return Metrics{}, fmt.Errorf("not valid value %q", fields[0])
+	}
+	if len(fields) == 2 {
+		if _, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return Metrics{}, fmt.Errorf("not valid timestamp %q", fields[1])
+		}
+	}
+
+	family, mtype := sampleFamily(name, types)
+	switch mtype {
+	case "counter":
+		if value < 0 || value != math.Trunc(value) || value >= math.MaxInt64 {
+			return Metrics{}, fmt.Errorf("counter %s should be a non-negative integer", name)
+		}
+		delta := int64(value)
+		return Metrics{ID: family, MType: CounterMetric, Delta: &delta, Labels: labels}, nil
+	case "gauge", "untyped", "":
+		return Metrics{ID: family, MType: GaugeMetric, Value: &value, Labels: labels}, nil
+	}
+	return Metrics{}, fmt.Errorf("%s metric %s is not supported", mtype, name)
+}
+
+// sampleSuffixes are added to the family name by samples of counters, histograms and summaries
+var sampleSuffixes = []string{"_total", "_created", "_bucket", "_sum", "_count"}
+
+// sampleFamily finds the family of a sample and its declared type, it is empty for untyped samples
+func sampleFamily(name string, types map[string]string) (string, string) {
+	if mtype, ok := types[name]; ok {
+		if mtype == "counter" {
+			return strings.TrimSuffix(name, "_total"), mtype
+		}
+		return name, mtype
+	}
+	for _, suffix := range sampleSuffixes {
+		family := strings.TrimSuffix(name, suffix)
+		if mtype, ok := types[family]; ok && family != name {
+			return family, mtype
+		}
+	}
+	return name, ""
+}
+
+// parseLabelSet reads labels after the opening brace and returns the rest of the line after the closing one.
+// Labels with empty values are dropped as Prometheus treats them as absent
+func parseLabelSet(s string) (map[string]string, string, error) {
+	labels := make(map[string]string)
+	seen := make(map[string]bool)
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if strings.HasPrefix(s, "}") {
+			if len(labels) == 0 {
+				labels = nil
+			}
+			return labels, s[1:], nil
+		}
+		if s == "" {
+			return nil, "", errors.New("labels are not closed")
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, "", errors.New("label should have a value")
+		}
+		name := strings.TrimSpace(s[:eq])
+		if seen[name] {
+			return nil, "", fmt.Errorf("duplicate label %q", name)
+		}
+		seen[name] = true
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return nil, "", fmt.Errorf("value of label %q should be quoted", name)
+		}
+		var value strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				value.WriteByte(s[i])
+				continue
+			}
+			i++
+			if i == len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case '\\', '"':
+				value.WriteByte(s[i])
+			default:
+				return nil, "", fmt.Errorf("not valid escape in label %q", name)
+			}
+		}
+		if i >= len(s) {
+			return nil, "", fmt.Errorf("value of label %q is not terminated", name)
+		}
+		if value.Len() > 0 {
+			labels[name] = value.String()
+		}
+		s = strings.TrimLeft(s[i+1:], " \t")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, "", errors.New("labels should be separated by commas")
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestParseExposition(t *testing.T) {
+	metrics, err := ParseExposition(strings.NewReader(`# HELP backup_files_total Files copied
+# TYPE backup_files_total counter
+backup_files_total{disk="sda"} 120 1700000000000
+backup_files_total{disk="sdb",empty=""} 0
+# TYPE backup_duration_seconds gauge
+backup_duration_seconds 12.5
+
+last_success{path="/var/\"data\"\n"} +Inf
+`))
+	require.NoError(t, err)
+	require.Len(t, metrics, 4)
+	assert.Equal(t, "backup_files", metrics[0].ID)
+	assert.Equal(t, CounterMetric, metrics[0].MType)
+	assert.Equal(t, int64(120), *metrics[0].Delta)
+	assert.Equal(t, map[string]string{"disk": "sda"}, metrics[0].Labels)
+	assert.Equal(t, map[string]string{"disk": "sdb"}, metrics[1].Labels)
+	assert.NoError(t, ValidateTotal(&metrics[1]))
+	assert.Error(t, ValidateMetric(&metrics[1]))
+	assert.Equal(t, GaugeMetric, metrics[2].MType)
+	assert.Equal(t, 12.5, *metrics[2].Value)
+	assert.Equal(t, "last_success", metrics[3].ID)
+	assert.Equal(t, map[string]string{"path": "/var/\"data\"\n"}, metrics[3].Labels)
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "no samples", input: "# TYPE up gauge\n"},
+		{name: "no value", input: "up\n"},
+		{name: "not valid value", input: "up one\n"},
+		{name: "not valid timestamp", input: "up 1 now\n"},
+		{name: "fractional counter", input: "# TYPE jobs counter\njobs_total 1.5\n"},
+		{name: "negative counter", input: "# TYPE jobs counter\njobs_total -1\n"},
+		{name: "histogram", input: "# TYPE latency histogram\nlatency_bucket{le=\"1\"} 1\n"},
+		{name: "unquoted label", input: "up{job=web} 1\n"},
+		{name: "not closed labels", input: "up{job=\"web\" 1\n"},
+		{name: "duplicate label", input: "up{job=\"a\",job=\"b\"} 1\n"},
+		{name: "duplicate series", input: "up{job=\"a\"} 1\nup{job=\"a\"} 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseExposition(strings.NewReader(tt.input))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Units with special display formatting, other units are printed after the value as is
+const (
+	UnitBytes       = "bytes"
+	UnitSeconds     = "seconds"
+	UnitNanoseconds = "nanoseconds"
+	UnitRatio       = "ratio"
+)
+
+var binaryPrefixes = []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+// FormatValue renders value for people, like 1.5 MiB for 1572864 bytes
+func FormatValue(value float64, unit string) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Sprintf("%g", value)
+	}
+	switch unit {
+	case "":
+		return fmt.Sprintf("%g", value)
+	case UnitBytes:
+		return formatBytes(value)
+	case UnitSeconds:
+		return formatDuration(value * float64(time.Second))
+	case UnitNanoseconds:
+		return formatDuration(value)
+	case UnitRatio:
+		return fmt.Sprintf("%.2f%%", value*100)
+	}
+	return fmt.Sprintf("%g %s", value, unit)
+}
+
+func formatBytes(value float64) string {
+	if math.Abs(value) < 1024 {
+		return fmt.Sprintf("%g B", value)
+	}
+	prefix := -1
+	for math.Abs(value) >= 1024 && prefix < len(binaryPrefixes)-1 {
+		value /= 1024
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %s", value, binaryPrefixes[prefix])
+}
+
+func formatDuration(nanoseconds float64) string {
+	if math.Abs(nanoseconds) >= math.MaxInt64 {
+		return fmt.Sprintf("%gs", nanoseconds/float64(time.Second))
+	}
+	return time.Duration(nanoseconds).String()
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value float64
+		unit  string
+		want  string
+	}{
+		{value: 1.5, unit: "", want: "1.5"},
+		{value: 512, unit: UnitBytes, want: "512 B"},
+		{value: 1572864, unit: UnitBytes, want: "1.5 MiB"},
+		{value: 3 << 30, unit: UnitBytes, want: "3.0 GiB"},
+		{value: 1.5, unit: UnitSeconds, want: "1.5s"},
+		{value: 2500000, unit: UnitNanoseconds, want: "2.5ms"},
+		{value: 0.125, unit: UnitRatio, want: "12.50%"},
+		{value: 3, unit: "requests", want: "3 requests"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, FormatValue(tt.value, tt.unit))
+	}
+
+	delta := int64(2048)
+	metric := Metrics{ID: "Received", MType: CounterMetric, Delta: &delta, Labels: map[string]string{"host": "web01"}}
+	assert.Equal(t, `Received{host="web01"} counter 2048`, metric.String())
+	assert.Equal(t, `Received{host="web01"} counter 2.0 KiB`, metric.Display(UnitBytes))
+}
@@ -3,18 +3,33 @@ package storage
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 type MetricsRequest struct {
 	*Metrics
+	// Quantiles asks /value/ for estimates of a distribution metric, DefaultQuantiles are used if empty
+	Quantiles []float64 `json:"quantiles,omitempty"`
 }
 
 type MetricsResponse struct {
 	*Metrics
 	*ErrorResponse
+	// Quantiles are estimates of a distribution metric keyed by quantile
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+	// Cardinality is the estimated number of distinct members of a set metric
+	Cardinality *uint64 `json:"cardinality,omitempty"`
+	// Unit and Description come from the declaration of the metric
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Display is the value formatted for people according to Unit
+	Display string `json:"display,omitempty"`
 }
 
 type ErrorResponse struct {
@@ -23,27 +38,142 @@ type ErrorResponse struct {
 
 var validNamePattern = regexp.MustCompile(`^[a-zA-Z]\w{0,127}$`)
 
+// SanitizeName replaces characters not allowed in metric and label names, like dots of api.requests, by underscores
+func SanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+var validLabelPattern = regexp.MustCompile(`^[a-zA-Z_]\w{0,63}$`)
+
+const (
+	maxLabels          = 16
+	maxLabelValueBytes = 256
+	// reservedLabelPrefix starts names of labels internal to Prometheus
+	reservedLabelPrefix = "__"
+)
+
+// formatLabels are added to samples of a type by exposition formats, so series of the type may not carry them
+var formatLabels = map[string]string{
+	HistogramMetric: "le",
+	SummaryMetric:   "quantile",
+}
+
 func ValidateMetric(m *Metrics) error {
+	return validateMetric(m, 1)
+}
+
+// ValidateTotal checks a metric which carries an absolute value instead of an increment,
+// so a counter may be zero
+func ValidateTotal(m *Metrics) error {
+	return validateMetric(m, 0)
+}
+
+func validateMetric(m *Metrics, minDelta int64) error {
 	if !validNamePattern.MatchString(m.ID) {
 		return errors.New("not valid metric Name")
 	}
+	if err := ValidateLabels(m.Labels); err != nil {
+		return err
+	}
+	if name, ok := formatLabels[m.MType]; ok {
+		if _, taken := m.Labels[name]; taken {
+			return fmt.Errorf("label %q is reserved for %s metrics", name, m.MType)
+		}
+	}
 	if m.MType == CounterMetric && m.Delta == nil {
 		return errors.New("delta value is required for counter metric")
 	}
-	if m.MType == CounterMetric && *m.Delta < 1 {
+	if m.MType == CounterMetric && *m.Delta < minDelta {
+		if minDelta == 0 {
+			return errors.New("counter value should not be negative")
+		}
 		return errors.New("delta value should be positive")
 	}
+	if m.MType == UpDownCounterMetric && m.Delta == nil {
+		return errors.New("delta value is required for updowncounter metric")
+	}
 	if m.MType == GaugeMetric && m.Value == nil {
 		return errors.New("value is required for gauge metric")
 	}
+	switch m.MType {
+	case HistogramMetric:
+		if m.Histogram != nil {
+			return m.Histogram.Validate()
+		}
+		return validateObservation(m)
+	case SummaryMetric:
+		if m.Summary != nil {
+			return m.Summary.Validate()
+		}
+		return validateObservation(m)
+	case SetMetric:
+		if m.Set == nil && len(m.Members) == 0 {
+			return errors.New("members or registers are required for set metric")
+		}
+		if m.Set != nil {
+			if err := m.Set.Validate(); err != nil {
+				return err
+			}
+		}
+		return validateMembers(m.Members)
+	}
 	return nil
 }
 
+// validateObservation checks a single observation sent to a distribution metric
+func validateObservation(m *Metrics) error {
+	if m.Value == nil {
+		return fmt.Errorf("%s or observed value is required for %s metric", m.MType, m.MType)
+	}
+	if math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+		return errors.New("observed value should be finite")
+	}
+	return nil
+}
+
+// ValidateLabels checks names and values of labels
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("too many labels, at most %d are allowed", maxLabels)
+	}
+	for name, value := range labels {
+		if !validLabelPattern.MatchString(name) {
+			return fmt.Errorf("not valid label name %q", name)
+		}
+		if strings.HasPrefix(name, reservedLabelPrefix) {
+			return fmt.Errorf("label name %q is reserved", name)
+		}
+		if value == "" || len(value) > maxLabelValueBytes {
+			return fmt.Errorf("label %q value should be from 1 to %d bytes", name, maxLabelValueBytes)
+		}
+	}
+	return nil
+}
+
+// ParseLabels takes labels from query parameters, only the first value of a parameter is used
+func ParseLabels(query url.Values) map[string]string {
+	if len(query) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(query))
+	for name, values := range query {
+		if len(values) > 0 {
+			labels[name] = values[0]
+		}
+	}
+	return labels
+}
+
 func ParseMetric(valType, name, val string) (*Metrics, error) {
 	res := &Metrics{}
 	res.ID = name
 	switch valType {
-	case GaugeMetric, CounterMetric:
+	case GaugeMetric, CounterMetric, UpDownCounterMetric, HistogramMetric, SummaryMetric, SetMetric:
 		res.MType = valType
 		if val == "" {
 			return res, nil
@@ -61,10 +191,12 @@ func ParseMetric(valType, name, val string) (*Metrics, error) {
 		delta = &s
 	}
 	switch valType {
-	case GaugeMetric:
+	case GaugeMetric, HistogramMetric, SummaryMetric:
 		res.Value = value
-	case CounterMetric:
+	case CounterMetric, UpDownCounterMetric:
 		res.Delta = delta
+	case SetMetric:
+		res.Members = []string{val}
 	}
 	return res, nil
 
@@ -78,3 +210,15 @@ func ParseJSONRequest(reader io.Reader) (*MetricsRequest, error) {
 	}
 	return &m, nil
 }
+
+// ParseJSONBatchRequest decodes a JSON array of metrics sent to the batch endpoint
+func ParseJSONBatchRequest(reader io.Reader) ([]Metrics, error) {
+	var m []Metrics
+	if err := json.NewDecoder(reader).Decode(&m); err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	return m, nil
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultHistogramBuckets are used when the first update of a histogram is a single observation
+var DefaultHistogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultQuantiles are reported for distribution metrics when no quantile is asked
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// ErrIncompatibleMerge is returned when an update can not be merged into the stored metric
+var ErrIncompatibleMerge = errors.New("update is not compatible with the stored metric")
+
+var ErrHistogramBuckets = fmt.Errorf("histogram buckets differ from the stored ones: %w", ErrIncompatibleMerge)
+
+// IDistribution is the value of a metric which tracks a distribution of observations
+type IDistribution interface {
+	// Quantile estimates the q-quantile, it is NaN if there are no observations or q is out of [0, 1]
+	Quantile(q float64) float64
+	// Stats returns the number and the sum of observations
+	Stats() (count uint64, sum float64)
+}
+
+// Histogram counts observations in buckets.
+// Buckets are sorted upper bounds, Counts has one more element for observations above the last bound
+type Histogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Sum     float64   `json:"sum"`
+	Count   uint64    `json:"count"`
+}
+
+// NewHistogram returns an empty histogram with the given bucket bounds
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: append([]float64(nil), buckets...),
+		Counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds value to the histogram
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.Buckets, value)
+	h.Counts[i]++
+	h.Sum += value
+	h.Count++
+}
+
+// Validate checks that buckets are sorted and counts are consistent
+func (h *Histogram) Validate() error {
+	if len(h.Buckets) == 0 {
+		return errors.New("histogram needs at least one bucket")
+	}
+	for i, bound := range h.Buckets {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return errors.New("histogram bucket bounds should be finite")
+		}
+		if i > 0 && bound <= h.Buckets[i-1] {
+			return errors.New("histogram bucket bounds should be strictly increasing")
+		}
+	}
+	if len(h.Counts) != len(h.Buckets)+1 {
+		return fmt.Errorf("histogram should have %d counts for %d buckets", len(h.Buckets)+1, len(h.Buckets))
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return errors.New("histogram count should equal the sum of bucket counts")
+	}
+	return nil
+}
+
+// Merge returns a new histogram with observations of both h and other
+func (h *Histogram) Merge(other *Histogram) (*Histogram, error) {
+	if len(h.Buckets) != len(other.Buckets) {
+		return nil, ErrHistogramBuckets
+	}
+	for i := range h.Buckets {
+		if h.Buckets[i] != other.Buckets[i] {
+			return nil, ErrHistogramBuckets
+		}
+	}
+	res := NewHistogram(h.Buckets)
+	for i := range res.Counts {
+		res.Counts[i] = h.Counts[i] + other.Counts[i]
+	}
+	res.Sum = h.Sum + other.Sum
+	res.Count = h.Count + other.Count
+	return res, nil
+}
+
+// Quantile estimates the q-quantile by linear interpolation inside the bucket it falls into.
+// Observations above the last bound are reported as the last bound
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	rank := q * float64(h.Count)
+	var cumulative uint64
+	for i, c := range h.Counts {
+		if c == 0 || float64(cumulative+c) < rank {
+			cumulative += c
+			continue
+		}
+		if i == len(h.Buckets) {
+			return h.Buckets[len(h.Buckets)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.Buckets[i-1]
+		} else if h.Buckets[0] <= 0 {
+			return h.Buckets[0]
+		}
+		upper := h.Buckets[i]
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(c)
+	}
+	return h.Buckets[len(h.Buckets)-1]
+}
+
+// Stats returns the number and the sum of observations
+func (h *Histogram) Stats() (uint64, float64) {
+	return h.Count, h.Sum
+}
+
+// mergeHistogram folds the update of a histogram metric into its stored state
+func mergeHistogram(tx IMetricStorageTx, metric *Metrics) error {
+	old, exists := tx.Get(metric)
+	update := metric.Histogram
+	if update == nil {
+		buckets := DefaultHistogramBuckets
+		if exists && old.Histogram != nil {
+			buckets = old.Histogram.Buckets
+		}
+		update = NewHistogram(buckets)
+		update.Observe(*metric.Value)
+	}
+	base := NewHistogram(update.Buckets)
+	if exists && old.Histogram != nil {
+		base = old.Histogram
+	}
+	merged, err := base.Merge(update)
+	if err != nil {
+		return err
+	}
+	metric.Histogram = merged
+	metric.Value = nil
+	return tx.Set(*metric)
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistogramQuantile(t *testing.T) {
+	h := NewHistogram([]float64{1, 2, 4})
+	assert.True(t, math.IsNaN(h.Quantile(0.5)))
+	for _, v := range []float64{0.5, 1.5, 1.5, 3, 10} {
+		h.Observe(v)
+	}
+	require.NoError(t, h.Validate())
+	assert.Equal(t, []uint64{1, 2, 1, 1}, h.Counts)
+	assert.Equal(t, 16.5, h.Sum)
+
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{q: 0.1, want: 0.5},
+		{q: 0.4, want: 1.5},
+		{q: 0.6, want: 2},
+		{q: 0.7, want: 3},
+		{q: 0.99, want: 4},
+	}
+	for _, tt := range tests {
+		assert.InDelta(t, tt.want, h.Quantile(tt.q), 1e-9, "q=%g", tt.q)
+	}
+}
+
+func TestHistogramValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Histogram
+	}{
+		{name: "no buckets", h: Histogram{Counts: []uint64{0}}},
+		{name: "unsorted", h: Histogram{Buckets: []float64{2, 1}, Counts: []uint64{0, 0, 0}}},
+		{name: "infinite", h: Histogram{Buckets: []float64{1, math.Inf(1)}, Counts: []uint64{0, 0, 0}}},
+		{name: "counts length", h: Histogram{Buckets: []float64{1}, Counts: []uint64{0}}},
+		{name: "count mismatch", h: Histogram{Buckets: []float64{1}, Counts: []uint64{1, 1}, Count: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, tt.h.Validate())
+		})
+	}
+}
+
+func TestCollectHistogram(t *testing.T) {
+	repo := NewRepository()
+	update := NewHistogram([]float64{1, 2})
+	update.Observe(0.5)
+	update.Observe(1.5)
+	res, err := repo.Collect(&Metrics{ID: "latency", MType: HistogramMetric, Histogram: update})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), res.Histogram.Count)
+
+	observed := 5.0
+	res, err = repo.Collect(&Metrics{ID: "latency", MType: HistogramMetric, Value: &observed})
+	require.NoError(t, err)
+	assert.Nil(t, res.Value)
+	assert.Equal(t, []uint64{1, 1, 1}, res.Histogram.Counts)
+	assert.Equal(t, 7.0, res.Histogram.Sum)
+	// the update is not changed by merging
+	assert.Equal(t, uint64(2), update.Count)
+
+	_, err = repo.Collect(&Metrics{ID: "latency", MType: HistogramMetric, Histogram: NewHistogram([]float64{1, 3})})
+	assert.ErrorIs(t, err, ErrHistogramBuckets)
+
+	_, err = repo.Collect(&Metrics{ID: "fresh", MType: HistogramMetric, Value: &observed})
+	require.NoError(t, err)
+	metric, ok := repo.Get(&Metrics{ID: "fresh", MType: HistogramMetric})
+	require.True(t, ok)
+	assert.Equal(t, DefaultHistogramBuckets, metric.Histogram.Buckets)
+}
+
+func TestHistogramIsPersisted(t *testing.T) {
+	observed := 0.3
+	metric := &Metrics{ID: "latency", MType: HistogramMetric, Value: &observed}
+
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	saver := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	_, err := saver.Collect(metric)
+	require.NoError(t, err)
+	require.NoError(t, saver.Save())
+	restored := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	require.NoError(t, restored.Load())
+	res, ok := restored.Get(metric)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), res.Histogram.Count)
+
+	repo := NewRepositoryWithStorage(newTestDBStorage(t))
+	for i := 0; i < 2; i++ {
+		_, err = repo.Collect(&Metrics{ID: "latency", MType: HistogramMetric, Value: &observed})
+		require.NoError(t, err)
+	}
+	res, ok = repo.Get(metric)
+	require.True(t, ok)
+	assert.Equal(t, uint64(2), res.Histogram.Count)
+	assert.InDelta(t, 0.6, res.Histogram.Sum, 1e-9)
+}
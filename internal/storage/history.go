@@ -0,0 +1,357 @@
+package storage
+
+import (
+	"context"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Sample is the state of a metric at some moment.
+// Histograms and summaries are recorded like counters of their observations with the sum of them in Sum,
+// sets are recorded like gauges of their estimated number of members.
+// Rollup samples start at Timestamp and summarize their resolution period:
+// gauges get Min, Max and Avg with the last value in Value,
+// counters get Increase over the period with the last total in Delta,
+// for up-down counters Increase is the net change and may be negative
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Delta     *int64    `json:"delta,omitempty"`
+	Value     *float64  `json:"value,omitempty"`
+	Sum       *float64  `json:"sum,omitempty"`
+	Min       *float64  `json:"min,omitempty"`
+	Max       *float64  `json:"max,omitempty"`
+	Avg       *float64  `json:"avg,omitempty"`
+	Increase  *int64    `json:"increase,omitempty"`
+	Count     int       `json:"count,omitempty"`
+	// Reset marks the sample taken right after an explicit reset of a counter
+	Reset bool `json:"reset,omitempty"`
+}
+
+const (
+	// RawResolution asks for samples as they were recorded
+	RawResolution time.Duration = 0
+	// AutoResolution picks the finest resolution which still holds data for the start of the range
+	AutoResolution time.Duration = -1
+)
+
+// HistoryQuery selects samples between From and To inclusive
+type HistoryQuery struct {
+	From       time.Time
+	To         time.Time
+	Resolution time.Duration
+}
+
+// HistoryRange is the answer to HistoryQuery
+type HistoryRange struct {
+	Resolution time.Duration
+	Samples    []Sample
+}
+
+// IHistoryReader gives access to recorded samples of metrics
+type IHistoryReader interface {
+	// Range returns samples of metric oldest first.
+	// ok is false if nothing was ever recorded for the metric or the resolution is not kept
+	Range(metric *Metrics, query HistoryQuery) (res HistoryRange, ok bool)
+}
+
+// sampleRing is a circular buffer of up to depth samples ordered by time.
+// Its storage grows on demand, so rarely updated metrics do not hold a full depth of samples
+type sampleRing struct {
+	samples []Sample
+	depth   int
+	start   int
+	size    int
+}
+
+const minRingCapacity = 8
+
+func newSampleRing(depth int) *sampleRing {
+	return &sampleRing{depth: depth}
+}
+
+func (r *sampleRing) at(i int) Sample {
+	return r.samples[(r.start+i)%len(r.samples)]
+}
+
+func (r *sampleRing) push(s Sample) {
+	if r.size == len(r.samples) && len(r.samples) < r.depth {
+		r.grow()
+	}
+	if r.size < len(r.samples) {
+		r.samples[(r.start+r.size)%len(r.samples)] = s
+		r.size++
+		return
+	}
+	if len(r.samples) == 0 {
+		return
+	}
+	r.samples[r.start] = s
+	r.start = (r.start + 1) % len(r.samples)
+}
+
+// grow doubles the storage up to depth keeping samples in order
+func (r *sampleRing) grow() {
+	capacity := 2 * len(r.samples)
+	if capacity < minRingCapacity {
+		capacity = minRingCapacity
+	}
+	if capacity > r.depth {
+		capacity = r.depth
+	}
+	samples := make([]Sample, capacity)
+	for i := 0; i < r.size; i++ {
+		samples[i] = r.at(i)
+	}
+	r.samples, r.start = samples, 0
+}
+
+// dropBefore evicts samples older than ts
+func (r *sampleRing) dropBefore(ts time.Time) {
+	for r.size > 0 && r.at(0).Timestamp.Before(ts) {
+		r.samples[r.start] = Sample{}
+		r.start = (r.start + 1) % len(r.samples)
+		r.size--
+	}
+}
+
+// between returns samples with timestamps in [from, to]
+func (r *sampleRing) between(from, to time.Time) []Sample {
+	res := make([]Sample, 0, r.size)
+	for i := 0; i < r.size; i++ {
+		s := r.at(i)
+		if s.Timestamp.Before(from) || s.Timestamp.After(to) {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// metricSeries holds raw samples of one metric and its rollups per tier
+type metricSeries struct {
+	raw     *sampleRing
+	rollups []*rollupSeries
+}
+
+// MetricHistory keeps the last samples of every metric bounded by depth and retention
+// and folds them into coarser rollup tiers in the background.
+// Metrics beyond MaxSeries are not recorded, zero means no limit
+type MetricHistory struct {
+	MaxSeries int
+	depth     int
+	retention time.Duration
+	tiers     []RollupTier
+	series    map[MetricHash]*metricSeries
+	mu        sync.RWMutex
+}
+
+// Record stores the state of metric at ts
+func (h *MetricHistory) Record(metric Metrics, ts time.Time) {
+	h.record(metric, ts, false)
+}
+
+// RecordReset stores the state of a counter right after its explicit reset
+func (h *MetricHistory) RecordReset(metric Metrics, ts time.Time) {
+	h.record(metric, ts, true)
+}
+
+func (h *MetricHistory) record(metric Metrics, ts time.Time, reset bool) {
+	sample := Sample{Timestamp: ts, Reset: reset}
+	if metric.Delta != nil {
+		delta := *metric.Delta
+		sample.Delta = &delta
+	}
+	if metric.Value != nil {
+		value := *metric.Value
+		sample.Value = &value
+	}
+	if distribution := metric.Distribution(); distribution != nil {
+		count, sum := distribution.Stats()
+		total := int64(count)
+		// the value of a distribution update is a single observation, not its state
+		sample.Delta, sample.Sum, sample.Value = &total, &sum, nil
+	}
+	if metric.Set != nil {
+		cardinality := float64(metric.Set.Cardinality())
+		sample.Value = &cardinality
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, ok := h.series[metric.GetHash()]
+	if !ok {
+		if h.MaxSeries > 0 && len(h.series) >= h.MaxSeries {
+			logger.Log.Debug("history is full, metric is not recorded", zap.String("id", metric.ID))
+			return
+		}
+		series = &metricSeries{raw: newSampleRing(h.depth)}
+		for _, tier := range h.tiers {
+			series.rollups = append(series.rollups, newRollupSeries(tier, metric.MType != UpDownCounterMetric))
+		}
+		h.series[metric.GetHash()] = series
+	}
+	if h.retention > 0 {
+		series.raw.dropBefore(ts.Add(-h.retention))
+	}
+	series.raw.push(sample)
+}
+
+// Forget drops all samples of metric
+func (h *MetricHistory) Forget(metric *Metrics) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.series, metric.GetHash())
+}
+
+func (h *MetricHistory) Range(metric *Metrics, query HistoryQuery) (HistoryRange, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	series, ok := h.series[metric.GetHash()]
+	if !ok {
+		return HistoryRange{}, false
+	}
+	resolution := query.Resolution
+	if resolution == AutoResolution {
+		resolution = h.pickResolution(query.From, time.Now())
+	}
+	if resolution == RawResolution {
+		from := query.From
+		if h.retention > 0 {
+			if oldest := time.Now().Add(-h.retention); from.Before(oldest) {
+				from = oldest
+			}
+		}
+		return HistoryRange{Resolution: RawResolution, Samples: series.raw.between(from, query.To)}, true
+	}
+	for _, rollup := range series.rollups {
+		if rollup.tier.Resolution == resolution {
+			return HistoryRange{Resolution: resolution, Samples: rollup.points.between(query.From, query.To)}, true
+		}
+	}
+	return HistoryRange{}, false
+}
+
+// pickResolution returns the finest resolution whose retention still covers from.
+// Without from raw samples are returned
+func (h *MetricHistory) pickResolution(from, now time.Time) time.Duration {
+	age := now.Sub(from)
+	if from.IsZero() || h.retention <= 0 || age <= h.retention || len(h.tiers) == 0 {
+		return RawResolution
+	}
+	for _, tier := range h.tiers {
+		if age <= tier.Retention {
+			return tier.Resolution
+		}
+	}
+	return h.tiers[len(h.tiers)-1].Resolution
+}
+
+// Rollup folds closed periods of every tier up to now
+func (h *MetricHistory) Rollup(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, series := range h.series {
+		source := series.raw
+		for _, rollup := range series.rollups {
+			rollup.fold(source, now)
+			source = rollup.points
+		}
+	}
+}
+
+// Start runs rollups every period of the finest tier until ctx is done
+func (h *MetricHistory) Start(ctx context.Context) {
+	if len(h.tiers) == 0 {
+		return
+	}
+	ticker := time.NewTicker(h.tiers[0].Resolution)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				h.Rollup(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// NewMetricHistory keeps up to depth raw samples per metric, not older than retention if it is positive.
+// tiers must be ordered from the finest resolution to the coarsest one
+func NewMetricHistory(depth int, retention time.Duration, tiers ...RollupTier) *MetricHistory {
+	return &MetricHistory{
+		depth:     depth,
+		retention: retention,
+		tiers:     tiers,
+		series:    make(map[MetricHash]*metricSeries),
+	}
+}
+
+// HistoryRecorder records the state of every collected metric into history
+type HistoryRecorder struct {
+	IMetricRepository
+	history *MetricHistory
+}
+
+func (hr *HistoryRecorder) Collect(metric *Metrics) (*Metrics, error) {
+	m, err := hr.IMetricRepository.Collect(metric)
+	if err == nil {
+		hr.history.Record(*m, time.Now())
+	}
+	return m, err
+}
+
+func (hr *HistoryRecorder) CollectBatch(metrics []Metrics) ([]Metrics, error) {
+	res, err := hr.IMetricRepository.CollectBatch(metrics)
+	if err != nil {
+		return res, err
+	}
+	now := time.Now()
+	for _, m := range res {
+		hr.history.Record(m, now)
+	}
+	return res, nil
+}
+
+func (hr *HistoryRecorder) Set(metric *Metrics) (*Metrics, error) {
+	m, err := hr.IMetricRepository.Set(metric)
+	if err == nil {
+		hr.history.Record(*m, time.Now())
+	}
+	return m, err
+}
+
+func (hr *HistoryRecorder) SetBatch(metrics []Metrics) ([]Metrics, error) {
+	res, err := hr.IMetricRepository.SetBatch(metrics)
+	if err != nil {
+		return res, err
+	}
+	now := time.Now()
+	for _, m := range res {
+		hr.history.Record(m, now)
+	}
+	return res, nil
+}
+
+func (hr *HistoryRecorder) Reset(metric *Metrics) (*Metrics, error) {
+	m, err := hr.IMetricRepository.Reset(metric)
+	if err == nil {
+		hr.history.RecordReset(*m, *m.ResetAt)
+	}
+	return m, err
+}
+
+func (hr *HistoryRecorder) Delete(metric *Metrics) error {
+	if err := hr.IMetricRepository.Delete(metric); err != nil {
+		return err
+	}
+	hr.history.Forget(metric)
+	return nil
+}
+
+func NewHistoryRecorder(repository IMetricRepository, history *MetricHistory) *HistoryRecorder {
+	return &HistoryRecorder{IMetricRepository: repository, history: history}
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func rawQuery(from, to time.Time) HistoryQuery {
+	return HistoryQuery{From: from, To: to, Resolution: RawResolution}
+}
+
+func TestMetricHistoryDepth(t *testing.T) {
+	history := NewMetricHistory(3, 0)
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < 5; i++ {
+		history.Record(*NewGaugeMetrics("load", float64(i)), start.Add(time.Duration(i)*time.Second))
+	}
+	res, ok := history.Range(&Metrics{ID: "load", MType: GaugeMetric}, rawQuery(time.Time{}, time.Now()))
+	require.True(t, ok)
+	require.Len(t, res.Samples, 3)
+	for i, s := range res.Samples {
+		assert.Equal(t, float64(i+2), *s.Value)
+	}
+
+	res, ok = history.Range(&Metrics{ID: "load", MType: GaugeMetric}, rawQuery(start.Add(3*time.Second), start.Add(3*time.Second)))
+	require.True(t, ok)
+	require.Len(t, res.Samples, 1)
+	assert.Equal(t, float64(3), *res.Samples[0].Value)
+
+	_, ok = history.Range(&Metrics{ID: "load", MType: CounterMetric}, rawQuery(time.Time{}, time.Now()))
+	assert.False(t, ok)
+}
+
+func TestSampleRingGrowsLazily(t *testing.T) {
+	ring := newSampleRing(20)
+	assert.Empty(t, ring.samples)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		ring.push(Sample{Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+	assert.Len(t, ring.samples, minRingCapacity)
+	ring.dropBefore(start.Add(4 * time.Second))
+	for i := 6; i < 30; i++ {
+		ring.push(Sample{Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+	assert.Len(t, ring.samples, 20)
+	samples := ring.between(time.Time{}, start.Add(time.Hour))
+	require.Len(t, samples, 20)
+	for i, s := range samples {
+		assert.Equal(t, start.Add(time.Duration(i+10)*time.Second), s.Timestamp)
+	}
+}
+
+func TestMetricHistoryMaxSeries(t *testing.T) {
+	history := NewMetricHistory(3, 0)
+	history.MaxSeries = 1
+	history.Record(*NewGaugeMetrics("load", 1), time.Now())
+	history.Record(*NewGaugeMetrics("temp", 1), time.Now())
+	history.Record(*NewGaugeMetrics("load", 2), time.Now())
+	res, ok := history.Range(&Metrics{ID: "load", MType: GaugeMetric}, rawQuery(time.Time{}, time.Now()))
+	require.True(t, ok)
+	assert.Len(t, res.Samples, 2)
+	_, ok = history.Range(&Metrics{ID: "temp", MType: GaugeMetric}, rawQuery(time.Time{}, time.Now()))
+	assert.False(t, ok)
+
+	history.Forget(&Metrics{ID: "load", MType: GaugeMetric})
+	history.Record(*NewGaugeMetrics("temp", 1), time.Now())
+	_, ok = history.Range(&Metrics{ID: "temp", MType: GaugeMetric}, rawQuery(time.Time{}, time.Now()))
+	assert.True(t, ok)
+}
+
+func TestMetricHistoryRetention(t *testing.T) {
+	history := NewMetricHistory(10, time.Minute)
+	now := time.Now()
+	history.Record(*NewGaugeMetrics("load", 1), now.Add(-2*time.Minute))
+	history.Record(*NewGaugeMetrics("load", 2), now.Add(-30*time.Second))
+	res, ok := history.Range(&Metrics{ID: "load", MType: GaugeMetric}, rawQuery(time.Time{}, now))
+	require.True(t, ok)
+	require.Len(t, res.Samples, 1)
+	assert.Equal(t, float64(2), *res.Samples[0].Value)
+}
+
+func TestMetricHistoryRollups(t *testing.T) {
+	tiers, err := ParseRollupTiers("1m:24h,1h:720h")
+	require.NoError(t, err)
+	history := NewMetricHistory(1000, 2*time.Hour, tiers...)
+	hour := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	for i := 0; i < 120; i++ {
+		ts := hour.Add(time.Duration(i) * 30 * time.Second)
+		history.Record(*NewGaugeMetrics("load", float64(i%2)), ts)
+		history.Record(*NewCounterMetrics("clicks", int64(i+1)), ts)
+	}
+	history.Rollup(hour.Add(time.Hour))
+
+	load := &Metrics{ID: "load", MType: GaugeMetric}
+	res, ok := history.Range(load, HistoryQuery{From: hour, To: hour.Add(time.Hour), Resolution: time.Minute})
+	require.True(t, ok)
+	require.Len(t, res.Samples, 60)
+	first := res.Samples[0]
+	assert.Equal(t, hour, first.Timestamp)
+	assert.Equal(t, 2, first.Count)
+	assert.Equal(t, 0.0, *first.Min)
+	assert.Equal(t, 1.0, *first.Max)
+	assert.Equal(t, 0.5, *first.Avg)
+	assert.Equal(t, 1.0, *first.Value)
+
+	res, ok = history.Range(load, HistoryQuery{From: hour, To: hour.Add(time.Hour), Resolution: time.Hour})
+	require.True(t, ok)
+	require.Len(t, res.Samples, 1)
+	assert.Equal(t, 120, res.Samples[0].Count)
+	assert.Equal(t, 0.5, *res.Samples[0].Avg)
+
+	clicks := &Metrics{ID: "clicks", MType: CounterMetric}
+	res, ok = history.Range(clicks, HistoryQuery{From: hour, To: hour.Add(time.Hour), Resolution: time.Minute})
+	require.True(t, ok)
+	require.Len(t, res.Samples, 60)
+	assert.Equal(t, int64(1), *res.Samples[0].Increase)
+	assert.Equal(t, int64(2), *res.Samples[1].Increase)
+	assert.Equal(t, int64(4), *res.Samples[1].Delta)
+	res, ok = history.Range(clicks, HistoryQuery{From: hour, To: hour.Add(time.Hour), Resolution: time.Hour})
+	require.True(t, ok)
+	require.Len(t, res.Samples, 1)
+	assert.Equal(t, int64(119), *res.Samples[0].Increase)
+
+	// folding twice must not duplicate points
+	history.Rollup(hour.Add(time.Hour))
+	res, _ = history.Range(clicks, HistoryQuery{From: hour, To: hour.Add(time.Hour), Resolution: time.Minute})
+	assert.Len(t, res.Samples, 60)
+
+	now := time.Now()
+	assert.Equal(t, RawResolution, history.pickResolution(time.Time{}, now))
+	assert.Equal(t, RawResolution, history.pickResolution(now.Add(-time.Hour), now))
+	assert.Equal(t, time.Minute, history.pickResolution(now.Add(-3*time.Hour), now))
+	assert.Equal(t, time.Hour, history.pickResolution(now.Add(-48*time.Hour), now))
+}
+
+func TestMetricHistoryRollupsUpDownCounter(t *testing.T) {
+	tiers, err := ParseRollupTiers("1m:24h")
+	require.NoError(t, err)
+	history := NewMetricHistory(1000, time.Hour, tiers...)
+	start := time.Now().Truncate(time.Minute).Add(-5 * time.Minute)
+	depth := func(delta int64) Metrics {
+		return Metrics{ID: "queue", MType: UpDownCounterMetric, Delta: &delta}
+	}
+	history.Record(depth(5), start)
+	history.Record(depth(3), start.Add(30*time.Second))
+	// without the marker a drop of an up-down counter is a plain decrease
+	history.RecordReset(depth(0), start.Add(time.Minute))
+	history.Record(depth(4), start.Add(90*time.Second))
+	history.Rollup(start.Add(2 * time.Minute))
+
+	res, ok := history.Range(&Metrics{ID: "queue", MType: UpDownCounterMetric}, HistoryQuery{From: start, To: start.Add(2 * time.Minute), Resolution: time.Minute})
+	require.True(t, ok)
+	require.Len(t, res.Samples, 2)
+	assert.Equal(t, int64(-2), *res.Samples[0].Increase)
+	assert.Equal(t, int64(4), *res.Samples[1].Increase)
+	assert.Equal(t, int64(4), *res.Samples[1].Delta)
+}
+
+func TestParseRollupTiers(t *testing.T) {
+	tiers, err := ParseRollupTiers("")
+	require.NoError(t, err)
+	assert.Empty(t, tiers)
+	_, err = ParseRollupTiers("1h:720h,1m:24h")
+	assert.Error(t, err)
+	_, err = ParseRollupTiers("1m")
+	assert.Error(t, err)
+	_, err = ParseRollupTiers("1h:1m")
+	assert.Error(t, err)
+}
+
+func TestHistoryRecorder(t *testing.T) {
+	history := NewMetricHistory(10, 0)
+	repo := NewHistoryRecorder(NewRepository(), history)
+	_, err := repo.Collect(NewCounterMetrics("clicks", 2))
+	require.NoError(t, err)
+	_, err = repo.CollectBatch([]Metrics{*NewCounterMetrics("clicks", 3)})
+	require.NoError(t, err)
+
+	res, ok := history.Range(&Metrics{ID: "clicks", MType: CounterMetric}, rawQuery(time.Time{}, time.Now()))
+	require.True(t, ok)
+	require.Len(t, res.Samples, 2)
+	assert.Equal(t, int64(2), *res.Samples[0].Delta)
+	assert.Equal(t, int64(5), *res.Samples[1].Delta)
+
+	require.NoError(t, repo.Delete(&Metrics{ID: "clicks", MType: CounterMetric}))
+	_, ok = history.Range(&Metrics{ID: "clicks", MType: CounterMetric}, rawQuery(time.Time{}, time.Now()))
+	assert.False(t, ok)
+
+	// absolute values are recorded as well
+	_, err = repo.Set(NewGaugeMetrics("load", 1))
+	require.NoError(t, err)
+	_, err = repo.SetBatch([]Metrics{*NewGaugeMetrics("load", 2)})
+	require.NoError(t, err)
+	res, ok = history.Range(&Metrics{ID: "load", MType: GaugeMetric}, rawQuery(time.Time{}, time.Now()))
+	require.True(t, ok)
+	assert.Len(t, res.Samples, 2)
+}
+
+func TestHistoryRecorderDistributionsAndSets(t *testing.T) {
+	history := NewMetricHistory(10, 0)
+	repo := NewHistoryRecorder(NewRepository(), history)
+	for _, value := range []float64{1, 3} {
+		v := value
+		_, err := repo.Collect(&Metrics{ID: "latency", MType: HistogramMetric, Value: &v})
+		require.NoError(t, err)
+		_, err = repo.Collect(&Metrics{ID: "duration", MType: SummaryMetric, Value: &v})
+		require.NoError(t, err)
+	}
+	_, err := repo.Collect(&Metrics{ID: "visitors", MType: SetMetric, Members: []string{"a", "b"}})
+	require.NoError(t, err)
+
+	for _, metric := range []Metrics{{ID: "latency", MType: HistogramMetric}, {ID: "duration", MType: SummaryMetric}} {
+		res, ok := history.Range(&metric, rawQuery(time.Time{}, time.Now()))
+		require.True(t, ok, metric.ID)
+		require.Len(t, res.Samples, 2, metric.ID)
+		last := res.Samples[1]
+		require.NotNil(t, last.Delta, metric.ID)
+		require.NotNil(t, last.Sum, metric.ID)
+		assert.Equal(t, int64(2), *last.Delta, metric.ID)
+		assert.Equal(t, 4.0, *last.Sum, metric.ID)
+		assert.Nil(t, last.Value, metric.ID)
+	}
+	res, ok := history.Range(&Metrics{ID: "visitors", MType: SetMetric}, rawQuery(time.Time{}, time.Now()))
+	require.True(t, ok)
+	require.Len(t, res.Samples, 1)
+	require.NotNil(t, res.Samples[0].Value)
+	assert.Equal(t, 2.0, *res.Samples[0].Value)
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// DefaultSetPrecision gives 2^14 registers, the standard error of estimates is about 0.8%
+	DefaultSetPrecision = 14
+	minSetPrecision     = 4
+	maxSetPrecision     = 16
+	maxSetMembers       = 1000
+	maxSetMemberBytes   = 256
+)
+
+var ErrSetPrecision = fmt.Errorf("set precision differs from the stored one: %w", ErrIncompatibleMerge)
+
+// HyperLogLog estimates the number of distinct members without keeping them.
+// Registers are encoded as base64 in JSON, agents may send them to merge their own sets
+type HyperLogLog struct {
+	Precision uint8  `json:"precision"`
+	Registers []byte `json:"registers"`
+}
+
+// NewHyperLogLog returns an empty set with 2^precision registers
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	return &HyperLogLog{Precision: precision, Registers: make([]byte, 1<<precision)}
+}
+
+// Add counts member in the set
+func (h *HyperLogLog) Add(member string) {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(member))
+	hash := mix64(hasher.Sum64())
+	index := hash >> (64 - h.Precision)
+	// the guard bit bounds the rank when the rest of the hash is zero
+	rank := byte(bits.LeadingZeros64(hash<<h.Precision|1<<(h.Precision-1)) + 1)
+	if rank > h.Registers[index] {
+		h.Registers[index] = rank
+	}
+}
+
+// mix64 spreads bits of FNV hashes which are weak in the high bits for short inputs
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Validate checks precision and registers
+func (h *HyperLogLog) Validate() error {
+	if h.Precision < minSetPrecision || h.Precision > maxSetPrecision {
+		return fmt.Errorf("set precision should be from %d to %d", minSetPrecision, maxSetPrecision)
+	}
+	if len(h.Registers) != 1<<h.Precision {
+		return fmt.Errorf("set of precision %d should have %d registers", h.Precision, 1<<h.Precision)
+	}
+	maxRank := byte(64 - h.Precision + 1)
+	for _, r := range h.Registers {
+		if r > maxRank {
+			return errors.New("set register is out of range")
+		}
+	}
+	return nil
+}
+
+// Merge returns a new set with members of both h and other
+func (h *HyperLogLog) Merge(other *HyperLogLog) (*HyperLogLog, error) {
+	if h.Precision != other.Precision {
+		return nil, ErrSetPrecision
+	}
+	res := NewHyperLogLog(h.Precision)
+	for i := range res.Registers {
+		res.Registers[i] = h.Registers[i]
+		if other.Registers[i] > res.Registers[i] {
+			res.Registers[i] = other.Registers[i]
+		}
+	}
+	return res, nil
+}
+
+// Cardinality estimates the number of distinct members
+func (h *HyperLogLog) Cardinality() uint64 {
+	m := float64(len(h.Registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha(len(h.Registers)) * m * m / sum
+	// linear counting is more accurate for small sets
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/float64(m))
+}
+
+// validateMembers checks members sent to a set metric
+func validateMembers(members []string) error {
+	if len(members) > maxSetMembers {
+		return fmt.Errorf("too many set members, at most %d are allowed", maxSetMembers)
+	}
+	for _, member := range members {
+		if member == "" || len(member) > maxSetMemberBytes {
+			return fmt.Errorf("set member should be from 1 to %d bytes", maxSetMemberBytes)
+		}
+	}
+	return nil
+}
+
+// mergeSet folds members and registers of the update of a set metric into its stored state
+func mergeSet(tx IMetricStorageTx, metric *Metrics) error {
+	old, exists := tx.Get(metric)
+	precision := uint8(DefaultSetPrecision)
+	switch {
+	case exists && old.Set != nil:
+		precision = old.Set.Precision
+	case metric.Set != nil:
+		precision = metric.Set.Precision
+	}
+	merged := NewHyperLogLog(precision)
+	for _, set := range []*HyperLogLog{old.Set, metric.Set} {
+		if set == nil {
+			continue
+		}
+		var err error
+		if merged, err = merged.Merge(set); err != nil {
+			return err
+		}
+	}
+	for _, member := range metric.Members {
+		merged.Add(member)
+	}
+	metric.Set = merged
+	metric.Members = nil
+	return tx.Set(*metric)
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestHyperLogLogCardinality(t *testing.T) {
+	tests := []struct {
+		name    string
+		members int
+	}{
+		{name: "empty", members: 0},
+		{name: "small", members: 10},
+		{name: "medium", members: 5000},
+		{name: "large", members: 200000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHyperLogLog(DefaultSetPrecision)
+			for i := 0; i < tt.members; i++ {
+				// duplicates do not change the estimate
+				h.Add(fmt.Sprintf("user-%d", i))
+				h.Add(fmt.Sprintf("user-%d", i))
+			}
+			assert.InDelta(t, float64(tt.members), float64(h.Cardinality()), float64(tt.members)*0.03)
+		})
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	left, right := NewHyperLogLog(10), NewHyperLogLog(10)
+	for i := 0; i < 1000; i++ {
+		left.Add(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		right.Add(fmt.Sprintf("10.0.%d.%d", (i+500)/256, (i+500)%256))
+	}
+	merged, err := left.Merge(right)
+	require.NoError(t, err)
+	assert.InDelta(t, 1500, float64(merged.Cardinality()), 1500*0.1)
+
+	_, err = left.Merge(NewHyperLogLog(11))
+	assert.ErrorIs(t, err, ErrIncompatibleMerge)
+
+	assert.Error(t, (&HyperLogLog{Precision: 3, Registers: make([]byte, 8)}).Validate())
+	assert.Error(t, (&HyperLogLog{Precision: 4, Registers: make([]byte, 8)}).Validate())
+	assert.Error(t, (&HyperLogLog{Precision: 4, Registers: append(make([]byte, 15), 62)}).Validate())
+	assert.NoError(t, left.Validate())
+}
+
+func TestCollectSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	saver := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	_, err := saver.Collect(&Metrics{ID: "visitors", MType: SetMetric, Members: []string{"alice", "bob"}})
+	require.NoError(t, err)
+	agentSet := NewHyperLogLog(DefaultSetPrecision)
+	agentSet.Add("bob")
+	agentSet.Add("carol")
+	res, err := saver.Collect(&Metrics{ID: "visitors", MType: SetMetric, Set: agentSet, Members: []string{"dave"}})
+	require.NoError(t, err)
+	assert.Nil(t, res.Members)
+	assert.Equal(t, uint64(4), res.Set.Cardinality())
+
+	_, err = saver.Collect(&Metrics{ID: "visitors", MType: SetMetric, Set: NewHyperLogLog(8)})
+	assert.ErrorIs(t, err, ErrSetPrecision)
+
+	require.NoError(t, saver.Save())
+	restored := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	require.NoError(t, restored.Load())
+	metric, ok := restored.Get(&Metrics{ID: "visitors", MType: SetMetric})
+	require.True(t, ok)
+	assert.Equal(t, uint64(4), metric.Set.Cardinality())
+
+	repo := NewRepositoryWithStorage(newTestDBStorage(t))
+	_, err = repo.Collect(&Metrics{ID: "visitors", MType: SetMetric, Members: []string{"alice", "bob", "alice"}})
+	require.NoError(t, err)
+	metric, ok = repo.Get(&Metrics{ID: "visitors", MType: SetMetric})
+	require.True(t, ok)
+	assert.Equal(t, uint64(2), metric.Set.Cardinality())
+}
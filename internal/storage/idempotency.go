@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader carries the key of an update as "agent:sequence"
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const (
+	idempotencyExpireInterval = time.Second
+	// idempotencySaveInterval is how often keys are saved for savers which persist every update on their own
+	idempotencySaveInterval = time.Second
+)
+
+var ErrRequestInProgress = errors.New("request with the same idempotency key is in progress")
+
+// IdempotencyKey identifies one logical update of an agent, retries of the update share the key
+type IdempotencyKey struct {
+	Agent    string
+	Sequence uint64
+}
+
+func (k IdempotencyKey) String() string {
+	return fmt.Sprintf("%s:%d", k.Agent, k.Sequence)
+}
+
+// ParseIdempotencyKey parses keys like "web01-3f2a:42"
+func ParseIdempotencyKey(value string) (IdempotencyKey, error) {
+	agent, seq, found := strings.Cut(value, ":")
+	if !found || agent == "" || len(agent) > maxLabelValueBytes {
+		return IdempotencyKey{}, fmt.Errorf("idempotency key %q should look like agent:sequence", value)
+	}
+	sequence, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return IdempotencyKey{}, fmt.Errorf("idempotency key %q: %w", value, err)
+	}
+	return IdempotencyKey{Agent: agent, Sequence: sequence}, nil
+}
+
+// IdempotentResponse is the response to the first request with a key, it is replayed to retries
+type IdempotentResponse struct {
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	SeenAt      time.Time `json:"seen_at"`
+}
+
+// IdempotencyStore remembers responses to keyed updates for window per agent.
+// It is saved to Path together with metrics, see MetricsSaver.Idempotency,
+// so that retries are recognised after a restart
+type IdempotencyStore struct {
+	Path   string
+	window time.Duration
+	mu     sync.Mutex
+	agents map[string]map[uint64]*IdempotentResponse
+	// changes counts updates of completed responses, saved is the count written to Path
+	changes uint64
+	saved   uint64
+	// saveMu keeps an older checkpoint from overwriting a newer one
+	saveMu sync.Mutex
+	// onComplete is run after a response is completed, savers which save after each update set it
+	// so that the key is saved along with the metrics of its update
+	onComplete func()
+}
+
+// Begin reserves key for a new request. If the key was seen the stored response is returned,
+// ErrRequestInProgress is returned while the first request with the key is not completed, however long it takes
+func (s *IdempotencyStore) Begin(key IdempotencyKey, now time.Time) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen, ok := s.agents[key.Agent][key.Sequence]
+	switch {
+	case !ok:
+	case seen.Status == 0:
+		return nil, ErrRequestInProgress
+	case now.Sub(seen.SeenAt) > s.window:
+	default:
+		return seen, nil
+	}
+	if s.agents[key.Agent] == nil {
+		s.agents[key.Agent] = make(map[uint64]*IdempotentResponse)
+	}
+	s.agents[key.Agent][key.Sequence] = &IdempotentResponse{SeenAt: now}
+	return nil, nil
+}
+
+// Complete stores the response to the request reserved by Begin
+func (s *IdempotencyStore) Complete(key IdempotencyKey, resp IdempotentResponse) {
+	s.mu.Lock()
+	if s.agents[key.Agent] == nil {
+		s.agents[key.Agent] = make(map[uint64]*IdempotentResponse)
+	}
+	s.agents[key.Agent][key.Sequence] = &resp
+	s.changes++
+	onComplete := s.onComplete
+	s.mu.Unlock()
+	if onComplete != nil {
+		onComplete()
+	}
+}
+
+func (s *IdempotencyStore) setOnComplete(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onComplete = fn
+}
+
+// Abort releases the key of a request which was not applied, so that a retry is applied
+func (s *IdempotencyStore) Abort(key IdempotencyKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forget(key.Agent, key.Sequence)
+}
+
+func (s *IdempotencyStore) forget(agent string, sequence uint64) {
+	delete(s.agents[agent], sequence)
+	if len(s.agents[agent]) == 0 {
+		delete(s.agents, agent)
+	}
+}
+
+// Expire forgets keys seen more than window ago
+func (s *IdempotencyStore) Expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for agent, responses := range s.agents {
+		for sequence, resp := range responses {
+			if resp.Status != 0 && now.Sub(resp.SeenAt) > s.window {
+				s.forget(agent, sequence)
+				s.changes++
+			}
+		}
+	}
+}
+
+// Save writes completed responses to Path if they changed since the last save
+func (s *IdempotencyStore) Save() error {
+	return s.checkpoint()()
+}
+
+// checkpoint captures completed responses, the returned function writes them to Path.
+// Responses completed after the capture are left for the next save
+func (s *IdempotencyStore) checkpoint() func() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Path == "" || s.changes == s.saved {
+		return func() error { return nil }
+	}
+	completed := make(map[string]map[uint64]*IdempotentResponse, len(s.agents))
+	for agent, responses := range s.agents {
+		for sequence, resp := range responses {
+			if resp.Status == 0 {
+				continue
+			}
+			if completed[agent] == nil {
+				completed[agent] = make(map[uint64]*IdempotentResponse)
+			}
+			completed[agent][sequence] = resp
+		}
+	}
+	data, err := json.Marshal(completed)
+	version := s.changes
+	return func() error {
+		s.saveMu.Lock()
+		defer s.saveMu.Unlock()
+		s.mu.Lock()
+		stale := version <= s.saved
+		s.mu.Unlock()
+		if stale {
+			return nil
+		}
+		if err == nil {
+			err = writeFileAtomic(s.Path, data)
+		}
+		if err != nil {
+			return fmt.Errorf("problems with saving idempotency keys: %w", err)
+		}
+		s.mu.Lock()
+		s.saved = version
+		s.mu.Unlock()
+		return nil
+	}
+}
+
+// Load reads responses saved by Save, a missing file is not an error
+func (s *IdempotencyStore) Load() error {
+	if s.Path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	agents := make(map[string]map[uint64]*IdempotentResponse)
+	if err = json.Unmarshal(data, &agents); err != nil {
+		return fmt.Errorf("problems with reading idempotency keys: %w", err)
+	}
+	s.mu.Lock()
+	s.agents = agents
+	s.mu.Unlock()
+	s.Expire(time.Now())
+	return nil
+}
+
+// Start expires keys in the background until ctx is done
+func (s *IdempotencyStore) Start(ctx context.Context) {
+	ticker := time.NewTicker(idempotencyExpireInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.Expire(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// NewIdempotencyStore remembers keys for window and keeps them in path, empty path keeps them in memory only
+func NewIdempotencyStore(path string, window time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		Path:   path,
+		window: window,
+		agents: make(map[string]map[uint64]*IdempotentResponse),
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"github.com/rkinwork/musthave-metrics/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseIdempotencyKey(t *testing.T) {
+	key, err := ParseIdempotencyKey("web01-3f2a:42")
+	require.NoError(t, err)
+	assert.Equal(t, IdempotencyKey{Agent: "web01-3f2a", Sequence: 42}, key)
+	assert.Equal(t, "web01-3f2a:42", key.String())
+
+	for _, value := range []string{"web01", ":42", "web01:-1", "web01:x"} {
+		_, err = ParseIdempotencyKey(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json.idempotency")
+	store := NewIdempotencyStore(path, time.Minute)
+	key := IdempotencyKey{Agent: "web01", Sequence: 1}
+	now := time.Now()
+
+	seen, err := store.Begin(key, now)
+	require.NoError(t, err)
+	assert.Nil(t, seen)
+	_, err = store.Begin(key, now)
+	assert.ErrorIs(t, err, ErrRequestInProgress)
+	store.Complete(key, IdempotentResponse{Status: http.StatusOK, Body: []byte("{}"), SeenAt: now})
+	seen, err = store.Begin(key, now)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, seen.Status)
+
+	failed := IdempotencyKey{Agent: "web01", Sequence: 2}
+	_, err = store.Begin(failed, now)
+	require.NoError(t, err)
+	store.Abort(failed)
+	seen, err = store.Begin(failed, now)
+	require.NoError(t, err)
+	assert.Nil(t, seen)
+	// a slow request keeps its key past the window
+	_, err = store.Begin(failed, now.Add(2*time.Minute))
+	assert.ErrorIs(t, err, ErrRequestInProgress)
+
+	require.NoError(t, store.Save())
+	restored := NewIdempotencyStore(path, time.Minute)
+	require.NoError(t, restored.Load())
+	seen, err = restored.Begin(key, now)
+	require.NoError(t, err)
+	require.NotNil(t, seen)
+	assert.Equal(t, []byte("{}"), seen.Body)
+	// requests in progress are not saved
+	seen, err = restored.Begin(failed, now)
+	require.NoError(t, err)
+	assert.Nil(t, seen)
+
+	restored.Expire(now.Add(2 * time.Minute))
+	seen, err = restored.Begin(key, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Nil(t, seen)
+}
+
+func TestIdempotencyKeysSavedWithMetrics(t *testing.T) {
+	dir := t.TempDir()
+	cnf := &config.Config{StoreInterval: time.Hour}
+	saver := &JSONFileSaver{FilePath: filepath.Join(dir, "missing", "metrics.json"), IMetricRepository: NewRepository()}
+	ms := NewMetricsSaver(cnf, saver)
+	ms.Idempotency = NewIdempotencyStore(filepath.Join(dir, "metrics.json.idempotency"), time.Minute)
+	key := IdempotencyKey{Agent: "web01", Sequence: 1}
+	now := time.Now()
+	_, err := ms.Idempotency.Begin(key, now)
+	require.NoError(t, err)
+	ms.Idempotency.Complete(key, IdempotentResponse{Status: http.StatusOK, SeenAt: now})
+
+	// metrics could not be saved, so keys protecting them are not saved either
+	ms.save(true)
+	assert.NoFileExists(t, ms.Idempotency.Path)
+
+	saver.FilePath = filepath.Join(dir, "metrics.json")
+	ms.save(true)
+	restored := NewIdempotencyStore(ms.Idempotency.Path, time.Minute)
+	require.NoError(t, restored.Load())
+	seen, err := restored.Begin(key, now)
+	require.NoError(t, err)
+	require.NotNil(t, seen)
+	assert.Equal(t, http.StatusOK, seen.Status)
+}
+
+func TestIdempotencyKeysSavedAfterEachUpdate(t *testing.T) {
+	dir := t.TempDir()
+	saver := &JSONFileSaver{FilePath: filepath.Join(dir, "metrics.json"), IMetricRepository: NewRepository()}
+	ms := NewMetricsSaver(&config.Config{}, saver)
+	ms.Idempotency = NewIdempotencyStore(filepath.Join(dir, "metrics.json.idempotency"), time.Minute)
+	require.NoError(t, ms.Start())
+	defer ms.Stop()
+
+	key := IdempotencyKey{Agent: "web01", Sequence: 1}
+	now := time.Now()
+	_, err := ms.Idempotency.Begin(key, now)
+	require.NoError(t, err)
+	_, err = ms.Collect(NewCounterMetrics("clicks", 3))
+	require.NoError(t, err)
+	ms.Idempotency.Complete(key, IdempotentResponse{Status: http.StatusOK, SeenAt: now})
+
+	// no later update is needed to save the key of the last one
+	restored := NewIdempotencyStore(ms.Idempotency.Path, time.Minute)
+	require.NoError(t, restored.Load())
+	seen, err := restored.Begin(key, now)
+	require.NoError(t, err)
+	require.NotNil(t, seen)
+	snapshot, err := readSnapshot(saver.FilePath)
+	require.NoError(t, err)
+	assert.Len(t, snapshot.Metrics, 1)
+}
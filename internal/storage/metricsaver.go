@@ -1,8 +1,7 @@
 package storage
 
 import (
-	"context"
-	"encoding/json"
+	"fmt"
 	"github.com/rkinwork/musthave-metrics/internal/config"
 	"github.com/rkinwork/musthave-metrics/internal/logger"
 	"go.uber.org/zap"
@@ -10,6 +9,20 @@ import (
 	"time"
 )
 
+func init() {
+	RegisterBackend(config.DefaultStorageType, func(cnf *config.Config) (IMetricSaver, error) {
+		return &JSONFileSaver{
+			FilePath:          cnf.FileStoragePath,
+			SnapshotHistory:   cnf.SnapshotHistory,
+			RestoreFrom:       cnf.RestoreFrom,
+			IMetricRepository: NewRepository(),
+		}, nil
+	})
+	RegisterBackend(config.MemoryStorageType, func(cnf *config.Config) (IMetricSaver, error) {
+		return &NoopMetricSaver{IMetricRepository: NewRepository()}, nil
+	})
+}
+
 type ILoadSave interface {
 	Save() error
 	Load() error
@@ -22,111 +35,262 @@ type IMetricSaver interface {
 
 type JSONFileSaver struct {
 	FilePath string
+	// SnapshotHistory is how many timestamped copies of FilePath to keep, 0 disables history
+	SnapshotHistory int
+	// RestoreFrom selects the snapshot for Load, see readRestorePoint
+	RestoreFrom string
+	IMetricRepository
+}
+
+// NoopMetricSaver is used when the repository is durable by itself
+type NoopMetricSaver struct {
 	IMetricRepository
 }
 
-type NoopMetricSaver struct{}
+func (ns *NoopMetricSaver) Save() error {
+	return nil
+}
+
+func (ns *NoopMetricSaver) Load() error {
+	return nil
+}
 
 func (js *JSONFileSaver) Save() error {
-	file, err := os.OpenFile(js.FilePath, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
+	return writeSnapshot(js.FilePath, js.GetAllMetrics())
+}
+
+// SaveHistory saves like Save and adds a timestamped copy to history, pruning the oldest ones
+func (js *JSONFileSaver) SaveHistory() error {
+	metrics := js.GetAllMetrics()
+	if err := writeSnapshot(js.FilePath, metrics); err != nil {
 		return err
 	}
-	defer func(file *os.File) {
-		err = file.Close()
-		if err != nil {
-			logger.Log.Error("problems with closing file", zap.Error(err))
-		}
-	}(file)
-
-	bytes, err := json.Marshal(js.GetAllMetrics())
-	if err != nil {
+	if js.SnapshotHistory <= 0 {
+		return nil
+	}
+	if err := writeSnapshot(historyPath(js.FilePath, time.Now()), metrics); err != nil {
 		return err
 	}
-
-	_, err = file.Write(bytes)
-	return err
+	return pruneHistory(js.FilePath, js.SnapshotHistory)
 }
 
-func (js *JSONFileSaver) Load() error {
-	var metrics []Metrics
-	if _, err := os.Stat(js.FilePath); os.IsNotExist(err) {
-		return nil
-	}
-	file, err := os.Open(js.FilePath)
+// Snapshots lists the current snapshot followed by history, newest first
+func (js *JSONFileSaver) Snapshots() ([]SnapshotInfo, error) {
+	history, err := listHistory(js.FilePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func(file *os.File) {
-		err = file.Close()
-		if err != nil {
-			logger.Log.Error("problems with closing file", zap.Error(err))
-		}
-	}(file)
+	res := make([]SnapshotInfo, 0, len(history)+1)
+	if _, err = os.Stat(js.FilePath); err == nil {
+		res = append(res, describeSnapshot(js.FilePath))
+	}
+	for _, path := range history {
+		res = append(res, describeSnapshot(path))
+	}
+	return res, nil
+}
 
-	data := json.NewDecoder(file)
-	err = data.Decode(&metrics)
+func (js *JSONFileSaver) Load() error {
+	_, err := js.load()
+	return err
+}
 
+// load restores the snapshot selected by RestoreFrom and returns its path, empty when there is no snapshot yet
+func (js *JSONFileSaver) load() (string, error) {
+	snapshot, path, err := readRestorePoint(js.FilePath, js.RestoreFrom)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
-	for _, metric := range metrics {
+	for _, metric := range snapshot.Metrics {
 		if _, err := js.Set(&metric); err != nil {
 			logger.Log.Error("error while setting metric", zap.Error(err))
 		}
 	}
+	return path, nil
+}
 
-	return nil
+// IUpdateLogger is implemented by savers that persist every update on their own.
+// For them Save is a compaction, so it is never run after each update
+type IUpdateLogger interface {
+	LogsUpdates() bool
+}
+
+// IHistorySaver is implemented by savers which keep history of snapshots.
+// SaveHistory is run by periodic and final saves only, so history is not rotated after each update
+type IHistorySaver interface {
+	SaveHistory() error
 }
 
 type MetricsSaver struct {
-	config *config.Config
-	ticker *time.Ticker
-	quit   chan struct{}
+	// Idempotency keys are saved along with metrics: keys are captured before the metrics are saved,
+	// so a restored key always protects an update the restored metrics hold.
+	// Savers which persist every update have it saved before its key is completed, their keys are saved every second.
+	// When metrics are saved after each update, they are saved again with the key once it is completed
+	Idempotency *IdempotencyStore
+	config      *config.Config
+	ticker      *time.Ticker
+	syncSave    bool
+	logsUpdates bool
+	stop        chan struct{}
+	quit        chan struct{}
 	IMetricSaver
 }
 
-func (ms *MetricsSaver) Done() {
+// Stop ends periodic saving and saves metrics for the last time,
+// it is called after everything which updates metrics has stopped so that their last updates are saved
+func (ms *MetricsSaver) Stop() {
+	close(ms.stop)
 	<-ms.quit
 }
 
-func (ms *MetricsSaver) Start(ctx context.Context) {
+// Start restores metrics if configured and runs periodic saving until Stop
+func (ms *MetricsSaver) Start() error {
 	if ms.config.Restore {
-		_ = ms.Load()
+		if err := ms.Load(); err != nil {
+			return fmt.Errorf("failed to restore metrics: %w", err)
+		}
+	}
+	if ms.Idempotency != nil && ms.syncSave {
+		ms.Idempotency.setOnComplete(func() { ms.save(false) })
+	}
+	var tick <-chan time.Time
+	if ms.ticker != nil {
+		tick = ms.ticker.C
 	}
 	go func() {
+		var keysTick <-chan time.Time
+		if ms.Idempotency != nil && ms.logsUpdates {
+			keysTicker := time.NewTicker(idempotencySaveInterval)
+			defer keysTicker.Stop()
+			keysTick = keysTicker.C
+		}
 		for {
 			select {
-			case <-ms.ticker.C:
-				_ = ms.Save()
-			case <-ctx.Done():
-				ms.ticker.Stop()
-				_ = ms.Save()
+			case <-tick:
+				ms.save(true)
+			case <-keysTick:
+				ms.saveKeys(ms.Idempotency.checkpoint())
+			case <-ms.stop:
+				if ms.ticker != nil {
+					ms.ticker.Stop()
+				}
+				ms.save(true)
 				close(ms.quit)
 				return
 			}
 		}
 	}()
+	return nil
+}
+
+func (ms *MetricsSaver) Delete(metric *Metrics) error {
+	err := ms.IMetricSaver.Delete(metric)
+	if err == nil && ms.syncSave {
+		ms.save(false)
+	}
+	return err
+}
+
+func (ms *MetricsSaver) Reset(metric *Metrics) (*Metrics, error) {
+	m, err := ms.IMetricSaver.Reset(metric)
+	if err == nil && ms.syncSave {
+		ms.save(false)
+	}
+	return m, err
+}
+
+func (ms *MetricsSaver) Snapshots() ([]SnapshotInfo, error) {
+	lister, ok := ms.IMetricSaver.(ISnapshotLister)
+	if !ok {
+		return nil, ErrSnapshotsNotSupported
+	}
+	return lister.Snapshots()
+}
+
+// save writes metrics and then idempotency keys captured before them, with rotate history of snapshots is kept too
+func (ms *MetricsSaver) save(rotate bool) {
+	var writeKeys func() error
+	if ms.Idempotency != nil {
+		writeKeys = ms.Idempotency.checkpoint()
+	}
+	save := ms.Save
+	if hs, ok := ms.IMetricSaver.(IHistorySaver); ok && rotate {
+		save = hs.SaveHistory
+	}
+	if err := save(); err != nil {
+		logger.Log.Error("problems with saving metrics", zap.Error(err))
+		return
+	}
+	ms.saveKeys(writeKeys)
+}
+
+func (ms *MetricsSaver) saveKeys(writeKeys func() error) {
+	if writeKeys == nil {
+		return
+	}
+	if err := writeKeys(); err != nil {
+		logger.Log.Error("problems with saving idempotency keys", zap.Error(err))
+	}
 }
 
 func (ms *MetricsSaver) Collect(metric *Metrics) (*Metrics, error) {
 
 	m, err := ms.IMetricSaver.Collect(metric)
-	if ms.config.StoreInterval == 0 {
-		_ = ms.Save()
+	if ms.syncSave {
+		ms.save(false)
+	}
+	return m, err
+}
+
+func (ms *MetricsSaver) CollectBatch(metrics []Metrics) ([]Metrics, error) {
+	res, err := ms.IMetricSaver.CollectBatch(metrics)
+	if err == nil && ms.syncSave {
+		ms.save(false)
+	}
+	return res, err
+}
+
+func (ms *MetricsSaver) Set(metric *Metrics) (*Metrics, error) {
+	m, err := ms.IMetricSaver.Set(metric)
+	if err == nil && ms.syncSave {
+		ms.save(false)
 	}
 	return m, err
 }
 
+func (ms *MetricsSaver) SetBatch(metrics []Metrics) ([]Metrics, error) {
+	res, err := ms.IMetricSaver.SetBatch(metrics)
+	if err == nil && ms.syncSave {
+		ms.save(false)
+	}
+	return res, err
+}
+
 func NewMetricsSaver(config *config.Config, repo IMetricSaver) *MetricsSaver {
+	interval := config.StoreInterval
+	syncSave := interval == 0
+	ul, ok := repo.(IUpdateLogger)
+	logsUpdates := ok && ul.LogsUpdates()
+	if logsUpdates {
+		syncSave = false
+		if interval == 0 {
+			interval = defaultCompactionInterval
+		}
+	}
 	var ticker *time.Ticker
-	if config.StoreInterval > 0 {
-		ticker = time.NewTicker(config.StoreInterval)
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
 	}
 
 	ms := &MetricsSaver{
 		config:       config,
 		ticker:       ticker,
+		syncSave:     syncSave,
+		logsUpdates:  logsUpdates,
+		stop:         make(chan struct{}),
 		quit:         make(chan struct{}),
 		IMetricSaver: repo,
 	}
@@ -1,26 +1,173 @@
 package storage
 
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
 type MetricHash string
 
 const (
-	GaugeMetric   = `gauge`
-	CounterMetric = `counter`
+	GaugeMetric     = `gauge`
+	CounterMetric   = `counter`
+	HistogramMetric = `histogram`
+	SummaryMetric   = `summary`
+	SetMetric       = `set`
+	// UpDownCounterMetric is a counter which may go down, like queue depth
+	UpDownCounterMetric = `updowncounter`
 )
 
 // Metrics is a struct that represents a metric.
 // It contains the ID, which is the name of the metric.
 // The MType parameter can have a value of "gauge" or "counter".
-// If MType is "counter", the Delta field represents the value of the metric.
+// If MType is "counter" or "updowncounter", the Delta field represents the value of the metric.
 // If MType is "gauge", the Value field represents the value of the metric.
+// If MType is "histogram", the Histogram field holds bucketed observations.
+// If MType is "summary", the Summary field holds a quantile sketch.
+// A single observation of a histogram or a summary may be sent in Value instead.
+// If MType is "set", the Set field holds the distinct count sketch, updates may carry Members to add.
 // If we use Metrics as response to request we fill only Value
 type Metrics struct {
 	ID    string   `json:"id"`              // имя метрики
 	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
 	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
 	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	// Histogram is the value of a histogram metric
+	Histogram *Histogram `json:"histogram,omitempty"`
+	// Summary is the value of a summary metric
+	Summary *Sketch `json:"summary,omitempty"`
+	// Set is the value of a set metric
+	Set *HyperLogLog `json:"set,omitempty"`
+	// Members are added to a set metric by an update, they are not stored
+	Members []string `json:"members,omitempty"`
+	// ResetAt is the time of the last explicit reset of a counter
+	ResetAt *time.Time `json:"reset_at,omitempty"`
+	// Labels are optional dimensions of the metric, metrics with different labels are different series
+	Labels map[string]string `json:"labels,omitempty"`
+	// UpdatedAt is the time of the last update, it is kept by storages but not exposed by API
+	UpdatedAt *time.Time `json:"-"`
+	// Relative marks a gauge update whose Value is a change, Collect adds it to the stored value
+	// in the same transaction. Listeners like StatsD set it, it is not a part of the API
+	Relative bool `json:"-"`
 }
 
-// GetHash returns a hash string composed of the ID and MType fields of the Metrics struct.
+// GetHash returns a hash string composed of the ID, MType and Labels fields of the Metrics struct.
 func (m Metrics) GetHash() MetricHash {
-	return MetricHash(m.ID + m.MType)
+	return MetricHash(m.ID + m.MType + LabelsKey(m.Labels))
+}
+
+// LabelsKey returns canonical representation of labels, it is empty when there are no labels
+func LabelsKey(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	// maps are encoded with sorted keys
+	key, _ := json.Marshal(labels)
+	return string(key)
+}
+
+// HasLabels reports if the metric has all labels of filter with the same values
+func (m Metrics) HasLabels(filter map[string]string) bool {
+	for name, value := range filter {
+		if v, ok := m.Labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// String renders the metric like HeapAlloc{host="web01"} gauge 123
+func (m Metrics) String() string {
+	return m.Display("")
+}
+
+// Display renders the metric with its value formatted for unit, like HeapAlloc gauge 1.5 MiB
+func (m Metrics) Display(unit string) string {
+	var sb strings.Builder
+	sb.WriteString(m.ID)
+	if len(m.Labels) > 0 {
+		names := make([]string, 0, len(m.Labels))
+		for name := range m.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		sb.WriteString("{")
+		for i, name := range names {
+			if i > 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(&sb, "%s=%q", name, m.Labels[name])
+		}
+		sb.WriteString("}")
+	}
+	sb.WriteString(" ")
+	sb.WriteString(m.MType)
+	if value := m.DisplayValue(unit); value != "" {
+		sb.WriteString(" ")
+		sb.WriteString(value)
+	}
+	return sb.String()
+}
+
+// DisplayValue renders only the value of the metric formatted for unit
+func (m Metrics) DisplayValue(unit string) string {
+	switch {
+	case m.Delta != nil && unit == "":
+		return fmt.Sprintf("%d", *m.Delta)
+	case m.Delta != nil:
+		return FormatValue(float64(*m.Delta), unit)
+	case m.Value != nil:
+		return FormatValue(*m.Value, unit)
+	case m.Distribution() != nil:
+		count, sum := m.Distribution().Stats()
+		return fmt.Sprintf("count=%d sum=%s", count, FormatValue(sum, unit))
+	case m.Set != nil:
+		return fmt.Sprintf("cardinality=%d", m.Set.Cardinality())
+	}
+	return ""
+}
+
+// Distribution returns the value of a histogram or a summary, it is nil for other metrics
+func (m Metrics) Distribution() IDistribution {
+	switch {
+	case m.Histogram != nil:
+		return m.Histogram
+	case m.Summary != nil:
+		return m.Summary
+	}
+	return nil
+}
+
+// storedMetric is a metric with its service fields as it is kept on disk
+type storedMetric struct {
+	Metrics
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// storedMetrics encodes metrics together with their service fields
+type storedMetrics []Metrics
+
+func (sm storedMetrics) MarshalJSON() ([]byte, error) {
+	res := make([]storedMetric, len(sm))
+	for i, m := range sm {
+		res[i] = storedMetric{Metrics: m, UpdatedAt: m.UpdatedAt}
+	}
+	return json.Marshal(res)
+}
+
+func (sm *storedMetrics) UnmarshalJSON(data []byte) error {
+	var stored []storedMetric
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	res := make(storedMetrics, len(stored))
+	for i, m := range stored {
+		res[i] = m.Metrics
+		res[i].UpdatedAt = m.UpdatedAt
+	}
+	*sm = res
+	return nil
 }
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// PushGroups remembers which series were pushed under every grouping key, like job="backup",instance="db01",
+// so that a later push can replace them and a group can be deleted as a whole.
+// Groups are saved to Path if it is set
+type PushGroups struct {
+	Path   string
+	mu     sync.Mutex
+	groups map[string][]Metrics
+}
+
+// Push stores metrics of the group given by grouping labels, they are added to labels of every metric.
+// Counters carry their total and replace the stored value.
+// With replace all other series of the group are deleted, otherwise only series with names of pushed metrics
+func (p *PushGroups) Push(repo IMetricRepository, grouping map[string]string, metrics []Metrics, replace bool) error {
+	if err := ValidateLabels(grouping); err != nil {
+		return err
+	}
+	for i := range metrics {
+		labels, err := groupLabels(metrics[i].Labels, grouping)
+		if err != nil {
+			return &BatchItemError{Index: i, Err: err}
+		}
+		metrics[i].Labels = labels
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := LabelsKey(grouping)
+	res, err := repo.SetBatch(metrics)
+	if err != nil {
+		// the push is rejected as a whole, the group stays as it was
+		return err
+	}
+	pushed := make(map[MetricHash]bool, len(res))
+	names := make(map[string]bool, len(res))
+	for i := range res {
+		pushed[res[i].GetHash()] = true
+		names[res[i].ID] = true
+	}
+	group := make([]Metrics, 0, len(p.groups[key])+len(res))
+	var deleteErr error
+	for _, m := range p.groups[key] {
+		switch {
+		case pushed[m.GetHash()]:
+		case deleteErr == nil && (replace || names[m.ID]):
+			if deleteErr = repo.Delete(&m); deleteErr != nil {
+				// series which were not deleted stay in the group
+				group = append(group, m)
+			}
+		default:
+			group = append(group, m)
+		}
+	}
+	for i := range res {
+		// a series pushed twice is kept once
+		if hash := res[i].GetHash(); pushed[hash] {
+			group = append(group, seriesOf(res[i]))
+			pushed[hash] = false
+		}
+	}
+	p.groups[key] = group
+	if err = p.save(); err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+// Delete removes all series of the group
+func (p *PushGroups) Delete(repo IMetricRepository, grouping map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := LabelsKey(grouping)
+	for i, m := range p.groups[key] {
+		if err := repo.Delete(&m); err != nil {
+			p.groups[key] = p.groups[key][i:]
+			return err
+		}
+	}
+	delete(p.groups, key)
+	return p.save()
+}
+
+// groupLabels adds grouping labels to labels of a pushed metric, a metric may not carry another value of them
+func groupLabels(labels, grouping map[string]string) (map[string]string, error) {
+	res := make(map[string]string, len(labels)+len(grouping))
+	for name, value := range labels {
+		res[name] = value
+	}
+	for name, value := range grouping {
+		if v, ok := res[name]; ok && v != value {
+			return nil, fmt.Errorf("label %s=%q differs from the grouping key", name, v)
+		}
+		res[name] = value
+	}
+	return res, nil
+}
+
+// seriesOf keeps only what identifies the series of a metric
+func seriesOf(m Metrics) Metrics {
+	return Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels}
+}
+
+func (p *PushGroups) save() error {
+	if p.Path == "" {
+		return nil
+	}
+	data, err := json.Marshal(p.groups)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(p.Path, data); err != nil {
+		return fmt.Errorf("problems with saving push groups: %w", err)
+	}
+	return nil
+}
+
+// Load reads groups saved to Path, a missing file is not an error
+func (p *PushGroups) Load() error {
+	if p.Path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	groups := make(map[string][]Metrics)
+	if err = json.Unmarshal(data, &groups); err != nil {
+		return fmt.Errorf("problems with reading push groups: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.groups = groups
+	return nil
+}
+
+func NewPushGroups() *PushGroups {
+	return &PushGroups{groups: make(map[string][]Metrics)}
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/config"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BackendFactory builds a repository with its persistence for the given config.
+// If the returned saver implements io.Closer it is closed on server shutdown
+type BackendFactory func(cnf *config.Config) (IMetricSaver, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a storage backend available by name.
+// It panics if factory is nil or the name is already taken
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if factory == nil {
+		panic("storage: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("storage: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// unregisterBackend removes a backend so that tests can register it again
+func unregisterBackend(name string) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	delete(backends, name)
+}
+
+// Backends returns sorted names of the registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend builds the backend configured by cnf.StorageType
+func NewBackend(cnf *config.Config) (IMetricSaver, error) {
+	backendsMu.RLock()
+	factory, ok := backends[cnf.StorageType]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q, available: %s", cnf.StorageType, strings.Join(Backends(), ", "))
+	}
+	saver, err := factory(cnf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init %q storage: %w", cnf.StorageType, err)
+	}
+	return saver, nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"github.com/rkinwork/musthave-metrics/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewBackend(t *testing.T) {
+	RegisterBackend("testBackend", func(cnf *config.Config) (IMetricSaver, error) {
+		return &NoopMetricSaver{IMetricRepository: NewRepository()}, nil
+	})
+	t.Cleanup(func() { unregisterBackend("testBackend") })
+	assert.Contains(t, Backends(), "testBackend")
+	assert.Panics(t, func() {
+		RegisterBackend("testBackend", func(cnf *config.Config) (IMetricSaver, error) { return nil, nil })
+	})
+
+	cnf, err := config.New(false)
+	require.NoError(t, err)
+
+	cnf.StorageType = "testBackend"
+	saver, err := NewBackend(cnf)
+	require.NoError(t, err)
+	assert.IsType(t, &NoopMetricSaver{}, saver)
+
+	cnf.StorageType = config.DefaultStorageType
+	saver, err = NewBackend(cnf)
+	require.NoError(t, err)
+	assert.IsType(t, &JSONFileSaver{}, saver)
+
+	cnf.StorageType = config.PostgresStorageType
+	_, err = NewBackend(cnf)
+	assert.ErrorContains(t, err, "database DSN is not configured")
+
+	cnf.StorageType = "unknown"
+	_, err = NewBackend(cnf)
+	assert.ErrorContains(t, err, `unknown storage type "unknown", available: filestorage, memory, postgres, testBackend`)
+}
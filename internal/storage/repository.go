@@ -1,9 +1,32 @@
 package storage
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrMetricNotFound = errors.New("metric not found")
+	ErrNotResettable  = errors.New("only counters can be reset")
+	// ErrMetricUpdated is returned by a conditional delete of a metric updated after the given time
+	ErrMetricUpdated = errors.New("metric was updated")
+)
+
 type IMetricRepository interface {
 	Get(metric *Metrics) (Metrics, bool)
 	Collect(metric *Metrics) (*Metrics, error)
+	// CollectBatch validates and collects all metrics atomically:
+	// either every metric is applied or none of them
+	CollectBatch(metrics []Metrics) ([]Metrics, error)
 	Set(metric *Metrics) (*Metrics, error)
+	// SetBatch validates and stores absolute values of all metrics atomically,
+	// like CollectBatch either every metric is applied or none of them
+	SetBatch(metrics []Metrics) ([]Metrics, error)
+	// Reset sets a counter to zero and remembers the time of the reset in ResetAt
+	// so that rates computed later do not take it for a decrease
+	Reset(metric *Metrics) (*Metrics, error)
+	// Delete removes the metric, if its UpdatedAt is set only when it was not updated after that time
 	Delete(metric *Metrics) error
 	GetAllMetrics() []Metrics
 }
@@ -17,21 +40,160 @@ func (m *MetricRepository) Get(metric *Metrics) (Metrics, bool) {
 }
 
 func (m *MetricRepository) Collect(metric *Metrics) (*Metrics, error) {
+	now := time.Now()
+	metric.UpdatedAt = &now
+	if adder, ok := m.storage.(ICounterAdder); ok && metric.Delta != nil &&
+		(metric.MType == CounterMetric || metric.MType == UpDownCounterMetric) {
+		res, err := adder.Add(*metric)
+		if err != nil {
+			return nil, err
+		}
+		metric.Delta = res.Delta
+		metric.ResetAt = res.ResetAt
+		return metric, nil
+	}
+	err := m.tx([]Metrics{*metric}, func(tx IMetricStorageTx) error {
+		return collect(tx, metric)
+	})
+	return metric, err
+}
+
+// tx runs fn isolating only metrics of scope if the storage supports it
+func (m *MetricRepository) tx(scope []Metrics, fn func(tx IMetricStorageTx) error) error {
+	if scoped, ok := m.storage.(IScopedTxStorage); ok {
+		return scoped.TxOn(scope, fn)
+	}
+	return m.storage.Tx(fn)
+}
+
+// BatchItemError reports which metric of a batch caused the whole batch to be rejected
+type BatchItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchItemError) Error() string {
+	return fmt.Sprintf("metric #%d: %v", e.Index, e.Err)
+}
+
+func (e *BatchItemError) Unwrap() error {
+	return e.Err
+}
+
+func (m *MetricRepository) CollectBatch(metrics []Metrics) ([]Metrics, error) {
+	for i := range metrics {
+		if err := ValidateMetric(&metrics[i]); err != nil {
+			return nil, &BatchItemError{Index: i, Err: err}
+		}
+	}
+	res := make([]Metrics, len(metrics))
+	now := time.Now()
+	err := m.tx(metrics, func(tx IMetricStorageTx) error {
+		for i := range metrics {
+			metric := metrics[i]
+			metric.UpdatedAt = &now
+			if err := collect(tx, &metric); err != nil {
+				return &BatchItemError{Index: i, Err: err}
+			}
+			res[i] = metric
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// collect merges metric with its stored state inside the transaction
+func collect(tx IMetricStorageTx, metric *Metrics) error {
 	switch metric.MType {
-	case CounterMetric:
-		delta := *metric.Delta
-		if oldMetric, ok := m.storage.Get(metric); ok {
-			delta = *oldMetric.Delta + delta
+	case CounterMetric, UpDownCounterMetric:
+		res, err := tx.Increment(*metric)
+		if err != nil {
+			return err
+		}
+		metric.Delta = res.Delta
+		metric.ResetAt = res.ResetAt
+		return nil
+	case HistogramMetric:
+		return mergeHistogram(tx, metric)
+	case SummaryMetric:
+		return mergeSummary(tx, metric)
+	case SetMetric:
+		return mergeSet(tx, metric)
+	case GaugeMetric:
+		if metric.Relative && metric.Value != nil {
+			value := *metric.Value
+			if stored, ok := tx.Get(metric); ok && stored.Value != nil {
+				value += *stored.Value
+			}
+			metric.Value, metric.Relative = &value, false
 		}
-		metric.Delta = &delta
 	}
-	return metric, m.storage.Set(*metric)
+	return tx.Set(*metric)
 }
 
+// Set stores metric as is, keeping its update time if it is known
 func (m *MetricRepository) Set(metrics *Metrics) (*Metrics, error) {
+	if metrics.UpdatedAt == nil {
+		now := time.Now()
+		metrics.UpdatedAt = &now
+	}
 	return metrics, m.storage.Set(*metrics)
 }
 
+func (m *MetricRepository) SetBatch(metrics []Metrics) ([]Metrics, error) {
+	for i := range metrics {
+		if err := ValidateTotal(&metrics[i]); err != nil {
+			return nil, &BatchItemError{Index: i, Err: err}
+		}
+	}
+	res := make([]Metrics, len(metrics))
+	now := time.Now()
+	err := m.tx(metrics, func(tx IMetricStorageTx) error {
+		for i := range metrics {
+			metric := metrics[i]
+			if metric.UpdatedAt == nil {
+				metric.UpdatedAt = &now
+			}
+			if err := tx.Set(metric); err != nil {
+				return &BatchItemError{Index: i, Err: err}
+			}
+			res[i] = metric
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (m *MetricRepository) Reset(metric *Metrics) (*Metrics, error) {
+	if metric.MType != CounterMetric && metric.MType != UpDownCounterMetric {
+		return nil, ErrNotResettable
+	}
+	var res Metrics
+	err := m.tx([]Metrics{*metric}, func(tx IMetricStorageTx) error {
+		stored, ok := tx.Get(metric)
+		if !ok {
+			return ErrMetricNotFound
+		}
+		now := time.Now()
+		zero := int64(0)
+		stored.Delta = &zero
+		stored.UpdatedAt = &now
+		stored.ResetAt = &now
+		res = stored
+		return tx.Set(stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
 func (m *MetricRepository) Delete(metric *Metrics) error {
 	return m.storage.Delete(metric)
 }
@@ -41,5 +203,9 @@ func (m *MetricRepository) GetAllMetrics() []Metrics {
 }
 
 func NewRepository() IMetricRepository {
-	return &MetricRepository{storage: NewInMemMetricStorage()}
+	return NewRepositoryWithStorage(NewInMemMetricStorage())
+}
+
+func NewRepositoryWithStorage(storage IMetricStorage) IMetricRepository {
+	return &MetricRepository{storage: storage}
 }
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RollupTier keeps aggregated samples of Resolution period for Retention
+type RollupTier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// ParseRollupTiers parses comma separated resolution:retention pairs like "1m:24h,1h:720h".
+// Tiers must go from the finest resolution to the coarsest one
+func ParseRollupTiers(value string) ([]RollupTier, error) {
+	var res []RollupTier
+	if strings.TrimSpace(value) == "" {
+		return res, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		resolution, retention, found := strings.Cut(strings.TrimSpace(part), ":")
+		if !found {
+			return nil, fmt.Errorf("rollup tier %q should look like resolution:retention", part)
+		}
+		tier := RollupTier{}
+		var err error
+		if tier.Resolution, err = time.ParseDuration(resolution); err != nil {
+			return nil, fmt.Errorf("rollup tier %q: %w", part, err)
+		}
+		if tier.Retention, err = time.ParseDuration(retention); err != nil {
+			return nil, fmt.Errorf("rollup tier %q: %w", part, err)
+		}
+		if tier.Resolution <= 0 || tier.Retention < tier.Resolution {
+			return nil, fmt.Errorf("rollup tier %q: retention should not be shorter than positive resolution", part)
+		}
+		if len(res) > 0 && tier.Resolution <= res[len(res)-1].Resolution {
+			return nil, errors.New("rollup tiers should go from the finest resolution to the coarsest one")
+		}
+		res = append(res, tier)
+	}
+	return res, nil
+}
+
+// rollupSeries holds aggregated points of one metric for a tier
+type rollupSeries struct {
+	tier   RollupTier
+	points *sampleRing
+	// folded is the end of the last folded period
+	folded time.Time
+	// lastTotal is the last counter total seen, the base for increase of the next period
+	lastTotal *int64
+	// monotonic counters are taken as reset when they go down
+	monotonic bool
+}
+
+func newRollupSeries(tier RollupTier, monotonic bool) *rollupSeries {
+	return &rollupSeries{
+		tier:      tier,
+		points:    newSampleRing(int(tier.Retention/tier.Resolution) + 1),
+		monotonic: monotonic,
+	}
+}
+
+// fold aggregates samples of source from closed periods which were not folded yet
+func (rs *rollupSeries) fold(source *sampleRing, now time.Time) {
+	cutoff := now.Truncate(rs.tier.Resolution)
+	var bucket []Sample
+	var bucketStart time.Time
+	for i := 0; i < source.size; i++ {
+		s := source.at(i)
+		if s.Timestamp.Before(rs.folded) || !s.Timestamp.Before(cutoff) {
+			continue
+		}
+		start := s.Timestamp.Truncate(rs.tier.Resolution)
+		if len(bucket) > 0 && !start.Equal(bucketStart) {
+			rs.points.push(rs.aggregate(bucketStart, bucket))
+			bucket = bucket[:0]
+		}
+		bucketStart = start
+		bucket = append(bucket, s)
+	}
+	if len(bucket) > 0 {
+		rs.points.push(rs.aggregate(bucketStart, bucket))
+	}
+	if cutoff.After(rs.folded) {
+		rs.folded = cutoff
+	}
+	rs.points.dropBefore(now.Add(-rs.tier.Retention))
+}
+
+// aggregate summarizes samples of one period, they may be raw samples or finer rollups
+func (rs *rollupSeries) aggregate(start time.Time, samples []Sample) Sample {
+	res := Sample{Timestamp: start}
+	last := samples[len(samples)-1]
+	if last.Delta != nil {
+		var increase int64
+		for _, s := range samples {
+			switch {
+			case s.Increase != nil:
+				increase += *s.Increase
+			case s.Reset:
+				increase += *s.Delta
+			case rs.lastTotal == nil:
+				// nothing is known before the first sample
+			case !rs.monotonic || *s.Delta >= *rs.lastTotal:
+				increase += *s.Delta - *rs.lastTotal
+			default:
+				// counter was reset
+				increase += *s.Delta
+			}
+			total := *s.Delta
+			rs.lastTotal = &total
+			res.Count += sampleCount(s)
+		}
+		total := *last.Delta
+		res.Delta = &total
+		res.Increase = &increase
+		res.Sum = last.Sum
+		return res
+	}
+
+	if last.Value == nil {
+		return res
+	}
+	var sum float64
+	for i, s := range samples {
+		lo, hi := *s.Value, *s.Value
+		if s.Min != nil {
+			lo, hi = *s.Min, *s.Max
+		}
+		if i == 0 || lo < *res.Min {
+			res.Min = &lo
+		}
+		if i == 0 || hi > *res.Max {
+			res.Max = &hi
+		}
+		avg := *s.Value
+		if s.Avg != nil {
+			avg = *s.Avg
+		}
+		sum += avg * float64(sampleCount(s))
+		res.Count += sampleCount(s)
+	}
+	avg := sum / float64(res.Count)
+	value := *last.Value
+	res.Avg = &avg
+	res.Value = &value
+	return res
+}
+
+// sampleCount is how many raw samples s stands for
+func sampleCount(s Sample) int {
+	if s.Count > 0 {
+		return s.Count
+	}
+	return 1
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultSketchAccuracy is the relative accuracy of sketches created from a single observation
+const DefaultSketchAccuracy = 0.01
+
+const (
+	// maxSketchBins limits bins of one sign, it covers values from 1e-9 to 1e9 at 1% accuracy
+	maxSketchBins = 2048
+	// minSketchValue is the smallest magnitude which gets its own bin, smaller values count as zero
+	minSketchValue = 1e-9
+	// maxSketchValue is the largest magnitude which gets its own bin, larger values count in its bin
+	maxSketchValue = 1e9
+)
+
+var ErrSketchAccuracy = fmt.Errorf("sketch accuracy differs from the stored one: %w", ErrIncompatibleMerge)
+
+// Sketch is a DDSketch: values are counted in logarithmic bins so that
+// quantile estimates have relative error of at most Accuracy and sketches merge losslessly
+type Sketch struct {
+	Accuracy float64        `json:"accuracy"`
+	Positive map[int]uint64 `json:"positive,omitempty"`
+	Negative map[int]uint64 `json:"negative,omitempty"`
+	Zero     uint64         `json:"zero,omitempty"`
+	Sum      float64        `json:"sum"`
+	Count    uint64         `json:"count"`
+}
+
+// NewSketch returns an empty sketch with the given relative accuracy
+func NewSketch(accuracy float64) *Sketch {
+	return &Sketch{
+		Accuracy: accuracy,
+		Positive: make(map[int]uint64),
+		Negative: make(map[int]uint64),
+	}
+}
+
+func (s *Sketch) gamma() float64 {
+	return (1 + s.Accuracy) / (1 - s.Accuracy)
+}
+
+func (s *Sketch) index(magnitude float64) int {
+	return int(math.Ceil(math.Log(magnitude) / math.Log(s.gamma())))
+}
+
+// indexRange returns bins of magnitudes from minSketchValue to maxSketchValue
+func (s *Sketch) indexRange() (int, int) {
+	return s.index(minSketchValue), s.index(maxSketchValue)
+}
+
+// binValue is the value every observation of bin i is estimated with
+func (s *Sketch) binValue(i int) float64 {
+	gamma := s.gamma()
+	return 2 * math.Pow(gamma, float64(i)) / (gamma + 1)
+}
+
+// Observe adds value to the sketch
+func (s *Sketch) Observe(value float64) {
+	switch {
+	case value >= minSketchValue:
+		s.Positive[s.index(math.Min(value, maxSketchValue))]++
+	case value <= -minSketchValue:
+		s.Negative[s.index(math.Min(-value, maxSketchValue))]++
+	default:
+		s.Zero++
+	}
+	s.Sum += value
+	s.Count++
+}
+
+// Validate checks accuracy, size, bin indices and consistency of counts
+func (s *Sketch) Validate() error {
+	if !(s.Accuracy > 0 && s.Accuracy < 1) {
+		return errors.New("sketch accuracy should be between 0 and 1")
+	}
+	if len(s.Positive) > maxSketchBins || len(s.Negative) > maxSketchBins {
+		return fmt.Errorf("sketch should have at most %d bins of each sign", maxSketchBins)
+	}
+	lo, hi := s.indexRange()
+	total := s.Zero
+	for _, bins := range []map[int]uint64{s.Positive, s.Negative} {
+		for i, c := range bins {
+			if i < lo || i > hi {
+				return fmt.Errorf("sketch bin %d should be from %d to %d", i, lo, hi)
+			}
+			total += c
+		}
+	}
+	if total != s.Count {
+		return errors.New("sketch count should equal the sum of bin counts")
+	}
+	return nil
+}
+
+// Merge returns a new sketch with observations of both s and other
+func (s *Sketch) Merge(other *Sketch) (*Sketch, error) {
+	if s.Accuracy != other.Accuracy {
+		return nil, ErrSketchAccuracy
+	}
+	res := NewSketch(s.Accuracy)
+	for _, src := range []*Sketch{s, other} {
+		for i, c := range src.Positive {
+			res.Positive[i] += c
+		}
+		for i, c := range src.Negative {
+			res.Negative[i] += c
+		}
+		res.Zero += src.Zero
+		res.Sum += src.Sum
+		res.Count += src.Count
+	}
+	collapseBins(res.Positive)
+	collapseBins(res.Negative)
+	return res, nil
+}
+
+// collapseBins folds the bins of the smallest magnitudes into one so that at most maxSketchBins are left,
+// like DDSketch does: only estimates of the lowest quantiles of a sign lose accuracy
+func collapseBins(bins map[int]uint64) {
+	if len(bins) <= maxSketchBins {
+		return
+	}
+	indices := sortedBins(bins)
+	excess := len(indices) - maxSketchBins
+	into := indices[excess]
+	for _, i := range indices[:excess] {
+		bins[into] += bins[i]
+		delete(bins, i)
+	}
+}
+
+// Quantile estimates the nearest-rank q-quantile within the relative accuracy of the sketch
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.Count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	rank := math.Max(math.Ceil(q*float64(s.Count)), 1)
+	var cumulative uint64
+	negative := sortedBins(s.Negative)
+	for i := len(negative) - 1; i >= 0; i-- {
+		cumulative += s.Negative[negative[i]]
+		if float64(cumulative) >= rank {
+			return -s.binValue(negative[i])
+		}
+	}
+	cumulative += s.Zero
+	if float64(cumulative) >= rank {
+		return 0
+	}
+	positive := sortedBins(s.Positive)
+	for _, i := range positive {
+		cumulative += s.Positive[i]
+		if float64(cumulative) >= rank {
+			return s.binValue(i)
+		}
+	}
+	// counts of a sketch which was not validated may fall short of Count, the largest value is returned then
+	switch {
+	case len(positive) > 0:
+		return s.binValue(positive[len(positive)-1])
+	case s.Zero > 0 || len(negative) == 0:
+		return 0
+	}
+	return -s.binValue(negative[0])
+}
+
+// Stats returns the number and the sum of observations
+func (s *Sketch) Stats() (uint64, float64) {
+	return s.Count, s.Sum
+}
+
+func sortedBins(bins map[int]uint64) []int {
+	res := make([]int, 0, len(bins))
+	for i := range bins {
+		res = append(res, i)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// mergeSummary folds the update of a summary metric into its stored state
+func mergeSummary(tx IMetricStorageTx, metric *Metrics) error {
+	old, exists := tx.Get(metric)
+	update := metric.Summary
+	if update == nil {
+		accuracy := DefaultSketchAccuracy
+		if exists && old.Summary != nil {
+			accuracy = old.Summary.Accuracy
+		}
+		update = NewSketch(accuracy)
+		update.Observe(*metric.Value)
+	}
+	base := NewSketch(update.Accuracy)
+	if exists && old.Summary != nil {
+		base = old.Summary
+	}
+	merged, err := base.Merge(update)
+	if err != nil {
+		return err
+	}
+	metric.Summary = merged
+	metric.Value = nil
+	return tx.Set(*metric)
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestSketchQuantile(t *testing.T) {
+	s := NewSketch(DefaultSketchAccuracy)
+	assert.True(t, math.IsNaN(s.Quantile(0.5)))
+	for i := 1; i <= 1000; i++ {
+		s.Observe(float64(i))
+	}
+	require.NoError(t, s.Validate())
+
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{q: 0, want: 1},
+		{q: 0.5, want: 500},
+		{q: 0.99, want: 990},
+		{q: 1, want: 1000},
+	}
+	for _, tt := range tests {
+		assert.InEpsilon(t, tt.want, s.Quantile(tt.q), DefaultSketchAccuracy, "q=%g", tt.q)
+	}
+
+	mixed := NewSketch(DefaultSketchAccuracy)
+	for _, v := range []float64{-10, -1, 0, 1, 10} {
+		mixed.Observe(v)
+	}
+	assert.InEpsilon(t, -10, mixed.Quantile(0), DefaultSketchAccuracy)
+	assert.Equal(t, 0.0, mixed.Quantile(0.5))
+	assert.InEpsilon(t, 10, mixed.Quantile(1), DefaultSketchAccuracy)
+}
+
+func TestSketchMerge(t *testing.T) {
+	left, right, whole := NewSketch(0.02), NewSketch(0.02), NewSketch(0.02)
+	for i := 1; i <= 100; i++ {
+		whole.Observe(float64(i))
+		if i%2 == 0 {
+			left.Observe(float64(i))
+		} else {
+			right.Observe(float64(i))
+		}
+	}
+	merged, err := left.Merge(right)
+	require.NoError(t, err)
+	assert.Equal(t, whole, merged)
+	assert.Equal(t, uint64(50), left.Count)
+
+	_, err = left.Merge(NewSketch(0.01))
+	assert.ErrorIs(t, err, ErrIncompatibleMerge)
+}
+
+func TestSketchValidate(t *testing.T) {
+	assert.Error(t, (&Sketch{Accuracy: 0}).Validate())
+	assert.Error(t, (&Sketch{Accuracy: 1}).Validate())
+	assert.Error(t, (&Sketch{Accuracy: 0.01, Positive: map[int]uint64{1: 2}, Count: 1}).Validate())
+	assert.NoError(t, (&Sketch{Accuracy: 0.01, Positive: map[int]uint64{1: 2}, Zero: 1, Count: 3}).Validate())
+	// bins beyond maxSketchValue would be estimated as +Inf
+	assert.Error(t, (&Sketch{Accuracy: 0.01, Positive: map[int]uint64{1 << 20: 1}, Count: 1}).Validate())
+	assert.Error(t, (&Sketch{Accuracy: 0.01, Negative: map[int]uint64{-1 << 20: 1}, Count: 1}).Validate())
+
+	huge := NewSketch(0.01)
+	huge.Observe(1e300)
+	require.NoError(t, huge.Validate())
+	assert.InEpsilon(t, maxSketchValue, huge.Quantile(1), 0.01)
+}
+
+func TestSketchMergeKeepsBinLimit(t *testing.T) {
+	lo, hi := NewSketch(0.001).indexRange()
+	left, right := NewSketch(0.001), NewSketch(0.001)
+	for i := 0; i < maxSketchBins; i++ {
+		left.Positive[lo+i]++
+		right.Positive[hi-i]++
+	}
+	left.Count, right.Count = maxSketchBins, maxSketchBins
+	require.NoError(t, left.Validate())
+	require.NoError(t, right.Validate())
+
+	merged, err := left.Merge(right)
+	require.NoError(t, err)
+	require.NoError(t, merged.Validate())
+	assert.Len(t, merged.Positive, maxSketchBins)
+	assert.Equal(t, uint64(2*maxSketchBins), merged.Count)
+	// the highest quantile keeps its accuracy
+	assert.Equal(t, merged.binValue(hi), merged.Quantile(1))
+}
+
+func TestSketchQuantileWithoutPositiveBins(t *testing.T) {
+	for _, s := range []*Sketch{
+		{Accuracy: 0.01, Zero: 1, Count: 2},
+		{Accuracy: 0.01, Negative: map[int]uint64{1: 1}, Count: 2},
+	} {
+		assert.NotPanics(t, func() { s.Quantile(1) })
+	}
+	zeros := NewSketch(0.01)
+	zeros.Observe(0)
+	assert.Equal(t, 0.0, zeros.Quantile(1))
+}
+
+func TestSummaryIsPersisted(t *testing.T) {
+	observed := 120.0
+	metric := &Metrics{ID: "latency", MType: SummaryMetric, Value: &observed}
+
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	saver := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	for i := 0; i < 2; i++ {
+		_, err := saver.Collect(&Metrics{ID: "latency", MType: SummaryMetric, Value: &observed})
+		require.NoError(t, err)
+	}
+	require.NoError(t, saver.Save())
+	restored := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	require.NoError(t, restored.Load())
+	res, ok := restored.Get(metric)
+	require.True(t, ok)
+	assert.Equal(t, uint64(2), res.Summary.Count)
+	assert.InEpsilon(t, observed, res.Summary.Quantile(0.5), DefaultSketchAccuracy)
+
+	repo := NewRepositoryWithStorage(newTestDBStorage(t))
+	_, err := repo.Collect(&Metrics{ID: "latency", MType: SummaryMetric, Value: &observed})
+	require.NoError(t, err)
+	res, ok = repo.Get(metric)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), res.Summary.Count)
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const snapshotFormatVersion = 1
+
+var (
+	ErrSnapshotCorrupted     = errors.New("snapshot is corrupted")
+	ErrSnapshotsNotSupported = errors.New("storage does not keep snapshots")
+)
+
+// Snapshot is the content of a metrics file
+type Snapshot struct {
+	Version   int
+	Timestamp time.Time
+	Metrics   []Metrics
+}
+
+// snapshotFile is the on-disk format, checksum is calculated over raw metrics bytes
+type snapshotFile struct {
+	Version   int             `json:"version"`
+	Timestamp time.Time       `json:"timestamp"`
+	Checksum  string          `json:"checksum"`
+	Metrics   json.RawMessage `json:"metrics"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeSnapshot writes metrics to a temporary file next to path, syncs it and renames it over path,
+// so a crash leaves either the previous or the new snapshot but never a partial one
+func writeSnapshot(path string, metrics []Metrics) error {
+	if metrics == nil {
+		metrics = []Metrics{}
+	}
+	raw, err := json.Marshal(storedMetrics(metrics))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshotFile{
+		Version:   snapshotFormatVersion,
+		Timestamp: time.Now().UTC(),
+		Checksum:  checksum(raw),
+		Metrics:   raw,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces path with data so that readers see either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			logger.Log.Error("problems with removing temporary file", zap.Error(err))
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func(d *os.File) {
+		if err := d.Close(); err != nil {
+			logger.Log.Error("problems with closing dir", zap.Error(err))
+		}
+	}(d)
+	return d.Sync()
+}
+
+// readSnapshot reads and verifies a snapshot.
+// Files written before versioning (a bare JSON array) are read as version 0
+func readSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var metrics storedMetrics
+		if err = json.Unmarshal(data, &metrics); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrSnapshotCorrupted, path, err)
+		}
+		return &Snapshot{Metrics: metrics}, nil
+	}
+
+	var file snapshotFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrSnapshotCorrupted, path, err)
+	}
+	if file.Version != snapshotFormatVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d in %s", file.Version, path)
+	}
+	if checksum(file.Metrics) != file.Checksum {
+		return nil, fmt.Errorf("%w: %s: checksum mismatch", ErrSnapshotCorrupted, path)
+	}
+	var metrics storedMetrics
+	if err = json.Unmarshal(file.Metrics, &metrics); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrSnapshotCorrupted, path, err)
+	}
+	return &Snapshot{Version: file.Version, Timestamp: file.Timestamp, Metrics: metrics}, nil
+}
+
+const (
+	// LatestSnapshot restores the newest snapshot that passes verification
+	LatestSnapshot     = "latest"
+	snapshotTimeLayout = "20060102T150405.000000000Z"
+)
+
+// SnapshotInfo describes a snapshot kept in history
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int64     `json:"size"`
+	Metrics   int       `json:"metrics"`
+	Valid     bool      `json:"valid"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ISnapshotLister is implemented by savers that keep snapshot history
+type ISnapshotLister interface {
+	Snapshots() ([]SnapshotInfo, error)
+}
+
+func historyPath(base string, ts time.Time) string {
+	return base + "." + ts.UTC().Format(snapshotTimeLayout)
+}
+
+// listHistory returns paths of timestamped snapshots of base, newest first
+func listHistory(base string) ([]string, error) {
+	dir, prefix := filepath.Dir(base), filepath.Base(base)+"."
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(snapshotTimeLayout, strings.TrimPrefix(name, prefix)); err == nil {
+			res = append(res, filepath.Join(dir, name))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(res)))
+	return res, nil
+}
+
+// pruneHistory removes all but keep newest snapshots of base
+func pruneHistory(base string, keep int) error {
+	paths, err := listHistory(base)
+	if err != nil {
+		return err
+	}
+	for len(paths) > keep {
+		if err = os.Remove(paths[len(paths)-1]); err != nil {
+			return err
+		}
+		paths = paths[:len(paths)-1]
+	}
+	return nil
+}
+
+func describeSnapshot(path string) SnapshotInfo {
+	info := SnapshotInfo{Name: filepath.Base(path)}
+	if stat, err := os.Stat(path); err == nil {
+		info.Size = stat.Size()
+	}
+	snapshot, err := readSnapshot(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Valid = true
+	info.Timestamp = snapshot.Timestamp
+	info.Metrics = len(snapshot.Metrics)
+	return info
+}
+
+// readRestorePoint reads the snapshot selected by restoreFrom and returns its path:
+// the current file when empty, the newest valid one for LatestSnapshot or a history snapshot by name
+func readRestorePoint(base, restoreFrom string) (*Snapshot, string, error) {
+	switch restoreFrom {
+	case "":
+		snapshot, err := readSnapshot(base)
+		return snapshot, base, err
+	case LatestSnapshot:
+		history, err := listHistory(base)
+		if err != nil {
+			return nil, "", err
+		}
+		candidates := append([]string{base}, history...)
+		found := false
+		for _, path := range candidates {
+			snapshot, err := readSnapshot(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			found = true
+			if err != nil {
+				logger.Log.Warn("skipping invalid snapshot", zap.Error(err))
+				continue
+			}
+			return snapshot, path, nil
+		}
+		if !found {
+			return nil, "", os.ErrNotExist
+		}
+		return nil, "", fmt.Errorf("%w: no valid snapshot of %s", ErrSnapshotCorrupted, base)
+	default:
+		history, err := listHistory(base)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, path := range history {
+			if filepath.Base(path) == restoreFrom {
+				snapshot, err := readSnapshot(path)
+				return snapshot, path, err
+			}
+		}
+		return nil, "", fmt.Errorf("snapshot %q not found", restoreFrom)
+	}
+}
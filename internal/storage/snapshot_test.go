@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"github.com/rkinwork/musthave-metrics/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONFileSaverSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	js := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	_, err := js.Collect(NewCounterMetrics("clicks", 3))
+	require.NoError(t, err)
+	_, err = js.Collect(NewGaugeMetrics("load", 0.5))
+	require.NoError(t, err)
+	require.NoError(t, js.Save())
+
+	// shorter snapshot must not leave a tail of the previous one
+	require.NoError(t, js.Delete(&Metrics{ID: "load", MType: GaugeMetric}))
+	require.NoError(t, js.Save())
+
+	snapshot, err := readSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, snapshotFormatVersion, snapshot.Version)
+	assert.False(t, snapshot.Timestamp.IsZero())
+	require.Len(t, snapshot.Metrics, 1)
+
+	restored := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	require.NoError(t, restored.Load())
+	metric, ok := restored.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(3), *metric.Delta)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files must be cleaned up")
+}
+
+func TestMetricsSaverRotatesHistoryOnlyPeriodically(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	js := &JSONFileSaver{FilePath: path, SnapshotHistory: 5, IMetricRepository: NewRepository()}
+	saver := NewMetricsSaver(&config.Config{}, js)
+	require.NoError(t, saver.Start())
+	for i := 0; i < 3; i++ {
+		_, err := saver.Collect(NewCounterMetrics("clicks", 1))
+		require.NoError(t, err)
+	}
+	snapshots, err := saver.Snapshots()
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 1, "saves after each update do not add history")
+
+	saver.Stop()
+	snapshots, err = saver.Snapshots()
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 2, "the final save adds history")
+}
+
+func TestReadSnapshotCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, writeSnapshot(path, []Metrics{*NewCounterMetrics("clicks", 3)}))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	tampered := strings.Replace(string(data), `"delta":3`, `"delta":4`, 1)
+	require.NoError(t, os.WriteFile(path, []byte(tampered), 0666))
+	_, err = readSnapshot(path)
+	assert.ErrorIs(t, err, ErrSnapshotCorrupted)
+
+	require.NoError(t, os.WriteFile(path, data[:len(data)/2], 0666))
+	js := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	assert.ErrorIs(t, js.Load(), ErrSnapshotCorrupted)
+}
+
+func TestReadSnapshotLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"id":"clicks","type":"counter","delta":3}]`), 0666))
+	snapshot, err := readSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, 0, snapshot.Version)
+	require.Len(t, snapshot.Metrics, 1)
+	assert.Equal(t, int64(3), *snapshot.Metrics[0].Delta)
+}
+
+func TestSnapshotHistory(t *testing.T) {
+	// glob metacharacters in the directory must not break listing history
+	dir := filepath.Join(t.TempDir(), "run[1]*?")
+	require.NoError(t, os.Mkdir(dir, 0777))
+	path := filepath.Join(dir, "metrics.json")
+	js := &JSONFileSaver{FilePath: path, SnapshotHistory: 2, IMetricRepository: NewRepository()}
+	for i := 0; i < 3; i++ {
+		_, err := js.Collect(NewCounterMetrics("clicks", 1))
+		require.NoError(t, err)
+		require.NoError(t, js.SaveHistory())
+	}
+	snapshots, err := js.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 3, "current snapshot and two history ones")
+	assert.Equal(t, "metrics.json", snapshots[0].Name)
+	for _, info := range snapshots {
+		assert.True(t, info.Valid)
+	}
+	assert.True(t, snapshots[1].Timestamp.After(snapshots[2].Timestamp))
+
+	restored := &JSONFileSaver{FilePath: path, RestoreFrom: snapshots[2].Name, IMetricRepository: NewRepository()}
+	require.NoError(t, restored.Load())
+	metric, ok := restored.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(2), *metric.Delta)
+
+	// corrupted current snapshot is skipped in favour of the newest valid one
+	require.NoError(t, os.WriteFile(path, []byte(`{"version":1`), 0666))
+	restored = &JSONFileSaver{FilePath: path, RestoreFrom: LatestSnapshot, IMetricRepository: NewRepository()}
+	require.NoError(t, restored.Load())
+	metric, ok = restored.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(3), *metric.Delta)
+
+	restored = &JSONFileSaver{FilePath: path, RestoreFrom: "unknown", IMetricRepository: NewRepository()}
+	assert.ErrorContains(t, restored.Load(), `snapshot "unknown" not found`)
+}
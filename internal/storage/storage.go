@@ -1,52 +1,273 @@
 package storage
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type IMetricStorage interface {
 	Get(m *Metrics) (Metrics, bool)
 	Set(m Metrics) error
+	// Delete removes the metric. If m.UpdatedAt is set the metric is removed only when it was not updated
+	// after that time, ErrMetricUpdated is returned otherwise
 	Delete(m *Metrics) error
 	IterMetrics() []Metrics
+	// Tx runs fn against a consistent view of the storage.
+	// Changes made through tx are applied only if fn returns nil, otherwise they are discarded
+	Tx(fn func(tx IMetricStorageTx) error) error
+}
+
+// IMetricStorageTx is the view of the storage available inside a transaction
+type IMetricStorageTx interface {
+	Get(m *Metrics) (Metrics, bool)
+	Set(m Metrics) error
+	// Increment adds the delta of a counter to the stored one and returns the result
+	Increment(m Metrics) (Metrics, error)
+}
+
+// IScopedTxStorage is implemented by storages which can run a transaction
+// isolating only the given metrics, fn must not touch other metrics
+type IScopedTxStorage interface {
+	TxOn(scope []Metrics, fn func(tx IMetricStorageTx) error) error
+}
+
+// ICounterAdder is implemented by storages with a fast path for counter increments outside of transactions
+type ICounterAdder interface {
+	Add(m Metrics) (Metrics, error)
 }
 
 // In-memory storage
 
+const defaultShards = 32
+
+// memEntry is a stored metric, counters keep delta and update time in atomics
+// so that increments of existing counters need only a read lock of their shard
+type memEntry struct {
+	metric    Metrics
+	counter   bool
+	delta     atomic.Int64
+	updatedAt atomic.Int64
+}
+
+func newMemEntry(m Metrics) *memEntry {
+	e := &memEntry{metric: m, counter: m.Delta != nil && (m.MType == CounterMetric || m.MType == UpDownCounterMetric)}
+	if e.counter {
+		e.delta.Store(*m.Delta)
+		e.metric.Delta = nil
+		if m.UpdatedAt != nil {
+			e.updatedAt.Store(m.UpdatedAt.UnixNano())
+		}
+		e.metric.UpdatedAt = nil
+	}
+	return e
+}
+
+func (e *memEntry) load() Metrics {
+	res := e.metric
+	if e.counter {
+		delta := e.delta.Load()
+		res.Delta = &delta
+		if ns := e.updatedAt.Load(); ns != 0 {
+			ts := time.Unix(0, ns)
+			res.UpdatedAt = &ts
+		}
+	}
+	return res
+}
+
+func (e *memEntry) add(m Metrics) Metrics {
+	e.delta.Add(*m.Delta)
+	if m.UpdatedAt != nil {
+		e.updatedAt.Store(m.UpdatedAt.UnixNano())
+	}
+	return e.load()
+}
+
+type memShard struct {
+	sync.RWMutex
+	metrics map[MetricHash]*memEntry
+}
+
+// InMemMetricStorage spreads metrics over shards by hash, every shard has its own lock
 type InMemMetricStorage struct {
-	m map[MetricHash]Metrics
-	sync.Mutex
+	shards []*memShard
+}
+
+// shardIndex hashes with FNV-1a inline to avoid allocating a hasher per call
+func (i *InMemMetricStorage) shardIndex(hash MetricHash) int {
+	const offset32, prime32 = 2166136261, 16777619
+	h := uint32(offset32)
+	for idx := 0; idx < len(hash); idx++ {
+		h ^= uint32(hash[idx])
+		h *= prime32
+	}
+	return int(h % uint32(len(i.shards)))
+}
+
+func (i *InMemMetricStorage) shard(hash MetricHash) *memShard {
+	return i.shards[i.shardIndex(hash)]
 }
 
 func (i *InMemMetricStorage) Get(m *Metrics) (Metrics, bool) {
-	res, ok := i.m[m.GetHash()]
-	return res, ok
+	hash := m.GetHash()
+	shard := i.shard(hash)
+	shard.RLock()
+	defer shard.RUnlock()
+	if e, ok := shard.metrics[hash]; ok {
+		return e.load(), true
+	}
+	return Metrics{}, false
 }
 
 func (i *InMemMetricStorage) Set(m Metrics) error {
-	i.Lock()
-	i.m[m.GetHash()] = m
-	i.Unlock()
+	hash := m.GetHash()
+	shard := i.shard(hash)
+	shard.Lock()
+	shard.metrics[hash] = newMemEntry(m)
+	shard.Unlock()
 	return nil
 }
 
 func (i *InMemMetricStorage) Delete(m *Metrics) error {
-	i.Lock()
-	delete(i.m, m.GetHash())
-	i.Unlock()
+	hash := m.GetHash()
+	shard := i.shard(hash)
+	shard.Lock()
+	defer shard.Unlock()
+	if e, ok := shard.metrics[hash]; ok && m.UpdatedAt != nil {
+		if stored := e.load(); stored.UpdatedAt != nil && stored.UpdatedAt.After(*m.UpdatedAt) {
+			return ErrMetricUpdated
+		}
+	}
+	delete(shard.metrics, hash)
 	return nil
 }
 
 func (i *InMemMetricStorage) IterMetrics() []Metrics {
 	var res []Metrics
-	for _, metric := range i.m {
-		res = append(res, metric)
+	for _, shard := range i.shards {
+		shard.RLock()
+		for _, e := range shard.metrics {
+			res = append(res, e.load())
+		}
+		shard.RUnlock()
 	}
 	return res
 }
 
-func NewInMemMetricStorage() *InMemMetricStorage {
-	imms := &InMemMetricStorage{
-		m: make(map[MetricHash]Metrics),
+// Add increments an existing counter under the read lock of its shard, new counters take the write lock
+func (i *InMemMetricStorage) Add(m Metrics) (Metrics, error) {
+	hash := m.GetHash()
+	shard := i.shard(hash)
+	shard.RLock()
+	if e, ok := shard.metrics[hash]; ok && e.counter {
+		res := e.add(m)
+		shard.RUnlock()
+		return res, nil
+	}
+	shard.RUnlock()
+
+	shard.Lock()
+	defer shard.Unlock()
+	if e, ok := shard.metrics[hash]; ok && e.counter {
+		return e.add(m), nil
+	}
+	e := newMemEntry(m)
+	shard.metrics[hash] = e
+	return e.load(), nil
+}
+
+func (i *InMemMetricStorage) Tx(fn func(tx IMetricStorageTx) error) error {
+	all := make([]int, len(i.shards))
+	for idx := range all {
+		all[idx] = idx
+	}
+	return i.txOnShards(all, fn)
+}
+
+// TxOn locks only shards of metrics in scope, so transactions on different metrics run in parallel
+func (i *InMemMetricStorage) TxOn(scope []Metrics, fn func(tx IMetricStorageTx) error) error {
+	seen := make(map[int]bool, len(scope))
+	var indexes []int
+	for idx := range scope {
+		shardIdx := i.shardIndex(scope[idx].GetHash())
+		if !seen[shardIdx] {
+			seen[shardIdx] = true
+			indexes = append(indexes, shardIdx)
+		}
+	}
+	// shards are always locked in the same order to avoid deadlocks
+	sort.Ints(indexes)
+	return i.txOnShards(indexes, fn)
+}
+
+func (i *InMemMetricStorage) txOnShards(indexes []int, fn func(tx IMetricStorageTx) error) error {
+	for _, idx := range indexes {
+		i.shards[idx].Lock()
+	}
+	defer func() {
+		for _, idx := range indexes {
+			i.shards[idx].Unlock()
+		}
+	}()
+	tx := &inMemTx{
+		storage: i,
+		staged:  make(map[MetricHash]Metrics),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for hash, metric := range tx.staged {
+		i.shard(hash).metrics[hash] = newMemEntry(metric)
+	}
+	return nil
+}
+
+// inMemTx keeps changes of a transaction aside until it is committed
+type inMemTx struct {
+	storage *InMemMetricStorage
+	staged  map[MetricHash]Metrics
+}
+
+func (t *inMemTx) Get(m *Metrics) (Metrics, bool) {
+	hash := m.GetHash()
+	if res, ok := t.staged[hash]; ok {
+		return res, ok
+	}
+	if e, ok := t.storage.shard(hash).metrics[hash]; ok {
+		return e.load(), true
+	}
+	return Metrics{}, false
+}
+
+func (t *inMemTx) Set(m Metrics) error {
+	t.staged[m.GetHash()] = m
+	return nil
+}
+
+func (t *inMemTx) Increment(m Metrics) (Metrics, error) {
+	delta := *m.Delta
+	if old, ok := t.Get(&m); ok {
+		delta += *old.Delta
+		m.ResetAt = old.ResetAt
 	}
+	m.Delta = &delta
+	return m, t.Set(m)
+}
+
+func NewInMemMetricStorage() *InMemMetricStorage {
+	return NewShardedInMemMetricStorage(defaultShards)
+}
 
+// NewShardedInMemMetricStorage spreads metrics over the given number of shards, one shard means a single lock
+func NewShardedInMemMetricStorage(shards int) *InMemMetricStorage {
+	if shards < 1 {
+		shards = 1
+	}
+	imms := &InMemMetricStorage{shards: make([]*memShard, shards)}
+	for idx := range imms.shards {
+		imms.shards[idx] = &memShard{metrics: make(map[MetricHash]*memEntry)}
+	}
 	return imms
 }
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// benchmarkShards compares a single lock with the default sharding
+var benchmarkShards = []int{1, defaultShards}
+
+const benchmarkSeries = 1000
+
+func benchmarkRepository(b *testing.B, shards int) IMetricRepository {
+	repo := NewRepositoryWithStorage(NewShardedInMemMetricStorage(shards))
+	for i := 0; i < benchmarkSeries; i++ {
+		if _, err := repo.Collect(NewCounterMetrics(fmt.Sprintf("counter%d", i), 1)); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := repo.Collect(NewGaugeMetrics(fmt.Sprintf("gauge%d", i), 1)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func runParallel(b *testing.B, fn func(repo IMetricRepository, i int) error) {
+	for _, shards := range benchmarkShards {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			repo := benchmarkRepository(b, shards)
+			var seq atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := fn(repo, int(seq.Add(1)%benchmarkSeries)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCollectCounter(b *testing.B) {
+	runParallel(b, func(repo IMetricRepository, i int) error {
+		_, err := repo.Collect(NewCounterMetrics(fmt.Sprintf("counter%d", i), 1))
+		return err
+	})
+}
+
+func BenchmarkCollectGauge(b *testing.B) {
+	runParallel(b, func(repo IMetricRepository, i int) error {
+		_, err := repo.Collect(NewGaugeMetrics(fmt.Sprintf("gauge%d", i), float64(i)))
+		return err
+	})
+}
+
+func BenchmarkCollectBatch(b *testing.B) {
+	runParallel(b, func(repo IMetricRepository, i int) error {
+		_, err := repo.CollectBatch([]Metrics{
+			*NewCounterMetrics(fmt.Sprintf("counter%d", i), 1),
+			*NewGaugeMetrics(fmt.Sprintf("gauge%d", i), float64(i)),
+		})
+		return err
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	runParallel(b, func(repo IMetricRepository, i int) error {
+		if _, ok := repo.Get(&Metrics{ID: fmt.Sprintf("gauge%d", i), MType: GaugeMetric}); !ok {
+			return ErrMetricNotFound
+		}
+		return nil
+	})
+}
+
+func BenchmarkMixedReadWrite(b *testing.B) {
+	runParallel(b, func(repo IMetricRepository, i int) error {
+		if i%10 == 0 {
+			repo.GetAllMetrics()
+			return nil
+		}
+		_, err := repo.Collect(NewCounterMetrics(fmt.Sprintf("counter%d", i), 1))
+		return err
+	})
+}
@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"sync"
 	"testing"
+	"time"
 )
 
 func NewCounterMetrics(id string, delta int64) *Metrics {
@@ -102,3 +105,218 @@ func TestGetFromRepository(t *testing.T) {
 		})
 	}
 }
+
+func TestCollectBatchIsAtomic(t *testing.T) {
+	repo := NewRepository()
+	_, err := repo.Collect(NewCounterMetrics("clicks", 10))
+	require.NoError(t, err)
+
+	_, err = repo.CollectBatch([]Metrics{
+		*NewCounterMetrics("clicks", 5),
+		*NewGaugeMetrics("load", 0.5),
+		*NewCounterMetrics("clicks", -1),
+	})
+	var itemErr *BatchItemError
+	require.ErrorAs(t, err, &itemErr)
+	assert.Equal(t, 2, itemErr.Index)
+
+	metric, ok := repo.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(10), *metric.Delta)
+	_, ok = repo.Get(&Metrics{ID: "load", MType: GaugeMetric})
+	assert.False(t, ok)
+
+	res, err := repo.CollectBatch([]Metrics{
+		*NewCounterMetrics("clicks", 5),
+		*NewCounterMetrics("clicks", 5),
+		*NewGaugeMetrics("load", 0.5),
+	})
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	assert.Equal(t, int64(15), *res[0].Delta)
+	assert.Equal(t, int64(20), *res[1].Delta)
+	metric, ok = repo.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(20), *metric.Delta)
+}
+
+func TestSetBatchIsAtomic(t *testing.T) {
+	registry := NewTypeRegistry()
+	repo := NewTypeGuard(NewRepository(), registry)
+	_, err := repo.Collect(NewCounterMetrics("clicks", 10))
+	require.NoError(t, err)
+
+	_, err = repo.SetBatch([]Metrics{
+		*NewGaugeMetrics("load", 0.5),
+		*NewGaugeMetrics("clicks", 1),
+	})
+	var itemErr *BatchItemError
+	require.ErrorAs(t, err, &itemErr)
+	assert.Equal(t, 1, itemErr.Index)
+	assert.ErrorIs(t, err, ErrTypeConflict)
+	_, ok := repo.Get(&Metrics{ID: "load", MType: GaugeMetric})
+	assert.False(t, ok)
+
+	res, err := repo.SetBatch([]Metrics{
+		*NewCounterMetrics("clicks", 3),
+		*NewGaugeMetrics("load", 0.5),
+	})
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	metric, ok := repo.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(3), *metric.Delta)
+	_, ok = repo.Get(&Metrics{ID: "load", MType: GaugeMetric})
+	assert.True(t, ok)
+}
+
+func TestLabels(t *testing.T) {
+	repo := NewRepository()
+	web := NewGaugeMetrics("HeapAlloc", 1)
+	web.Labels = map[string]string{"host": "web01", "service": "api"}
+	db := NewGaugeMetrics("HeapAlloc", 2)
+	db.Labels = map[string]string{"host": "db01"}
+	for _, m := range []*Metrics{web, db, NewGaugeMetrics("HeapAlloc", 3)} {
+		require.NoError(t, ValidateMetric(m))
+		_, err := repo.Collect(m)
+		require.NoError(t, err)
+	}
+	assert.Len(t, repo.GetAllMetrics(), 3)
+
+	metric, ok := repo.Get(&Metrics{ID: "HeapAlloc", MType: GaugeMetric, Labels: map[string]string{"service": "api", "host": "web01"}})
+	require.True(t, ok)
+	assert.Equal(t, 1.0, *metric.Value)
+	assert.True(t, metric.HasLabels(map[string]string{"host": "web01"}))
+	assert.False(t, metric.HasLabels(map[string]string{"host": "db01"}))
+	assert.Equal(t, `HeapAlloc{host="web01",service="api"} gauge 1`, metric.String())
+	_, ok = repo.Get(&Metrics{ID: "HeapAlloc", MType: GaugeMetric, Labels: map[string]string{"host": "web01"}})
+	assert.False(t, ok)
+
+	assert.Error(t, ValidateLabels(map[string]string{"1host": "web01"}))
+	assert.Error(t, ValidateLabels(map[string]string{"host": ""}))
+	assert.Error(t, ValidateLabels(map[string]string{"__name__": "web01"}))
+
+	// labels added by exposition formats are reserved for their types
+	observed := 0.5
+	histogram := &Metrics{ID: "latency", MType: HistogramMetric, Value: &observed, Labels: map[string]string{"le": "1"}}
+	assert.ErrorContains(t, ValidateMetric(histogram), `label "le" is reserved`)
+	summary := &Metrics{ID: "latency", MType: SummaryMetric, Value: &observed, Labels: map[string]string{"quantile": "0.5"}}
+	assert.ErrorContains(t, ValidateMetric(summary), `label "quantile" is reserved`)
+	gauge := NewGaugeMetrics("ratio", 1)
+	gauge.Labels = map[string]string{"quantile": "0.5"}
+	assert.NoError(t, ValidateMetric(gauge))
+}
+
+func TestUpDownCounterAndReset(t *testing.T) {
+	tests := []struct {
+		name string
+		repo func(t *testing.T) IMetricRepository
+	}{
+		{name: "memory", repo: func(t *testing.T) IMetricRepository { return NewRepository() }},
+		{name: "database", repo: func(t *testing.T) IMetricRepository { return NewRepositoryWithStorage(newTestDBStorage(t)) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tt.repo(t)
+			for _, delta := range []int64{5, -8} {
+				d := delta
+				metric := &Metrics{ID: "queue", MType: UpDownCounterMetric, Delta: &d}
+				require.NoError(t, ValidateMetric(metric))
+				_, err := repo.Collect(metric)
+				require.NoError(t, err)
+			}
+			queue := &Metrics{ID: "queue", MType: UpDownCounterMetric}
+			metric, ok := repo.Get(queue)
+			require.True(t, ok)
+			assert.Equal(t, int64(-3), *metric.Delta)
+			assert.Nil(t, metric.ResetAt)
+
+			res, err := repo.Reset(queue)
+			require.NoError(t, err)
+			assert.Equal(t, int64(0), *res.Delta)
+			require.NotNil(t, res.ResetAt)
+
+			// the reset time survives later updates
+			res, err = repo.Collect(&Metrics{ID: "queue", MType: UpDownCounterMetric, Delta: res.Delta})
+			require.NoError(t, err)
+			require.NotNil(t, res.ResetAt)
+			metric, ok = repo.Get(queue)
+			require.True(t, ok)
+			assert.True(t, res.ResetAt.Equal(*metric.ResetAt))
+
+			_, err = repo.Reset(&Metrics{ID: "absent", MType: CounterMetric})
+			assert.ErrorIs(t, err, ErrMetricNotFound)
+			_, err = repo.Reset(NewGaugeMetrics("load", 1))
+			assert.ErrorIs(t, err, ErrNotResettable)
+		})
+	}
+}
+
+func TestConcurrentCollect(t *testing.T) {
+	const workers, updates = 8, 200
+	for _, shards := range []int{1, defaultShards} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			repo := NewRepositoryWithStorage(NewShardedInMemMetricStorage(shards))
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < updates; i++ {
+						_, err := repo.Collect(NewCounterMetrics("requests", 1))
+						assert.NoError(t, err)
+						_, err = repo.Collect(NewGaugeMetrics(fmt.Sprintf("load%d", w), float64(i)))
+						assert.NoError(t, err)
+						_, err = repo.CollectBatch([]Metrics{*NewCounterMetrics("batched", 1), *NewCounterMetrics("requests", 1)})
+						assert.NoError(t, err)
+						queue := NewGaugeMetrics("queue", 0.5)
+						queue.Relative = true
+						_, err = repo.Collect(queue)
+						assert.NoError(t, err)
+						repo.Get(&Metrics{ID: "requests", MType: CounterMetric})
+						repo.GetAllMetrics()
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			metric, ok := repo.Get(&Metrics{ID: "requests", MType: CounterMetric})
+			require.True(t, ok)
+			assert.Equal(t, int64(2*workers*updates), *metric.Delta)
+			metric, ok = repo.Get(&Metrics{ID: "batched", MType: CounterMetric})
+			require.True(t, ok)
+			assert.Equal(t, int64(workers*updates), *metric.Delta)
+			// relative gauges are added to the stored value without losing concurrent changes
+			metric, ok = repo.Get(&Metrics{ID: "queue", MType: GaugeMetric})
+			require.True(t, ok)
+			assert.Equal(t, 0.5*workers*updates, *metric.Value)
+			assert.False(t, metric.Relative)
+			assert.Len(t, repo.GetAllMetrics(), workers+3)
+		})
+	}
+}
+
+func TestConditionalDelete(t *testing.T) {
+	storages := map[string]func(t *testing.T) IMetricStorage{
+		"memory": func(t *testing.T) IMetricStorage { return NewInMemMetricStorage() },
+		"db":     func(t *testing.T) IMetricStorage { return newTestDBStorage(t) },
+	}
+	for name, newStorage := range storages {
+		t.Run(name, func(t *testing.T) {
+			repo := NewRepositoryWithStorage(newStorage(t))
+			updated, err := repo.Collect(NewCounterMetrics("clicks", 1))
+			require.NoError(t, err)
+			before := updated.UpdatedAt.Add(-time.Second)
+
+			assert.ErrorIs(t, repo.Delete(&Metrics{ID: "clicks", MType: CounterMetric, UpdatedAt: &before}), ErrMetricUpdated)
+			_, ok := repo.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+			assert.True(t, ok)
+
+			now := time.Now()
+			require.NoError(t, repo.Delete(&Metrics{ID: "clicks", MType: CounterMetric, UpdatedAt: &now}))
+			_, ok = repo.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+			assert.False(t, ok)
+			require.NoError(t, repo.Delete(&Metrics{ID: "clicks", MType: CounterMetric, UpdatedAt: &now}))
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"go.uber.org/zap"
+	"path"
+	"strings"
+	"time"
+)
+
+const defaultSweepInterval = 10 * time.Second
+
+// TTLRule sets TTL for metrics whose name matches Pattern, see path.Match for the syntax
+type TTLRule struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// TTLPolicy tells how long a metric may stay without updates.
+// The first matching rule wins, Default is used otherwise. Zero TTL means forever
+type TTLPolicy struct {
+	Default time.Duration
+	Rules   []TTLRule
+}
+
+// ParseTTLRules parses comma separated pattern:ttl pairs like "Heap*:10m,RandomValue:0s"
+func ParseTTLRules(value string) ([]TTLRule, error) {
+	var res []TTLRule
+	if strings.TrimSpace(value) == "" {
+		return res, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		pattern, ttl, found := strings.Cut(strings.TrimSpace(part), ":")
+		if !found {
+			return nil, fmt.Errorf("ttl rule %q should look like pattern:ttl", part)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("ttl rule %q: %w", part, err)
+		}
+		rule := TTLRule{Pattern: pattern}
+		var err error
+		if rule.TTL, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("ttl rule %q: %w", part, err)
+		}
+		if rule.TTL < 0 {
+			return nil, fmt.Errorf("ttl rule %q: ttl should not be negative", part)
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+// TTLFor returns TTL of the metric named id
+func (p TTLPolicy) TTLFor(id string) time.Duration {
+	for _, rule := range p.Rules {
+		if ok, _ := path.Match(rule.Pattern, id); ok {
+			return rule.TTL
+		}
+	}
+	return p.Default
+}
+
+// Enabled reports if any metric may expire
+func (p TTLPolicy) Enabled() bool {
+	if p.Default > 0 {
+		return true
+	}
+	for _, rule := range p.Rules {
+		if rule.TTL > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports if metric was not updated for its TTL by now
+func (p TTLPolicy) Expired(metric *Metrics, now time.Time) bool {
+	ttl := p.TTLFor(metric.ID)
+	if ttl <= 0 || metric.UpdatedAt == nil {
+		return false
+	}
+	return now.Sub(*metric.UpdatedAt) > ttl
+}
+
+// TTLSweeper evicts metrics which were not updated for their TTL
+type TTLSweeper struct {
+	repository IMetricRepository
+	policy     TTLPolicy
+	interval   time.Duration
+}
+
+// Sweep deletes expired metrics and returns them
+func (s *TTLSweeper) Sweep(now time.Time) []Metrics {
+	var evicted []Metrics
+	for _, metric := range s.repository.GetAllMetrics() {
+		if !s.policy.Expired(&metric, now) {
+			continue
+		}
+		// the delete is conditional on UpdatedAt, so a metric updated after listing stays
+		err := s.repository.Delete(&metric)
+		if errors.Is(err, ErrMetricUpdated) {
+			continue
+		}
+		if err != nil {
+			logger.Log.Error("problems with evicting metric", zap.String("id", metric.ID), zap.Error(err))
+			continue
+		}
+		evicted = append(evicted, metric)
+	}
+	if len(evicted) > 0 {
+		logger.Log.Info("evicted stale metrics", zap.Int("count", len(evicted)))
+	}
+	return evicted
+}
+
+// Start runs sweeps until ctx is done
+func (s *TTLSweeper) Start(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.Sweep(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func NewTTLSweeper(repository IMetricRepository, policy TTLPolicy) *TTLSweeper {
+	return &TTLSweeper{
+		repository: repository,
+		policy:     policy,
+		interval:   defaultSweepInterval,
+	}
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	rules, err := ParseTTLRules("Heap*:1m,RandomValue:0s")
+	require.NoError(t, err)
+	policy := TTLPolicy{Default: time.Hour, Rules: rules}
+	assert.Equal(t, time.Minute, policy.TTLFor("HeapAlloc"))
+	assert.Equal(t, time.Duration(0), policy.TTLFor("RandomValue"))
+	assert.Equal(t, time.Hour, policy.TTLFor("Alloc"))
+	assert.True(t, policy.Enabled())
+	assert.False(t, TTLPolicy{}.Enabled())
+
+	_, err = ParseTTLRules("Heap*")
+	assert.Error(t, err)
+	_, err = ParseTTLRules("[:1m")
+	assert.Error(t, err)
+	_, err = ParseTTLRules("Heap*:-1m")
+	assert.Error(t, err)
+}
+
+func TestTTLSweeper(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	saver := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	for _, m := range []*Metrics{NewGaugeMetrics("HeapAlloc", 1), NewGaugeMetrics("RandomValue", 1), NewCounterMetrics("PollCount", 1)} {
+		_, err := saver.Collect(m)
+		require.NoError(t, err)
+	}
+	rules, err := ParseTTLRules("Heap*:1m,RandomValue:0s")
+	require.NoError(t, err)
+	sweeper := NewTTLSweeper(saver, TTLPolicy{Default: time.Hour, Rules: rules})
+
+	assert.Empty(t, sweeper.Sweep(time.Now()))
+	evicted := sweeper.Sweep(time.Now().Add(2 * time.Minute))
+	require.Len(t, evicted, 1)
+	assert.Equal(t, "HeapAlloc", evicted[0].ID)
+	evicted = sweeper.Sweep(time.Now().Add(2 * time.Hour))
+	require.Len(t, evicted, 1)
+	assert.Equal(t, "PollCount", evicted[0].ID)
+
+	// update time survives snapshots, so restored metrics keep expiring
+	require.NoError(t, saver.Save())
+	restored := &JSONFileSaver{FilePath: path, IMetricRepository: NewRepository()}
+	require.NoError(t, restored.Load())
+	metrics := restored.GetAllMetrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "RandomValue", metrics[0].ID)
+	require.NotNil(t, metrics[0].UpdatedAt)
+	original, _ := saver.Get(&Metrics{ID: "RandomValue", MType: GaugeMetric})
+	assert.True(t, original.UpdatedAt.Equal(*metrics[0].UpdatedAt))
+}
+
+// updatingRepository updates a metric right after listing, like a concurrent client would
+type updatingRepository struct {
+	IMetricRepository
+	update *Metrics
+}
+
+func (r *updatingRepository) GetAllMetrics() []Metrics {
+	res := r.IMetricRepository.GetAllMetrics()
+	if _, err := r.Collect(r.update); err != nil {
+		panic(err)
+	}
+	return res
+}
+
+func TestTTLSweeperKeepsUpdatedMetric(t *testing.T) {
+	repo := NewRepository()
+	_, err := repo.Set(&Metrics{ID: "load", MType: GaugeMetric, Value: new(float64), UpdatedAt: &time.Time{}})
+	require.NoError(t, err)
+	sweeper := NewTTLSweeper(&updatingRepository{IMetricRepository: repo, update: NewGaugeMetrics("load", 1)}, TTLPolicy{Default: time.Minute})
+
+	assert.Empty(t, sweeper.Sweep(time.Now()))
+	metric, ok := repo.Get(&Metrics{ID: "load", MType: GaugeMetric})
+	require.True(t, ok)
+	assert.Equal(t, 1.0, *metric.Value)
+}
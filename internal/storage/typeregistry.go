@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"go.uber.org/zap"
+	"os"
+	"sort"
+	"sync"
+)
+
+var ErrTypeConflict = errors.New("metric name is taken by another type")
+
+// MetricDescriptor declares the type of a metric name with optional metadata
+type MetricDescriptor struct {
+	Name        string `json:"name"`
+	MType       string `json:"type"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+	Help        string `json:"help,omitempty"`
+}
+
+// Validate checks name and type of the descriptor
+func (d MetricDescriptor) Validate() error {
+	if !validNamePattern.MatchString(d.Name) {
+		return fmt.Errorf("not valid metric name %q", d.Name)
+	}
+	if _, err := ParseMetric(d.MType, d.Name, ""); err != nil {
+		return fmt.Errorf("metric %s: %w", d.Name, err)
+	}
+	return nil
+}
+
+// LoadDescriptors reads a JSON array of descriptors from path
+func LoadDescriptors(path string) ([]MetricDescriptor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res []MetricDescriptor
+	if err = json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("problems with reading metric declarations: %w", err)
+	}
+	return res, nil
+}
+
+// TypeRegistry keeps the type of every metric name, declared or first seen.
+// A name which is not declared is held while it has stored series or writes in flight, then any type may take it.
+// Declared metrics are saved to Path if it is set, so that declarations made through the API survive restarts
+type TypeRegistry struct {
+	Path     string
+	saveMu   sync.Mutex
+	mu       sync.RWMutex
+	types    map[string]string
+	declared map[string]MetricDescriptor
+	series   map[string]map[MetricHash]struct{}
+	inflight map[string]int
+}
+
+// Declare fixes the type of a name and its metadata
+func (r *TypeRegistry) Declare(d MetricDescriptor) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if mtype, ok := r.types[d.Name]; ok && mtype != d.MType {
+		return conflictError(d.Name, mtype)
+	}
+	r.types[d.Name] = d.MType
+	r.declared[d.Name] = d
+	return nil
+}
+
+// Describe returns the declaration of name, a nil registry knows nothing
+func (r *TypeRegistry) Describe(name string) (MetricDescriptor, bool) {
+	if r == nil {
+		return MetricDescriptor{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.declared[name]
+	return d, ok
+}
+
+// Unit returns the declared unit of name, it is empty for undeclared metrics
+func (r *TypeRegistry) Unit(name string) string {
+	d, _ := r.Describe(name)
+	return d.Unit
+}
+
+// Save writes declared metrics to Path
+func (r *TypeRegistry) Save() error {
+	if r.Path == "" {
+		return nil
+	}
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	data, err := json.Marshal(r.Declared())
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(r.Path, data); err != nil {
+		return fmt.Errorf("problems with saving metric declarations: %w", err)
+	}
+	return nil
+}
+
+// Load declares metrics saved to Path, a missing file is not an error
+func (r *TypeRegistry) Load() error {
+	if r.Path == "" {
+		return nil
+	}
+	descriptors, err := LoadDescriptors(r.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range descriptors {
+		if err = r.Declare(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Acquire holds name with mtype for a write, ErrTypeConflict is returned if the name has another type.
+// A successful Acquire must be followed by Commit or Abort
+func (r *TypeRegistry) Acquire(name, mtype string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if known, ok := r.types[name]; ok && known != mtype {
+		return conflictError(name, known)
+	}
+	r.types[name] = mtype
+	r.inflight[name]++
+	return nil
+}
+
+// Commit ends a write which stored the series of name
+func (r *TypeRegistry) Commit(name string, series MetricHash) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.series[name] == nil {
+		r.series[name] = make(map[MetricHash]struct{})
+	}
+	r.series[name][series] = struct{}{}
+	r.done(name)
+}
+
+// Abort ends a write which stored nothing
+func (r *TypeRegistry) Abort(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done(name)
+}
+
+// Forget tells that the series of name was deleted
+func (r *TypeRegistry) Forget(name string, series MetricHash) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.series[name], series)
+	r.freeIfUnused(name)
+}
+
+// done ends a write of name, r.mu must be held
+func (r *TypeRegistry) done(name string) {
+	if r.inflight[name]--; r.inflight[name] <= 0 {
+		delete(r.inflight, name)
+	}
+	r.freeIfUnused(name)
+}
+
+// freeIfUnused frees a name which is not declared and has neither series nor writes in flight, r.mu must be held
+func (r *TypeRegistry) freeIfUnused(name string) {
+	if len(r.series[name]) > 0 || r.inflight[name] > 0 {
+		return
+	}
+	delete(r.series, name)
+	if _, ok := r.declared[name]; !ok {
+		delete(r.types, name)
+	}
+}
+
+// Declared returns declared metrics ordered by name
+func (r *TypeRegistry) Declared() []MetricDescriptor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]MetricDescriptor, 0, len(r.declared))
+	for _, d := range r.declared {
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+func conflictError(name, mtype string) error {
+	return fmt.Errorf("metric %s is a %s: %w", name, mtype, ErrTypeConflict)
+}
+
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		types:    make(map[string]string),
+		declared: make(map[string]MetricDescriptor),
+		series:   make(map[string]map[MetricHash]struct{}),
+		inflight: make(map[string]int),
+	}
+}
+
+// TypeGuard rejects updates which would give a metric name a second type
+type TypeGuard struct {
+	IMetricRepository
+	registry *TypeRegistry
+}
+
+// acquire holds names of metrics for a write, on conflict names held so far are let go
+// and the index of the conflicting metric is returned
+func (tg *TypeGuard) acquire(metrics []Metrics) (int, error) {
+	for i := range metrics {
+		if err := tg.registry.Acquire(metrics[i].ID, metrics[i].MType); err != nil {
+			tg.finish(metrics[:i], false)
+			return i, err
+		}
+	}
+	return 0, nil
+}
+
+// finish ends the write of metrics acquired before, stored tells if their series were written
+func (tg *TypeGuard) finish(metrics []Metrics, stored bool) {
+	for i := range metrics {
+		if stored {
+			tg.registry.Commit(metrics[i].ID, metrics[i].GetHash())
+		} else {
+			tg.registry.Abort(metrics[i].ID)
+		}
+	}
+}
+
+func (tg *TypeGuard) Collect(metric *Metrics) (*Metrics, error) {
+	if _, err := tg.acquire([]Metrics{*metric}); err != nil {
+		return nil, err
+	}
+	m, err := tg.IMetricRepository.Collect(metric)
+	tg.finish([]Metrics{*metric}, err == nil)
+	return m, err
+}
+
+func (tg *TypeGuard) CollectBatch(metrics []Metrics) ([]Metrics, error) {
+	if index, err := tg.acquire(metrics); err != nil {
+		return nil, &BatchItemError{Index: index, Err: err}
+	}
+	res, err := tg.IMetricRepository.CollectBatch(metrics)
+	tg.finish(metrics, err == nil)
+	return res, err
+}
+
+func (tg *TypeGuard) Set(metric *Metrics) (*Metrics, error) {
+	if _, err := tg.acquire([]Metrics{*metric}); err != nil {
+		return nil, err
+	}
+	m, err := tg.IMetricRepository.Set(metric)
+	tg.finish([]Metrics{*metric}, err == nil)
+	return m, err
+}
+
+func (tg *TypeGuard) SetBatch(metrics []Metrics) ([]Metrics, error) {
+	if index, err := tg.acquire(metrics); err != nil {
+		return nil, &BatchItemError{Index: index, Err: err}
+	}
+	res, err := tg.IMetricRepository.SetBatch(metrics)
+	tg.finish(metrics, err == nil)
+	return res, err
+}
+
+// Delete frees the name once its last series is gone
+func (tg *TypeGuard) Delete(metric *Metrics) error {
+	if err := tg.IMetricRepository.Delete(metric); err != nil {
+		return err
+	}
+	tg.registry.Forget(metric.ID, metric.GetHash())
+	return nil
+}
+
+// NewTypeGuard registers names of metrics already in repository, the first type seen wins
+func NewTypeGuard(repository IMetricRepository, registry *TypeRegistry) *TypeGuard {
+	for _, m := range repository.GetAllMetrics() {
+		if err := registry.Acquire(m.ID, m.MType); err != nil {
+			logger.Log.Warn("stored metric conflicts with the type of its name", zap.String("id", m.ID), zap.Error(err))
+			continue
+		}
+		registry.Commit(m.ID, m.GetHash())
+	}
+	return &TypeGuard{IMetricRepository: repository, registry: registry}
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTypeRegistryDeclare(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "declarations.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name":"HeapAlloc","type":"gauge","unit":"bytes","description":"Heap in use","help":"runtime.MemStats.HeapAlloc"},
+		{"name":"PollCount","type":"counter"}
+	]`), 0o600))
+	descriptors, err := LoadDescriptors(path)
+	require.NoError(t, err)
+
+	registry := NewTypeRegistry()
+	for _, d := range descriptors {
+		require.NoError(t, registry.Declare(d))
+	}
+	assert.Equal(t, descriptors, registry.Declared())
+	assert.ErrorIs(t, registry.Declare(MetricDescriptor{Name: "PollCount", MType: GaugeMetric}), ErrTypeConflict)
+	assert.Error(t, registry.Declare(MetricDescriptor{Name: "1st", MType: GaugeMetric}))
+	assert.Error(t, registry.Declare(MetricDescriptor{Name: "Latency", MType: "timer"}))
+
+	// declared names are never freed
+	require.NoError(t, registry.Acquire("PollCount", CounterMetric))
+	registry.Abort("PollCount")
+	assert.ErrorIs(t, registry.Acquire("PollCount", GaugeMetric), ErrTypeConflict)
+}
+
+func TestTypeRegistryHoldsNameInFlight(t *testing.T) {
+	registry := NewTypeRegistry()
+	// A fails while B is still writing the same name, the name stays with B
+	require.NoError(t, registry.Acquire("Alloc", GaugeMetric))
+	require.NoError(t, registry.Acquire("Alloc", GaugeMetric))
+	registry.Abort("Alloc")
+	assert.ErrorIs(t, registry.Acquire("Alloc", CounterMetric), ErrTypeConflict)
+
+	series := NewGaugeMetrics("Alloc", 1).GetHash()
+	registry.Commit("Alloc", series)
+	assert.ErrorIs(t, registry.Acquire("Alloc", CounterMetric), ErrTypeConflict)
+	registry.Forget("Alloc", series)
+	require.NoError(t, registry.Acquire("Alloc", CounterMetric))
+}
+
+func TestTypeGuard(t *testing.T) {
+	repo := NewRepository()
+	_, err := repo.Collect(NewGaugeMetrics("Alloc", 1))
+	require.NoError(t, err)
+	guard := NewTypeGuard(repo, NewTypeRegistry())
+
+	_, err = guard.Collect(NewCounterMetrics("Alloc", 1))
+	assert.ErrorIs(t, err, ErrTypeConflict)
+	labeled := NewGaugeMetrics("Alloc", 2)
+	labeled.Labels = map[string]string{"host": "web01"}
+	_, err = guard.Collect(labeled)
+	require.NoError(t, err)
+
+	_, err = guard.CollectBatch([]Metrics{*NewCounterMetrics("PollCount", 1), *NewGaugeMetrics("PollCount", 1)})
+	var itemErr *BatchItemError
+	require.True(t, errors.As(err, &itemErr))
+	assert.Equal(t, 1, itemErr.Index)
+	assert.ErrorIs(t, err, ErrTypeConflict)
+	// names of a rejected batch are free again
+	_, err = guard.Collect(NewGaugeMetrics("PollCount", 1))
+	require.NoError(t, err)
+
+	require.NoError(t, guard.Delete(&Metrics{ID: "Alloc", MType: GaugeMetric}))
+	_, err = guard.Collect(NewCounterMetrics("Alloc", 1))
+	assert.ErrorIs(t, err, ErrTypeConflict, "a labeled series still holds the name")
+	require.NoError(t, guard.Delete(&Metrics{ID: "Alloc", MType: GaugeMetric, Labels: map[string]string{"host": "web01"}}))
+	_, err = guard.Collect(NewCounterMetrics("Alloc", 1))
+	assert.NoError(t, err)
+}
+
+func TestTypeRegistryPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json.metadata")
+	registry := NewTypeRegistry()
+	registry.Path = path
+	require.NoError(t, registry.Load())
+	require.NoError(t, registry.Declare(MetricDescriptor{Name: "HeapAlloc", MType: GaugeMetric, Unit: UnitBytes}))
+	require.NoError(t, registry.Save())
+
+	restored := NewTypeRegistry()
+	restored.Path = path
+	require.NoError(t, restored.Load())
+	d, ok := restored.Describe("HeapAlloc")
+	require.True(t, ok)
+	assert.Equal(t, UnitBytes, d.Unit)
+	assert.Equal(t, "", restored.Unit("Alloc"))
+
+	var none *TypeRegistry
+	assert.Equal(t, "", none.Unit("HeapAlloc"))
+}
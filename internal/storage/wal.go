@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rkinwork/musthave-metrics/internal/config"
+	"github.com/rkinwork/musthave-metrics/internal/logger"
+	"go.uber.org/zap"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	walSuffix                 = ".wal"
+	defaultCompactionInterval = 300 * time.Second
+	walOpSet                  = "set"
+	walOpDelete               = "delete"
+)
+
+func init() {
+	RegisterBackend(config.WALStorageType, func(cnf *config.Config) (IMetricSaver, error) {
+		ws := NewWALFileSaver(cnf.FileStoragePath, NewRepository())
+		ws.SnapshotHistory = cnf.SnapshotHistory
+		ws.RestoreFrom = cnf.RestoreFrom
+		return ws, nil
+	})
+}
+
+// walRecord is one line of the write-ahead log.
+// Metrics hold the state after the update, so replaying a record twice is harmless
+type walRecord struct {
+	Op      string        `json:"op"`
+	Metrics storedMetrics `json:"metrics"`
+}
+
+// WALFileSaver appends every accepted update to a log next to the snapshot.
+// Save folds the log into a fresh snapshot, Load replays snapshot and log
+type WALFileSaver struct {
+	JSONFileSaver
+	LogPath string
+	mu      sync.Mutex
+	log     *os.File
+}
+
+func (ws *WALFileSaver) LogsUpdates() bool {
+	return true
+}
+
+func (ws *WALFileSaver) Collect(metric *Metrics) (*Metrics, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	res, err := ws.logged(walOpSet, []Metrics{*metric}, func() ([]Metrics, error) {
+		m, err := ws.JSONFileSaver.Collect(metric)
+		if err != nil {
+			return nil, err
+		}
+		return []Metrics{*m}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res[0], nil
+}
+
+func (ws *WALFileSaver) CollectBatch(metrics []Metrics) ([]Metrics, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.logged(walOpSet, metrics, func() ([]Metrics, error) {
+		return ws.JSONFileSaver.CollectBatch(metrics)
+	})
+}
+
+func (ws *WALFileSaver) Set(metric *Metrics) (*Metrics, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	res, err := ws.logged(walOpSet, []Metrics{*metric}, func() ([]Metrics, error) {
+		m, err := ws.JSONFileSaver.Set(metric)
+		if err != nil {
+			return nil, err
+		}
+		return []Metrics{*m}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res[0], nil
+}
+
+func (ws *WALFileSaver) SetBatch(metrics []Metrics) ([]Metrics, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.logged(walOpSet, metrics, func() ([]Metrics, error) {
+		return ws.JSONFileSaver.SetBatch(metrics)
+	})
+}
+
+func (ws *WALFileSaver) Reset(metric *Metrics) (*Metrics, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	res, err := ws.logged(walOpSet, []Metrics{*metric}, func() ([]Metrics, error) {
+		m, err := ws.JSONFileSaver.Reset(metric)
+		if err != nil {
+			return nil, err
+		}
+		return []Metrics{*m}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res[0], nil
+}
+
+func (ws *WALFileSaver) Delete(metric *Metrics) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	_, err := ws.logged(walOpDelete, []Metrics{*metric}, func() ([]Metrics, error) {
+		if err := ws.JSONFileSaver.Delete(metric); err != nil {
+			return nil, err
+		}
+		return []Metrics{*metric}, nil
+	})
+	return err
+}
+
+// logged applies update and logs the metrics it returns.
+// If the record can't be written the metrics of scope get their previous state back,
+// so a client seeing the error may retry without the update being counted twice. ws.mu must be held
+func (ws *WALFileSaver) logged(op string, scope []Metrics, update func() ([]Metrics, error)) ([]Metrics, error) {
+	before := make([]Metrics, len(scope))
+	found := make([]bool, len(scope))
+	for i := range scope {
+		before[i], found[i] = ws.JSONFileSaver.Get(&scope[i])
+	}
+	res, err := update()
+	if err != nil {
+		return nil, err
+	}
+	if err = ws.appendRecord(walRecord{Op: op, Metrics: res}); err != nil {
+		for i := range scope {
+			ws.restore(&scope[i], before[i], found[i])
+		}
+		return nil, fmt.Errorf("problems with writing log: %w", err)
+	}
+	return res, nil
+}
+
+// restore puts back the state of metric read before a failed update
+func (ws *WALFileSaver) restore(metric *Metrics, before Metrics, found bool) {
+	var err error
+	if found {
+		_, err = ws.JSONFileSaver.Set(&before)
+	} else if _, exists := ws.JSONFileSaver.Get(metric); exists {
+		err = ws.JSONFileSaver.Delete(&Metrics{ID: metric.ID, MType: metric.MType, Labels: metric.Labels})
+	}
+	if err != nil {
+		logger.Log.Error("problems with rolling back metric", zap.String("id", metric.ID), zap.Error(err))
+	}
+}
+
+// Save writes a fresh snapshot and truncates the log
+func (ws *WALFileSaver) Save() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.compact(ws.JSONFileSaver.Save)
+}
+
+// SaveHistory compacts like Save and adds the snapshot to history
+func (ws *WALFileSaver) SaveHistory() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.compact(ws.JSONFileSaver.SaveHistory)
+}
+
+// compact folds the state into a snapshot written by save and truncates the log, ws.mu must be held
+func (ws *WALFileSaver) compact(save func() error) error {
+	if err := save(); err != nil {
+		return err
+	}
+	if ws.log != nil {
+		if err := ws.log.Close(); err != nil {
+			logger.Log.Error("problems with closing log", zap.Error(err))
+		}
+		ws.log = nil
+	}
+	if err := os.Truncate(ws.LogPath, 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Load restores the snapshot and replays the log on top of it.
+// A torn record at the end of the log is cut off so new records are not appended after it.
+// Restoring from a history snapshot discards the log, since it holds updates made on top of the current file
+func (ws *WALFileSaver) Load() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	path, err := ws.JSONFileSaver.load()
+	if err != nil {
+		return err
+	}
+	if path != "" && path != ws.FilePath {
+		return ws.compact(ws.JSONFileSaver.Save)
+	}
+	file, err := os.Open(ws.LogPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) {
+		err = file.Close()
+		if err != nil {
+			logger.Log.Error("problems with closing file", zap.Error(err))
+		}
+	}(file)
+
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var broken error
+	var replayed int64
+	for line := 1; sc.Scan(); line++ {
+		if broken != nil {
+			return broken
+		}
+		var rec walRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			broken = fmt.Errorf("corrupted log record at line %d: %w", line, err)
+			continue
+		}
+		ws.replay(rec)
+		replayed += int64(len(sc.Bytes())) + 1
+	}
+	if err = sc.Err(); err != nil {
+		return err
+	}
+	if broken != nil {
+		logger.Log.Warn("cutting off torn record at the end of log", zap.Error(broken))
+		return os.Truncate(ws.LogPath, replayed)
+	}
+	return nil
+}
+
+func (ws *WALFileSaver) replay(rec walRecord) {
+	for i := range rec.Metrics {
+		var err error
+		switch rec.Op {
+		case walOpSet:
+			_, err = ws.IMetricRepository.Set(&rec.Metrics[i])
+		case walOpDelete:
+			err = ws.IMetricRepository.Delete(&rec.Metrics[i])
+		default:
+			err = errors.New("unknown log operation " + rec.Op)
+		}
+		if err != nil {
+			logger.Log.Error("error while replaying metric", zap.Error(err))
+		}
+	}
+}
+
+// appendRecord writes rec as one line and syncs it to disk, ws.mu must be held
+func (ws *WALFileSaver) appendRecord(rec walRecord) error {
+	if ws.log == nil {
+		file, err := os.OpenFile(ws.LogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		ws.log = file
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = ws.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return ws.log.Sync()
+}
+
+// Close releases the log file
+func (ws *WALFileSaver) Close() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.log == nil {
+		return nil
+	}
+	err := ws.log.Close()
+	ws.log = nil
+	return err
+}
+
+func NewWALFileSaver(filePath string, repository IMetricRepository) *WALFileSaver {
+	return &WALFileSaver{
+		JSONFileSaver: JSONFileSaver{FilePath: filePath, IMetricRepository: repository},
+		LogPath:       filePath + walSuffix,
+	}
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWALFileSaverReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ws := NewWALFileSaver(path, NewRepository())
+
+	_, err := ws.Collect(NewCounterMetrics("clicks", 3))
+	require.NoError(t, err)
+	require.NoError(t, ws.Save())
+	_, err = ws.Collect(NewCounterMetrics("clicks", 4))
+	require.NoError(t, err)
+	_, err = ws.CollectBatch([]Metrics{*NewGaugeMetrics("load", 0.5), *NewGaugeMetrics("temp", 36.6)})
+	require.NoError(t, err)
+	require.NoError(t, ws.Delete(&Metrics{ID: "temp", MType: GaugeMetric}))
+	_, err = ws.Collect(NewCounterMetrics("errors", 2))
+	require.NoError(t, err)
+	_, err = ws.Reset(&Metrics{ID: "errors", MType: CounterMetric})
+	require.NoError(t, err)
+	_, err = ws.Set(NewGaugeMetrics("pushed", 2.5))
+	require.NoError(t, err)
+	require.NoError(t, ws.Close())
+
+	restored := NewWALFileSaver(path, NewRepository())
+	require.NoError(t, restored.Load())
+	metric, ok := restored.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(7), *metric.Delta)
+	metric, ok = restored.Get(&Metrics{ID: "load", MType: GaugeMetric})
+	require.True(t, ok)
+	assert.Equal(t, 0.5, *metric.Value)
+	_, ok = restored.Get(&Metrics{ID: "temp", MType: GaugeMetric})
+	assert.False(t, ok)
+	metric, ok = restored.Get(&Metrics{ID: "errors", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(0), *metric.Delta)
+	assert.NotNil(t, metric.ResetAt)
+	metric, ok = restored.Get(&Metrics{ID: "pushed", MType: GaugeMetric})
+	require.True(t, ok)
+	assert.Equal(t, 2.5, *metric.Value)
+
+	require.NoError(t, restored.Save())
+	info, err := os.Stat(restored.LogPath)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+}
+
+func TestWALFileSaverTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ws := NewWALFileSaver(path, NewRepository())
+	_, err := ws.Collect(NewCounterMetrics("clicks", 3))
+	require.NoError(t, err)
+	require.NoError(t, ws.Close())
+
+	file, err := os.OpenFile(ws.LogPath, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"set","metrics":[{"id":"clic`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	restored := NewWALFileSaver(path, NewRepository())
+	require.NoError(t, restored.Load())
+	metric, ok := restored.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(3), *metric.Delta)
+
+	_, err = restored.Collect(NewCounterMetrics("clicks", 1))
+	require.NoError(t, err)
+	require.NoError(t, restored.Close())
+	restored = NewWALFileSaver(path, NewRepository())
+	require.NoError(t, restored.Load())
+	metric, ok = restored.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(4), *metric.Delta)
+}
+
+func TestWALFileSaverRollback(t *testing.T) {
+	repo := NewRepository()
+	_, err := repo.Collect(NewCounterMetrics("clicks", 3))
+	require.NoError(t, err)
+	ws := NewWALFileSaver(filepath.Join(t.TempDir(), "metrics.json"), repo)
+	// a directory can't be opened as the log, so every append fails
+	ws.LogPath = t.TempDir()
+
+	_, err = ws.Collect(NewCounterMetrics("clicks", 4))
+	assert.Error(t, err)
+	_, err = ws.CollectBatch([]Metrics{*NewCounterMetrics("clicks", 1), *NewGaugeMetrics("load", 0.5)})
+	assert.Error(t, err)
+	_, err = ws.Set(NewGaugeMetrics("pushed", 1))
+	assert.Error(t, err)
+	_, err = ws.Reset(&Metrics{ID: "clicks", MType: CounterMetric})
+	assert.Error(t, err)
+
+	metric, ok := ws.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(3), *metric.Delta)
+	assert.Nil(t, metric.ResetAt)
+	_, ok = ws.Get(&Metrics{ID: "load", MType: GaugeMetric})
+	assert.False(t, ok)
+	_, ok = ws.Get(&Metrics{ID: "pushed", MType: GaugeMetric})
+	assert.False(t, ok)
+
+	assert.Error(t, ws.Delete(&Metrics{ID: "clicks", MType: CounterMetric}))
+	_, ok = ws.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	assert.True(t, ok)
+}
+
+func TestWALFileSaverRestoreFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ws := NewWALFileSaver(path, NewRepository())
+	ws.SnapshotHistory = 2
+	_, err := ws.Collect(NewCounterMetrics("clicks", 3))
+	require.NoError(t, err)
+	require.NoError(t, ws.SaveHistory())
+	_, err = ws.Collect(NewCounterMetrics("clicks", 4))
+	require.NoError(t, err)
+	require.NoError(t, ws.Close())
+
+	// latest resolves to the current file, so the log on top of it is replayed
+	restored := NewWALFileSaver(path, NewRepository())
+	restored.RestoreFrom = LatestSnapshot
+	require.NoError(t, restored.Load())
+	metric, ok := restored.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(7), *metric.Delta)
+	require.NoError(t, restored.Close())
+
+	snapshots, err := ws.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	restored = NewWALFileSaver(path, NewRepository())
+	restored.RestoreFrom = snapshots[1].Name
+	require.NoError(t, restored.Load())
+	metric, ok = restored.Get(&Metrics{ID: "clicks", MType: CounterMetric})
+	require.True(t, ok)
+	assert.Equal(t, int64(3), *metric.Delta)
+	info, err := os.Stat(restored.LogPath)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size(), "log made on top of the current file is discarded")
+}